@@ -0,0 +1,15 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+func main() {
+	os.Exit(fakessh.PackerDownload())
+}
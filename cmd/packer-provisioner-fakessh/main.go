@@ -5,12 +5,19 @@
 package main
 
 import (
+	"os"
+
 	"github.com/hashicorp/packer/packer/plugin"
 
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
 	. "github.com/leocp1/packer-provisioner-fakessh/pkg/provisioner"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == fakessh.SHELLSUBCOMMAND {
+		os.Exit(fakessh.Shell(os.Args[2:]))
+	}
+
 	var err error = nil
 	server, err := plugin.Server()
 	if err != nil {
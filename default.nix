@@ -8,14 +8,17 @@ buildGoModule rec {
   pname = "packer-provisioner-fakessh";
   version = "0.0.1";
   src = nixFilter (gitignoreSource ./.);
-  vendorSha256 = "1hafkq1djhfiw2f3gh36y1fhq6jknqy7qf5clbb841x2gws9kn0q";
+  vendorSha256 = "0fibdyg0n06r0vic69f79rksrgq8a1sqn1zkd2vpcwssx13ibwii";
   doCheck = true;
   patchPhase = ''
     substituteAllInPlace ./pkg/fakessh/utils.go
   '';
   postFixup = ''
     install -Dm755 $out/bin/ssh $out/share/bin/ssh
-    rm $out/bin/ssh
+    install -Dm755 $out/bin/scp $out/share/bin/scp
+    install -Dm755 $out/bin/packer-upload $out/share/bin/packer-upload
+    install -Dm755 $out/bin/packer-download $out/share/bin/packer-download
+    rm $out/bin/ssh $out/bin/scp $out/bin/packer-upload $out/bin/packer-download
   '';
   meta = with stdenv.lib; {
     description = "Packer provisioner with fake ssh command";
@@ -8,6 +8,11 @@ require (
 	github.com/hashicorp/packer v1.6.3
 	github.com/kardianos/osext v0.0.0-20170510131534-ae77be60afb1
 	github.com/keegancsmith/rpc v1.3.0
+	github.com/klauspost/compress v1.11.13
+	github.com/pkg/sftp v1.13.1
 	github.com/yookoala/realpath v1.0.0
-	golang.org/x/sys v0.0.0-20200615200032-f1bc736245b1
+	github.com/zclconf/go-cty v1.4.0
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
+	golang.org/x/net v0.0.0-20210226172049-e18ecbb05110
+	golang.org/x/sys v0.0.0-20210423185535-09eb48e85fd7
 )
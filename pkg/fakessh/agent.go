@@ -0,0 +1,222 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+const (
+	// Command accepting connections on a unix socket and multiplexing them
+	// over stdin and stdout, run by the Communicator for ssh -A.
+	// The directory of the socket is created first, only accessible by the
+	// user. Connections are multiplexed in the frames read by frameMux.
+	DEFAULTAGENTLISTENCOMMAND = `umask 077 && mkdir -p {{.Dir}} && ` +
+		`exec python3 -c '` + pythonMux + `' {{.Path}}`
+	// Directory of the forwarded agent sockets on the guest
+	AGENTSOCKETDIR = "/tmp"
+	// Time to wait for the forwarded agent socket before running the command
+	AGENTSOCKETTIMEOUT = 10 * time.Second
+)
+
+// Data available to agent listen command templates
+type AgentTemplate struct {
+	// The unix socket to listen on, quoted for a POSIX shell
+	Path string
+	// The directory of Path, quoted for a POSIX shell
+	Dir string
+}
+
+// Render an agent listen command template with data
+func RenderAgentCommand(tpl string, data *AgentTemplate) (string, error) {
+	return interpolate.Render(tpl, &interpolate.Context{Data: data})
+}
+
+// Build the command multiplexing the connections to c.ListenAgent, run as
+// the user of c.
+//
+// commUser is the user the Communicator runs commands as.
+func (ssh *RpcSsh) agentListenCommand(
+	c *RpcCmd,
+	commUser string,
+) (string, error) {
+	tpl := ssh.Config.AgentListenCommand
+	if tpl == "" {
+		tpl = DEFAULTAGENTLISTENCOMMAND
+	}
+	command, err := RenderAgentCommand(tpl, &AgentTemplate{
+		Path: ShellQuote(c.ListenAgent),
+		Dir:  ShellQuote(path.Dir(c.ListenAgent)),
+	})
+	if err != nil {
+		return "", err
+	}
+	return ssh.switchUser(command, c, commUser)
+}
+
+// Get the local agent socket to forward, from -A, -a or the ForwardAgent
+// option. Returns false if the agent is not forwarded.
+//
+// Like OpenSSH, ForwardAgent may name a socket or an environment variable
+// holding one instead of "yes".
+func (inv *Invocation) ForwardAgent() (string, bool) {
+	value := "no"
+	switch {
+	case inv.Flag('a'):
+	case inv.Flag('A'):
+		value = "yes"
+	default:
+		if v, ok := inv.Option("ForwardAgent"); ok {
+			value = v
+		}
+	}
+	switch strings.ToLower(value) {
+	case "no", "false":
+		return "", false
+	case "yes", "true":
+		return os.Getenv("SSH_AUTH_SOCK"), true
+	}
+	if strings.HasPrefix(value, "$") {
+		return os.Getenv(value[1:]), true
+	}
+	return inv.expandTokens(expandHome(value)), true
+}
+
+// Forwarding of a local agent to a socket on the guest
+type agentForwarder struct {
+	dir string
+	cmd Cmd
+	// The local agent socket
+	agent string
+	// The socket on the guest
+	Path string
+
+	cancel context.CancelFunc
+	// Closed when the agent listen command exits
+	done chan struct{}
+	// Connections to the local agent
+	m *frameMux
+}
+
+// Forward the agent of inv, if any, to a new socket on the guest for the
+// user and host of cmd, through the fake ssh server with working directory
+// dir. Returns nil if the agent is not forwarded.
+//
+// Unlike OpenSSH, a missing local agent is an error, since the command on
+// the guest would fail without it.
+func startAgentForward(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	cmd Cmd,
+) (*agentForwarder, error) {
+	sock, ok := inv.ForwardAgent()
+	if !ok {
+		return nil, nil
+	}
+	if sock == "" {
+		return nil, fmt.Errorf(
+			"Could not forward agent: no agent socket is set")
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("Could not forward agent: %s", err)
+	}
+	conn.Close()
+
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	a := &agentForwarder{
+		dir:   dir,
+		cmd:   cmd,
+		agent: sock,
+		Path: path.Join(
+			AGENTSOCKETDIR,
+			"ssh-fakessh-"+hex.EncodeToString(random),
+			fmt.Sprintf("agent.%d", os.Getpid()),
+		),
+		done: make(chan struct{}),
+	}
+
+	lctx, cancel := context.WithCancel(ctx)
+	a.cancel = cancel
+	stdin, w := net.Pipe()
+	r, stdout := net.Pipe()
+	a.m = newFrameMux(w, func() (net.Conn, error) {
+		return net.Dial("unix", a.agent)
+	})
+	listen := cmd
+	listen.ListenAgent = a.Path
+	listen.Stdin = stdin
+	listen.Stdout = stdout
+	listen.Stderr = noCloseFile{os.Stderr}
+	go func() {
+		defer close(a.done)
+		exitCode, err := RunCmd(lctx, dir, &listen)
+		if lctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			diagf(inv.Flag('q'), "agent forwarding failed: %s", err)
+		} else if exitCode != 0 {
+			diagf(inv.Flag('q'), "agent forwarding failed with exit code %d",
+				exitCode)
+		}
+	}()
+	go a.m.demux(r)
+
+	err = a.waitSocket(ctx)
+	if err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Wait until the agent listen command listens on the socket on the guest
+func (a *agentForwarder) waitSocket(ctx context.Context) error {
+	wctx, cancel := context.WithTimeout(ctx, AGENTSOCKETTIMEOUT)
+	defer cancel()
+	select {
+	case <-a.m.ready:
+		return nil
+	case <-a.done:
+		return fmt.Errorf("Could not forward agent")
+	case <-wctx.Done():
+		return fmt.Errorf(
+			"Could not forward agent: %s was not created", a.Path)
+	}
+}
+
+// Run command as the user of the agent socket on the guest
+func (a *agentForwarder) run(ctx context.Context, command string) (int, error) {
+	cmd := a.cmd
+	cmd.Command = command
+	cmd.NoStdin = true
+	cmd.Stdout = noCloseFile{os.Stderr}
+	cmd.Stderr = noCloseFile{os.Stderr}
+	return RunCmd(ctx, a.dir, &cmd)
+}
+
+// Stop forwarding the agent and remove the socket on the guest
+func (a *agentForwarder) Close() error {
+	a.cancel()
+	<-a.done
+	a.m.Close()
+	_, err := a.run(context.Background(), "rm -rf "+ShellQuote(path.Dir(a.Path)))
+	return err
+}
@@ -0,0 +1,152 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// Data available to command templates.
+//
+// Every field is quoted for a POSIX shell, so templates must not quote them
+// again.
+type CommandTemplate struct {
+	// The command to run
+	Command string
+	// The user of the ssh destination
+	User string
+	// The host of the ssh destination
+	Host string
+	// Accepted environment variables as POSIX shell assignments like
+	// NAME='value', separated by spaces
+	Env string
+	// The working directory of the fake ssh command
+	WorkDir string
+}
+
+// Render a command template with data
+func RenderCommand(tpl string, data *CommandTemplate) (string, error) {
+	return interpolate.Render(tpl, &interpolate.Context{Data: data})
+}
+
+// Build the command sent to the Communicator for c.
+//
+// commUser is the user the Communicator runs commands as.
+func (ssh *RpcSsh) remoteCommand(c *RpcCmd, commUser string) (string, error) {
+	command := c.Cmd
+	if command == "" {
+		command = LOGINSHELLCMD
+	}
+
+	accept := ssh.Config.AcceptEnv
+	if accept == nil {
+		accept = DefaultAcceptEnv
+	}
+	env := filterEnv(c.Env, accept)
+	// The forwarded agent is always set, like sshd does
+	if c.AgentSocket != "" {
+		env = append(env, "SSH_AUTH_SOCK="+c.AgentSocket)
+	}
+	command = EnvCommand(env, command)
+	if c.Pty != nil {
+		var err error = nil
+		command, err = ssh.ptyCommand(command, c)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if ssh.Config.ExecuteCommand != "" {
+		var err error = nil
+		command, err = RenderCommand(
+			ssh.Config.ExecuteCommand,
+			&CommandTemplate{
+				Command: ShellQuote(command),
+				User:    ShellQuote(c.User),
+				Host:    ShellQuote(c.Host),
+				Env:     strings.Join(ShellAssignments(env), " "),
+				WorkDir: ShellQuote(c.WorkDir),
+			},
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return ssh.switchUser(command, c, commUser)
+}
+
+// Wrap command with SwitchUserCommand to run it as the user of c, after
+// checking that the user is permitted.
+//
+// commUser is the user the Communicator runs commands as.
+func (ssh *RpcSsh) switchUser(
+	command string,
+	c *RpcCmd,
+	commUser string,
+) (string, error) {
+	err := ssh.permitUser(c, commUser)
+	if err != nil {
+		return "", err
+	}
+	if !ssh.switchesUser(c, commUser) {
+		return command, nil
+	}
+	return RenderCommand(
+		ssh.Config.SwitchUserCommand,
+		&CommandTemplate{
+			Command: ShellQuote(command),
+			User:    ShellQuote(c.User),
+			Host:    ShellQuote(c.Host),
+			WorkDir: ShellQuote(c.WorkDir),
+		},
+	)
+}
+
+// Check if the commands of c are switched to another user than commUser
+func (ssh *RpcSsh) switchesUser(c *RpcCmd, commUser string) bool {
+	return ssh.Config.SwitchUserCommand != "" &&
+		c.User != "" && c.User != commUser
+}
+
+// Check that the user of c may run commands.
+//
+// The user must be a valid login name, and match AllowedUsers unless it is
+// commUser, the user the Communicator runs commands as.
+func (ssh *RpcSsh) permitUser(c *RpcCmd, commUser string) error {
+	if c.User == "" {
+		return nil
+	}
+	if !ValidUserName(c.User) {
+		return fmt.Errorf("invalid user name %q", c.User)
+	}
+	if c.User == commUser {
+		return nil
+	}
+	if len(ssh.Config.AllowedUsers) > 0 &&
+		!MatchAnyPattern(c.User, ssh.Config.AllowedUsers) {
+		return fmt.Errorf("user %q is not permitted", c.User)
+	}
+	return nil
+}
+
+// Check if user is a POSIX portable login name: letters, digits, periods,
+// underscores and hyphens, not starting with a hyphen
+func ValidUserName(user string) bool {
+	if user == "" || user[0] == '-' {
+		return false
+	}
+	for i := 0; i < len(user); i++ {
+		b := user[i]
+		if !('a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' ||
+			'0' <= b && b <= '9' || b == '.' || b == '_' || b == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,386 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/ctxio"
+)
+
+const (
+	// Compression codecs of the streams between the fake ssh server and the
+	// guest, with the gzip and zstd commands of the guest or with python3
+	CODECGZIP       = "gzip"
+	CODECZSTD       = "zstd"
+	CODECPYTHONGZIP = "python3-gzip"
+	CODECPYTHONZSTD = "python3-zstd"
+
+	// Command printing the codec the guest supports, preferring the gzip
+	// and zstd commands over python3 and zstd over gzip.
+	// Prints nothing if the guest can not compress.
+	COMPRESSIONPROBECOMMAND = `if command -v mktemp >/dev/null 2>&1 && ` +
+		`command -v zstd >/dev/null 2>&1; then echo zstd; ` +
+		`elif command -v mktemp >/dev/null 2>&1 && ` +
+		`command -v gzip >/dev/null 2>&1; then echo gzip; ` +
+		`elif python3 -c 'import zstandard' >/dev/null 2>&1; ` +
+		`then echo python3-zstd; ` +
+		`elif python3 -c 'import zlib' >/dev/null 2>&1; ` +
+		`then echo python3-gzip; fi`
+
+	// Longest chunk of stdin compressed at once
+	COMPRESSIONCHUNK = 64 * 1024
+	// Longest chunk of stdin compressed as one member for the gzip and zstd
+	// commands of the guest, which are started again for each member
+	COMPRESSIONMEMBER = 1024 * 1024
+)
+
+// Compress stdin to stdout with the gzip or zstd command in $1, as one
+// member or frame for each read, so the output is flushed after each read.
+//
+// The commands only write their output once their buffers are full, which
+// would stall request-response protocols like nix-daemon --stdio, so each
+// read is compressed on its own.
+const shCompress = `t=$(mktemp) || exit; trap 'rm -f "$t"' EXIT; ` +
+	`while dd bs=65536 count=1 of="$t" 2>/dev/null && [ -s "$t" ]; do ` +
+	`"$1" -qc <"$t" || exit; done`
+
+// Decompress stdin to stdout with the gzip or zstd command in $1. Stdin is
+// a sequence of members or frames, each preceded by its length on a line
+// of its own, as written by compressStream.
+//
+// Each member is read with dd, which never reads past the requested
+// length, and decompressed once complete.
+const shDecompress = `t=$(mktemp) || exit; trap 'rm -f "$t"' EXIT; ` +
+	`while read n; do : >"$t"; s=0; while [ "$s" -lt "$n" ]; do ` +
+	`dd bs=$((n - s)) count=1 2>/dev/null >>"$t"; p=$s; ` +
+	`s=$(($(wc -c <"$t"))); [ "$s" -gt "$p" ] || exit 1; done; ` +
+	`"$1" -qdc <"$t" || exit; done`
+
+// Compress (c) or decompress (d) stdin to stdout with the codec in argv,
+// flushing after each read. Contains no single quotes.
+//
+// Used if the guest has no gzip or zstd command.
+const pythonCodec = `
+import os, sys, zlib
+mode, codec = sys.argv[1], sys.argv[2]
+if codec == "zstd":
+    import zstandard
+    if mode == "c":
+        z = zstandard.ZstdCompressor().compressobj()
+        def step(d):
+            return z.compress(d) + z.flush(zstandard.COMPRESSOBJ_FLUSH_BLOCK)
+        end = z.flush
+    else:
+        z = zstandard.ZstdDecompressor().decompressobj()
+        step = z.decompress
+        end = lambda: b""
+else:
+    if mode == "c":
+        z = zlib.compressobj(6, zlib.DEFLATED, 31)
+        def step(d):
+            return z.compress(d) + z.flush(zlib.Z_SYNC_FLUSH)
+        end = z.flush
+    else:
+        z = zlib.decompressobj(31)
+        step = z.decompress
+        end = z.flush
+def write(b):
+    while b:
+        b = b[os.write(1, b):]
+while True:
+    d = os.read(0, 65536)
+    if not d:
+        break
+    write(step(d))
+write(end())
+`
+
+// Get if -C or the Compression option request compression, as "yes" or
+// "no", or "" if neither was given
+func (inv *Invocation) Compression() string {
+	if inv.Flag('C') {
+		return "yes"
+	}
+	value, ok := inv.Option("Compression")
+	if !ok {
+		return ""
+	}
+	switch strings.ToLower(value) {
+	case "yes", "true":
+		return "yes"
+	}
+	return "no"
+}
+
+// Check if the streams of c are compressed, from the Compression of c and
+// the default of the server
+func (ssh *RpcSsh) compresses(c *RpcCmd) bool {
+	switch c.Compression {
+	case "yes":
+		return true
+	case "no":
+		return false
+	}
+	return ssh.Config.Compression
+}
+
+// Get the codec the guest of comm supports, or "" if it can not compress.
+//
+// The guest is probed once with COMPRESSIONPROBECOMMAND.
+func (ssh *RpcSsh) compressionCodec(
+	ctx context.Context,
+	comm packer.Communicator,
+) string {
+	ssh.L.RLock()
+	codec, ok := ssh.Codecs[comm]
+	ssh.L.RUnlock()
+	if ok {
+		return codec
+	}
+
+	stdout := &bytes.Buffer{}
+	cmd := &packer.RemoteCmd{
+		Command: COMPRESSIONPROBECOMMAND,
+		Stdout:  stdout,
+		Stderr:  ioutil.Discard,
+	}
+	err := comm.Start(ctx, cmd)
+	if err != nil {
+		return ""
+	}
+	cmd.Wait()
+	codec = strings.TrimSpace(stdout.String())
+	switch codec {
+	case CODECGZIP, CODECZSTD, CODECPYTHONGZIP, CODECPYTHONZSTD:
+	default:
+		codec = ""
+	}
+	// A cancelled probe is tried again by the next command
+	if ctx.Err() != nil {
+		return codec
+	}
+
+	ssh.L.Lock()
+	ssh.Codecs[comm] = codec
+	ssh.L.Unlock()
+	return codec
+}
+
+// Wrap command so its stdin is decompressed, if stdin is set, and its
+// stdout and stderr are compressed with codec on the guest. The exit code
+// of command is kept.
+//
+// The decompressor is not waited for, since it only exits once stdin is
+// closed, which happens after the command exits.
+func compressCommand(command string, codec string, stdin bool) string {
+	filter := func(mode string) string {
+		switch codec {
+		case CODECPYTHONGZIP:
+			return "python3 -c '" + pythonCodec + "' " + mode + " gzip"
+		case CODECPYTHONZSTD:
+			return "python3 -c '" + pythonCodec + "' " + mode + " zstd"
+		}
+		script := shCompress
+		if mode == "d" {
+			script = shDecompress
+		}
+		return "sh -c " + ShellQuote(script) + " sh " + codec
+	}
+	run := "sh -c " + ShellQuote(command) + " 3>&- 7<&- 8>&- 9>&-"
+	if stdin {
+		run = "{ " + filter("d") + " <&7 2>/dev/null 3>&- 7<&- 8>&- 9>&- & } | " +
+			run
+	}
+	return "exec 7<&0 8>&1 9>&2; " +
+		"s=$( { { { " + run + "; echo $? >&3; } | " +
+		filter("c") + " 3>&- 7<&- >&8; } 2>&1 | " +
+		filter("c") + " 3>&- 7<&- >&9; } 3>&1 ); " +
+		`exit "${s:-1}"`
+}
+
+// Run command on comm with its streams compressed with codec between the
+// server and the guest, and return its exit code
+func runCompressed(
+	ctx context.Context,
+	comm packer.Communicator,
+	command string,
+	codec string,
+	pipes RpcState,
+) (int, error) {
+	outR, outW := io.Pipe()
+	errR, errW := io.Pipe()
+	cmd := &packer.RemoteCmd{
+		Command: compressCommand(command, codec, pipes.Stdin != nil),
+		Stdout:  outW,
+		Stderr:  errW,
+	}
+	if pipes.Stdin != nil {
+		inR, inW := io.Pipe()
+		defer inR.Close()
+		cmd.Stdin = inR
+		go func() {
+			inW.CloseWithError(compressStream(
+				inW, ctxio.ReaderAdapter(ctx, pipes.Stdin), codec))
+		}()
+	}
+	decompress := func(w deadlineWriterCloser, r *io.PipeReader) chan error {
+		c := make(chan error, 1)
+		go func() {
+			err := decompressStream(ctxio.WriterAdapter(ctx, w), r, codec)
+			// Keep the Communicator from blocking on the rest
+			io.Copy(ioutil.Discard, r)
+			c <- err
+		}()
+		return c
+	}
+	outErr := decompress(pipes.Stdout, outR)
+	errErr := decompress(pipes.Stderr, errR)
+
+	err := comm.Start(ctx, cmd)
+	if err != nil {
+		outW.Close()
+		errW.Close()
+		return EXIT_FAILURE, err
+	}
+	exitCode := cmd.Wait()
+	outW.Close()
+	errW.Close()
+	if err := <-outErr; err != nil {
+		return exitCode, err
+	}
+	if err := <-errErr; err != nil {
+		return exitCode, err
+	}
+	return exitCode, nil
+}
+
+// Write the data read from r to w compressed with codec.
+//
+// The compressed data is flushed after each read, so the guest gets
+// requests as soon as they are written. For the gzip and zstd commands of
+// the guest, each read is a member or frame of its own preceded by its
+// length, since the commands would wait for more input otherwise.
+func compressStream(w io.Writer, r io.Reader, codec string) error {
+	switch codec {
+	case CODECGZIP, CODECZSTD:
+		return compressMembers(w, r, codec)
+	}
+
+	var zw interface {
+		io.WriteCloser
+		Flush() error
+	}
+	if codec == CODECPYTHONZSTD {
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		zw = enc
+	} else {
+		zw = gzip.NewWriter(w)
+	}
+
+	buf := make([]byte, COMPRESSIONCHUNK)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := zw.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if ferr := zw.Flush(); ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return zw.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write each read of r to w as a gzip member or zstd frame preceded by its
+// length, in the format read by shDecompress
+func compressMembers(w io.Writer, r io.Reader, codec string) error {
+	var enc *zstd.Encoder
+	if codec == CODECZSTD {
+		var err error
+		enc, err = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer enc.Close()
+	}
+
+	buf := make([]byte, COMPRESSIONMEMBER)
+	member := &bytes.Buffer{}
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			member.Reset()
+			if enc != nil {
+				member.Write(enc.EncodeAll(buf[:n], nil))
+			} else {
+				zw := gzip.NewWriter(member)
+				zw.Write(buf[:n])
+				zw.Close()
+			}
+			_, werr := fmt.Fprintf(w, "%d\n%s", member.Len(), member.Bytes())
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Write the data read from r to w decompressed with codec.
+//
+// Empty input is accepted as an empty stream, so the output of a guest
+// that wrote nothing is not an error.
+func decompressStream(w io.Writer, r io.Reader, codec string) error {
+	if codec == CODECZSTD || codec == CODECPYTHONZSTD {
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		_, err = io.Copy(w, dec)
+		return err
+	}
+
+	// Members are read one at a time, since a multistream gzip.Reader
+	// holds back the end of a member until the next one starts
+	br := bufio.NewReader(r)
+	gr, err := gzip.NewReader(br)
+	for err == nil {
+		gr.Multistream(false)
+		if _, err = io.Copy(w, gr); err != nil {
+			return err
+		}
+		err = gr.Reset(br)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
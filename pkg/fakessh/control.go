@@ -0,0 +1,315 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keegancsmith/rpc"
+)
+
+const (
+	// Multiplex commands of ssh -O answered by the fake ssh
+	CONTROLCHECK = "check"
+	CONTROLEXIT  = "exit"
+	CONTROLSTOP  = "stop"
+	// Register a ControlMaster session with the server
+	CONTROLOPEN = "open"
+	// End a ControlMaster session, keeping it for its ControlPersist time
+	CONTROLCLOSE = "close"
+)
+
+// RPC argument of RpcSsh.Control
+type RpcControl struct {
+	// A multiplex command, CONTROLOPEN or CONTROLCLOSE
+	Op string
+	// The expanded ControlPath of the session
+	Path string
+	// Time the session is kept after CONTROLCLOSE.
+	// 0 keeps it until CONTROLEXIT or CONTROLSTOP, a negative time drops it.
+	Persist time.Duration
+}
+
+// RPC reply of RpcSsh.Control
+type RpcControlReply struct {
+	// Whether a session was registered for the ControlPath before the call
+	Running bool
+	// Process id reported as the pid of the master
+	Pid int
+}
+
+// Answer a multiplex command for a ControlPath.
+//
+// The fake ssh has no master processes, so the server keeps a ControlMaster
+// session for each ControlPath instead. CONTROLOPEN only registers a session
+// if none is running.
+func (ssh *RpcSsh) Control(
+	ctx context.Context,
+	c *RpcControl,
+	reply *RpcControlReply,
+) error {
+	ssh.L.Lock()
+	defer ssh.L.Unlock()
+
+	expiry, ok := ssh.Masters[c.Path]
+	if ok && !expiry.IsZero() && time.Now().After(expiry) {
+		delete(ssh.Masters, c.Path)
+		ok = false
+	}
+	reply.Running = ok
+	reply.Pid = os.Getpid()
+
+	switch c.Op {
+	case CONTROLCHECK:
+	case CONTROLOPEN:
+		if !ok {
+			ssh.Masters[c.Path] = time.Time{}
+		}
+	case CONTROLCLOSE:
+		if !ok {
+			break
+		}
+		if c.Persist < 0 {
+			delete(ssh.Masters, c.Path)
+		} else if c.Persist > 0 {
+			ssh.Masters[c.Path] = time.Now().Add(c.Persist)
+		}
+	case CONTROLEXIT, CONTROLSTOP:
+		delete(ssh.Masters, c.Path)
+	default:
+		return fmt.Errorf("unsupported multiplex command %q", c.Op)
+	}
+	return nil
+}
+
+// Send a multiplex command to the fake ssh server with working directory dir
+func SendControl(
+	ctx context.Context,
+	dir string,
+	c *RpcControl,
+) (*RpcControlReply, error) {
+	udsDir := filepath.Join(dir, UDSPath)
+	cli, err := rpc.DialHTTP("unix", udsDir)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	reply := &RpcControlReply{}
+	err = cli.Call(ctx, "RpcSsh.Control", c, reply)
+	return reply, err
+}
+
+// Check if op is a multiplex command OpenSSH accepts with -O
+func isControlOp(op string) bool {
+	switch op {
+	case "check", "forward", "cancel", "exit", "stop", "proxy":
+		return true
+	}
+	return false
+}
+
+// Get the ControlPath from -S or the ControlPath option, with tokens
+// expanded. Returns false if it is unset or "none".
+func (inv *Invocation) ControlPath() (string, bool) {
+	path, ok := inv.FlagArg('S')
+	if !ok {
+		path, ok = inv.Option("ControlPath")
+	}
+	if !ok || path == "" || strings.EqualFold(path, "none") {
+		return "", false
+	}
+	return inv.expandTokens(expandHome(path)), true
+}
+
+// Get the ControlMaster mode: "yes", "no", "ask", "auto" or "autoask".
+//
+// Like OpenSSH, -M sets "yes" and -MM sets "ask".
+func (inv *Invocation) ControlMaster() string {
+	switch {
+	case inv.Flags['M'] == 1:
+		return "yes"
+	case inv.Flags['M'] > 1:
+		return "ask"
+	}
+	mode, ok := inv.Option("ControlMaster")
+	if !ok {
+		return "no"
+	}
+	switch mode = strings.ToLower(mode); mode {
+	case "true":
+		return "yes"
+	case "false":
+		return "no"
+	}
+	return mode
+}
+
+// Get the time a ControlMaster session is kept after it ends.
+//
+// Like RpcControl.Persist, 0 keeps it until it is stopped and a negative
+// time drops it.
+func (inv *Invocation) ControlPersist() (time.Duration, error) {
+	value, ok := inv.Option("ControlPersist")
+	if !ok {
+		return -1, nil
+	}
+	switch strings.ToLower(value) {
+	case "no", "false":
+		return -1, nil
+	case "yes", "true":
+		return 0, nil
+	}
+	persist, err := parseSshTime(value)
+	if err != nil {
+		return 0, &UsageError{
+			Msg: fmt.Sprintf("Bad ControlPersist time '%s'", value),
+		}
+	}
+	return persist, nil
+}
+
+// Parse an OpenSSH time like "90", "60s" or "1h30m".
+//
+// Units are s, m, h, d or w in any case. A number without a unit is in
+// seconds.
+func parseSshTime(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty time")
+	}
+	var total time.Duration
+	for len(s) > 0 {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("bad time %q", s)
+		}
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, err
+		}
+		unit := time.Second
+		if i < len(s) {
+			switch s[i] {
+			case 's', 'S':
+			case 'm', 'M':
+				unit = time.Minute
+			case 'h', 'H':
+				unit = time.Hour
+			case 'd', 'D':
+				unit = 24 * time.Hour
+			case 'w', 'W':
+				unit = 7 * 24 * time.Hour
+			default:
+				return 0, fmt.Errorf("bad time unit %q", s[i])
+			}
+			i++
+		}
+		total += time.Duration(n) * unit
+		s = s[i:]
+	}
+	return total, nil
+}
+
+// Answer the multiplex command op (ssh -O) and return the exit code.
+//
+// Like OpenSSH, the result is printed to stderr, and a missing master is
+// reported as a failed connection to its control socket.
+func controlCommand(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	op string,
+	quiet bool,
+) int {
+	path, ok := inv.ControlPath()
+	if !ok {
+		diagf(quiet, "No ControlPath specified for \"-O\" command")
+		return EXIT_FAILURE
+	}
+	if op != CONTROLCHECK && op != CONTROLEXIT && op != CONTROLSTOP {
+		diagf(quiet, "multiplex command %q is not supported", op)
+		return EXIT_FAILURE
+	}
+
+	reply, err := SendControl(ctx, dir, &RpcControl{Op: op, Path: path})
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	if !reply.Running {
+		diagf(quiet,
+			"Control socket connect(%s): No such file or directory", path)
+		return EXIT_FAILURE
+	}
+	switch op {
+	case CONTROLCHECK:
+		fmt.Fprintf(os.Stderr, "Master running (pid=%d)\r\n", reply.Pid)
+	case CONTROLEXIT:
+		fmt.Fprint(os.Stderr, "Exit request sent.\r\n")
+	case CONTROLSTOP:
+		fmt.Fprint(os.Stderr, "Stop listening request sent.\r\n")
+	}
+	return 0
+}
+
+// A ControlMaster session registered by this fake ssh
+type controlMaster struct {
+	dir     string
+	path    string
+	persist time.Duration
+}
+
+// Register a ControlMaster session if inv asks to be a master.
+//
+// Returns nil if inv is not a master, or if a session for the ControlPath is
+// already running and inv reuses it.
+func startMaster(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	quiet bool,
+) (*controlMaster, error) {
+	path, ok := inv.ControlPath()
+	mode := inv.ControlMaster()
+	if !ok || mode == "no" {
+		return nil, nil
+	}
+	persist, err := inv.ControlPersist()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := SendControl(ctx, dir, &RpcControl{Op: CONTROLOPEN, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Running {
+		if mode != "auto" && mode != "autoask" {
+			diagf(quiet,
+				"ControlSocket %s already exists, disabling multiplexing", path)
+		}
+		return nil, nil
+	}
+	return &controlMaster{dir: dir, path: path, persist: persist}, nil
+}
+
+// End the session, keeping it for its ControlPersist time
+func (m *controlMaster) Close() error {
+	_, err := SendControl(context.Background(), m.dir, &RpcControl{
+		Op:      CONTROLCLOSE,
+		Path:    m.path,
+		Persist: m.persist,
+	})
+	return err
+}
@@ -0,0 +1,90 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+func TestControlOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		path    string
+		master  string
+		persist time.Duration
+		err     bool
+	}{
+		{
+			name:    "none",
+			args:    []string{"ssh", "host"},
+			path:    "",
+			master:  "no",
+			persist: -1,
+		},
+		{
+			name: "ansible",
+			args: []string{"ssh", "-o", "ControlMaster=auto",
+				"-o", "ControlPersist=60s", "-o", "ControlPath=/cp/%r@%h:%p",
+				"-l", "root", "host"},
+			path:    "/cp/root@host:22",
+			master:  "auto",
+			persist: 60 * time.Second,
+		},
+		{
+			name: "flags first",
+			args: []string{"ssh", "-MM", "-o", "ControlMaster=no",
+				"-S", "/cp/%n", "-o", "ControlPath=/other",
+				"-o", "ControlPersist=yes", "host"},
+			path:    "/cp/host",
+			master:  "ask",
+			persist: 0,
+		},
+		{
+			name: "units",
+			args: []string{"ssh", "-S", "none", "-o", "ControlPersist=1h30M5",
+				"host"},
+			path:    "",
+			master:  "no",
+			persist: time.Hour + 30*time.Minute + 5*time.Second,
+		},
+		{
+			name: "bad persist",
+			args: []string{"ssh", "-o", "ControlPersist=5x", "host"},
+			err:  true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			persist, err := inv.ControlPersist()
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error for %#v", tt.args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed for %#v: %s", tt.args, err)
+			}
+			path, _ := inv.ControlPath()
+			master := inv.ControlMaster()
+			if path != tt.path || master != tt.master || persist != tt.persist {
+				t.Errorf(
+					"failed for %#v ... (got path %#v, master %#v, "+
+						"persist %s)",
+					tt.args, path, master, persist,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// Name of the subcommand of the provisioner executable opening a shell
+	// on the guest
+	SHELLSUBCOMMAND = "shell"
+)
+
+// Open an interactive login shell on the guest of a running fake ssh
+// server, with the arguments after SHELLSUBCOMMAND, and return its exit
+// code.
+//
+// The server is picked by the directory argument, or RPCDirEnvVarName if
+// there is none. Like ssh -t, the shell runs under a pseudo-terminal if
+// stdin is a terminal.
+func Shell(args []string) int {
+	flags := flag.NewFlagSet(SHELLSUBCOMMAND, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"usage: %s [-l user] [-host host] [dir]\n", SHELLSUBCOMMAND)
+		flags.PrintDefaults()
+	}
+	user := flags.String("l", "",
+		"run the shell as user, with switch_user_command")
+	host := flags.String("host", "",
+		"pick the guest like the host of an ssh destination")
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() > 1 {
+		if err == nil {
+			flags.Usage()
+		}
+		return EXIT_FAILURE
+	}
+	dir, ok := os.LookupEnv(RPCDirEnvVarName)
+	if flags.NArg() == 1 {
+		dir, ok = flags.Arg(0), true
+	}
+	if !ok {
+		fmt.Fprintf(os.Stderr, "shell: %s is not set\n", RPCDirEnvVarName)
+		return EXIT_FAILURE
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	defer signal.Stop(signalChan)
+	go func() {
+		select {
+		case <-signalChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// An unknown working directory is passed as the empty string
+	workDir, _ := os.Getwd()
+	cmd := &Cmd{
+		User:    *user,
+		Host:    *host,
+		WorkDir: workDir,
+		Stdin:   os.Stdin,
+		Stdout:  os.Stdout,
+		Stderr:  noCloseFile{os.Stderr},
+	}
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		pty, err := startPty(ctx, dir, cmd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shell: %s\n", err)
+			return EXIT_FAILURE
+		}
+		defer pty.Close()
+	}
+
+	cmd.Stdin, err = pollableStdin()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "shell: %s\n", err)
+		return EXIT_FAILURE
+	}
+
+	exitCode, err := RunCmd(ctx, dir, cmd)
+	if err != nil {
+		if ctx.Err() == nil {
+			fmt.Fprintf(os.Stderr, "shell: %s\n", err)
+		}
+		return EXIT_FAILURE
+	}
+	return exitCode
+}
@@ -0,0 +1,80 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"sort"
+	"strings"
+)
+
+var (
+	// Environment variables accepted by the fakessh server by default
+	DefaultAcceptEnv = []string{"LANG", "LC_*", "GIT_PROTOCOL"}
+)
+
+// Get the environment variables OpenSSH would send to the server.
+//
+// environ is the local environment, like the output of `os.Environ()`.
+// Variables are selected with every SendEnv option, where a pattern starting
+// with '-' removes earlier matching patterns. Variables from the first SetEnv
+// option are added after, overriding variables from SendEnv.
+// Returns a sorted slice of variable assignments.
+func (inv *Invocation) Env(environ []string) []string {
+	patterns := []string{}
+	setEnv := []string(nil)
+	for _, o := range inv.Options {
+		switch {
+		case strings.EqualFold(o.Key, "SendEnv"):
+			for _, p := range o.Args() {
+				if strings.HasPrefix(p, "-") {
+					kept := patterns[:0]
+					for _, q := range patterns {
+						if !MatchPattern(q, p[1:]) {
+							kept = append(kept, q)
+						}
+					}
+					patterns = kept
+				} else {
+					patterns = append(patterns, p)
+				}
+			}
+		case strings.EqualFold(o.Key, "SetEnv") && setEnv == nil:
+			setEnv = o.Args()
+		}
+	}
+
+	m := make(map[string]string)
+	for _, set := range environ {
+		ss := strings.SplitN(set, "=", 2)
+		if len(ss) == 2 && MatchAnyPattern(ss[0], patterns) {
+			m[ss[0]] = ss[1]
+		}
+	}
+	for _, set := range setEnv {
+		ss := strings.SplitN(set, "=", 2)
+		if len(ss) == 2 {
+			m[ss[0]] = ss[1]
+		}
+	}
+
+	env := make([]string, 0, len(m))
+	for name, val := range m {
+		env = append(env, name+"="+val)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// Keep the variable assignments in env with names matching accept
+func filterEnv(env []string, accept []string) []string {
+	filtered := make([]string, 0, len(env))
+	for _, set := range env {
+		ss := strings.SplitN(set, "=", 2)
+		if MatchAnyPattern(ss[0], accept) {
+			filtered = append(filtered, set)
+		}
+	}
+	return filtered
+}
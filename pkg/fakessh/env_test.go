@@ -0,0 +1,160 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+func TestInvocationEnv(t *testing.T) {
+	environ := []string{
+		"GIT_PROTOCOL=version=2",
+		"LANG=en_US.UTF-8",
+		"LC_ALL=C",
+		"LC_TIME=C",
+		"NIX_PATH=nixpkgs=/nix/var/nix/profiles/per-user/root/channels",
+		"HOME=/root",
+	}
+	tests := []struct {
+		name     string
+		input    []string
+		expected []string
+	}{
+		{
+			name:     "none",
+			input:    []string{"ssh", "host"},
+			expected: []string{},
+		},
+		{
+			name:     "git",
+			input:    []string{"ssh", "-o", "SendEnv=GIT_PROTOCOL", "host"},
+			expected: []string{"GIT_PROTOCOL=version=2"},
+		},
+		{
+			name: "patterns",
+			input: []string{"ssh", "-o", "SendEnv=LANG LC_*",
+				"-oSendEnv NIX_?ATH", "host"},
+			expected: []string{
+				"LANG=en_US.UTF-8",
+				"LC_ALL=C",
+				"LC_TIME=C",
+				"NIX_PATH=nixpkgs=/nix/var/nix/profiles/per-user/root/channels",
+			},
+		},
+		{
+			name: "remove patterns",
+			input: []string{"ssh", "-o", "SendEnv=LANG LC_*",
+				"-o", "SendEnv=-LC_*", "host"},
+			expected: []string{"LANG=en_US.UTF-8"},
+		},
+		{
+			name: "set env",
+			input: []string{"ssh", "-o", "SendEnv=LANG",
+				"-o", `SetEnv=LANG=C FOO="a b"`, "-o", "SetEnv=BAR=ignored",
+				"host"},
+			expected: []string{"FOO=a b", "LANG=C"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := inv.Env(environ)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v)",
+					tt.input,
+					tt.expected,
+					got,
+				)
+			}
+		})
+	}
+}
+
+func TestEnvCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      []string
+		cmd      string
+		expected string
+	}{
+		{
+			name:     "empty",
+			env:      []string{},
+			cmd:      "true",
+			expected: "true",
+		},
+		{
+			name:     "sorted",
+			env:      []string{"LANG=C", "GIT_PROTOCOL=version=2"},
+			cmd:      "git-upload-pack 'repo'",
+			expected: "export GIT_PROTOCOL='version=2' LANG='C'; git-upload-pack 'repo'",
+		},
+		{
+			name:     "quotes",
+			env:      []string{"A=it's $HOME `id`"},
+			cmd:      "true",
+			expected: `export A='it'\''s $HOME ` + "`id`" + `'; true`,
+		},
+		{
+			name:     "invalid names",
+			env:      []string{"1A=x", "A-B=x", "A;B=x", "NOVALUE"},
+			cmd:      "true",
+			expected: "true",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			got := EnvCommand(tt.env, tt.cmd)
+			if got != tt.expected {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v)",
+					tt.env,
+					tt.expected,
+					got,
+				)
+			}
+		})
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		s        string
+		pattern  string
+		expected bool
+	}{
+		{s: "LANG", pattern: "LANG", expected: true},
+		{s: "LANGUAGE", pattern: "LANG", expected: false},
+		{s: "LC_ALL", pattern: "LC_*", expected: true},
+		{s: "LC_", pattern: "LC_*", expected: true},
+		{s: "NIX_PATH", pattern: "NIX_?ATH", expected: true},
+		{s: "NIX_ATH", pattern: "NIX_?ATH", expected: false},
+		{s: "build.example.com", pattern: "*.example.*", expected: true},
+		{s: "example.com", pattern: "*.example.*", expected: false},
+		{s: "", pattern: "*", expected: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.pattern), func(t *testing.T) {
+			got := MatchPattern(tt.s, tt.pattern)
+			if got != tt.expected {
+				t.Errorf(
+					"MatchPattern(%#v, %#v) = %#v instead of %#v",
+					tt.s,
+					tt.pattern,
+					got,
+					tt.expected,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+// Requires POSIX shell commands and gzip, zstd or python3
+// +build linux
+
+package fakessh_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/localcommunicator"
+)
+
+// Bytes per second through the streams of a throttledComm
+const LINKRATE = 8 * 1024 * 1024
+
+// One direction of a link of LINKRATE bytes per second
+type link struct {
+	// When the data sent so far is through the link
+	free time.Time
+	L    sync.Mutex
+}
+
+// Wait until n more bytes went through l.
+//
+// Short waits are added up, since sleeps are not precise enough for the
+// small chunks of compressed streams.
+func (l *link) Send(n int) {
+	l.L.Lock()
+	now := time.Now()
+	if l.free.Before(now) {
+		l.free = now
+	}
+	l.free = l.free.Add(time.Duration(n) * time.Second / LINKRATE)
+	wait := l.free.Sub(now)
+	l.L.Unlock()
+	if wait > time.Millisecond {
+		time.Sleep(wait)
+	}
+}
+
+// Writer as slow as a link
+type throttledWriter struct {
+	W    io.Writer
+	Link *link
+}
+
+func (tw *throttledWriter) Write(p []byte) (n int, err error) {
+	tw.Link.Send(len(p))
+	return tw.W.Write(p)
+}
+
+// Reader as slow as a link
+type throttledReader struct {
+	R    io.Reader
+	Link *link
+}
+
+func (tr *throttledReader) Read(p []byte) (n int, err error) {
+	n, err = tr.R.Read(p)
+	tr.Link.Send(n)
+	return n, err
+}
+
+// Communicator with streams as slow as a network link, where stdout and
+// stderr share the downlink
+type throttledComm struct {
+	packer.Communicator
+	Up   link
+	Down link
+}
+
+func (c *throttledComm) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	if cmd.Stdin != nil {
+		cmd.Stdin = &throttledReader{cmd.Stdin, &c.Up}
+	}
+	if cmd.Stdout != nil {
+		cmd.Stdout = &throttledWriter{cmd.Stdout, &c.Down}
+	}
+	if cmd.Stderr != nil {
+		cmd.Stderr = &throttledWriter{cmd.Stderr, &c.Down}
+	}
+	return c.Communicator.Start(ctx, cmd)
+}
+
+// Benchmark sending text through a slow link with and without compression
+func BenchmarkCompression(b *testing.B) {
+	ctx := context.Background()
+
+	out, _ := exec.Command("sh", "-c", fakessh.COMPRESSIONPROBECOMMAND).Output()
+	if len(bytes.TrimSpace(out)) == 0 {
+		b.Skip("no compressor found")
+	}
+
+	var text bytes.Buffer
+	for i := 0; text.Len() < 16*1024*1024; i++ {
+		fmt.Fprintf(&text, "/nix/store/%032d-package-%d\n", i, i%97)
+	}
+
+	local, err := localcommunicator.New()
+	if err != nil {
+		b.Fatal(err)
+	}
+	srv, err := fakessh.NewServer(&throttledComm{Communicator: local}, "", nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	srvChan := make(chan error)
+	go func() {
+		srvChan <- srv.Serve()
+	}()
+
+	for _, compression := range []string{"no", "yes"} {
+		b.Run("compression-"+compression+"-16MiB", func(b *testing.B) {
+			b.SetBytes(int64(2 * text.Len()))
+			for i := 0; i < b.N; i++ {
+				stdout := &drwcBuffer{&bytes.Buffer{}}
+				cmd := &fakessh.Cmd{
+					Command:     "cat",
+					Compression: compression,
+					Stdin:       &drwcBuffer{bytes.NewBuffer(text.Bytes())},
+					Stdout:      stdout,
+					Stderr:      &drwcBuffer{&bytes.Buffer{}},
+				}
+				exitCode, err := fakessh.RunCmd(ctx, srv.Dir, cmd)
+				if err != nil || exitCode != 0 {
+					b.Fatal(exitCode, err)
+				}
+				if stdout.B.Len() != text.Len() {
+					b.Fatalf("got %d bytes", stdout.B.Len())
+				}
+			}
+		})
+	}
+
+	srv.Shutdown(ctx)
+	err = <-srvChan
+	if err != http.ErrServerClosed {
+		b.Error(err)
+	}
+}
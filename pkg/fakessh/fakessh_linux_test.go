@@ -0,0 +1,220 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// Requires Linux pseudo-terminals and the script of util-linux
+// +build linux
+
+package fakessh_test
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/localcommunicator"
+)
+
+// Open a new pseudo-terminal, returning its master and slave
+func openPty(t *testing.T) (master *os.File, slave *os.File) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		t.Skip("pseudo-terminals not available")
+	}
+	fd := int(master.Fd())
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	slave, err = os.OpenFile(
+		fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+	return master, slave
+}
+
+// Read lines from the pseudo-terminal master. Call the returned function to
+// wait for a line ending in want, after any escape sequences of a prompt,
+// calling retry periodically if it is not nil.
+func expectLines(
+	t *testing.T,
+	ctx context.Context,
+	master *os.File,
+) func(want string, retry func()) {
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(master)
+		for scanner.Scan() {
+			lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+		close(lines)
+	}()
+	return func(want string, retry func()) {
+		tick := time.NewTicker(200 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("expected %#v, but got EOF", want)
+				}
+				if strings.HasSuffix(line, want) {
+					return
+				}
+			case <-tick.C:
+				if retry != nil {
+					retry()
+				}
+			case <-ctx.Done():
+				t.Fatalf("expected %#v, but timed out", want)
+			}
+		}
+	}
+}
+
+func TestPty(t *testing.T) {
+	ctx := context.Background()
+
+	if err := exec.Command("script", "-qec", "true", "/dev/null").Run(); err != nil {
+		t.Skip("script of util-linux not found")
+	}
+
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+	setSize := func(rows uint16, cols uint16) {
+		err := unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ,
+			&unix.Winsize{Row: rows, Col: cols})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setSize(30, 100)
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "-t", "vm",
+		`echo "$TERM"; stty size; while read x; do stty size; done; echo end`)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	var err error
+	cmd.Env, err = fakessh.AddFakeSshPath(
+		[]string{"TERM=xterm"}, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitChan := make(chan int, 1)
+	go func() {
+		exitChan <- localcommunicator.RunExitCode(cmd)
+	}()
+
+	expect := expectLines(t, dctx, master)
+
+	expect("xterm", nil)
+	expect("30 100", nil)
+
+	// The window size follows the local terminal
+	setSize(40, 120)
+	expect("40 120", func() { master.Write([]byte("\n")) })
+
+	// The local terminal is raw, so ^D is passed to the guest
+	master.Write([]byte("\x04"))
+	expect("end", nil)
+	exitCode := <-exitChan
+	if exitCode != 0 {
+		t.Errorf("bad exit code %d", exitCode)
+	}
+
+	// The local terminal is restored
+	termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if termios.Lflag&unix.ICANON == 0 || termios.Lflag&unix.ECHO == 0 {
+		t.Errorf("local terminal not restored: %#v", termios)
+	}
+	flags, err := unix.FcntlInt(slave.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_NONBLOCK != 0 {
+		t.Errorf("local terminal left non-blocking")
+	}
+}
+
+// Run fakessh.Shell with the arguments after -- as a helper process of
+// TestShell
+func TestShellHelper(t *testing.T) {
+	if os.Getenv("FAKESSH_TEST_SHELL") != "1" {
+		return
+	}
+	os.Exit(fakessh.Shell(flag.Args()))
+}
+
+func TestShell(t *testing.T) {
+	ctx := context.Background()
+
+	if err := exec.Command("script", "-qec", "true", "/dev/null").Run(); err != nil {
+		t.Skip("script of util-linux not found")
+	}
+
+	master, slave := openPty(t)
+	defer master.Close()
+	defer slave.Close()
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	cmd := exec.CommandContext(dctx, os.Args[0],
+		"-test.run=^TestShellHelper$", "--", srvDir)
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	cmd.Env = append(os.Environ(), "FAKESSH_TEST_SHELL=1")
+	exitChan := make(chan int, 1)
+	go func() {
+		exitChan <- localcommunicator.RunExitCode(cmd)
+	}()
+	expect := expectLines(t, dctx, master)
+
+	// The login shell reads the terminal, once its profile is read
+	expect("42", func() {
+		master.Write([]byte("test -t 0 && echo $((6 * 7)); exit 3\n"))
+	})
+	exitCode := <-exitChan
+	if exitCode != 3 {
+		t.Errorf("bad exit code %d", exitCode)
+	}
+}
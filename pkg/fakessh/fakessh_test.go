@@ -57,6 +57,59 @@ func (tw *tWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Start a fakessh server with a local communicator and return its directory.
+// Call the returned function to shut it down.
+func startServer(t *testing.T, config *fakessh.ServerConfig) (
+	dir string,
+	shutdown func(),
+) {
+	comm, err := localcommunicator.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := fakessh.NewServer(comm, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvChan := make(chan error)
+	go func() {
+		srvChan <- srv.Serve()
+	}()
+	return srv.Dir, func() {
+		srv.Shutdown(context.Background())
+		err := <-srvChan
+		if err != http.ErrServerClosed {
+			t.Error(err)
+		}
+	}
+}
+
+// Find or build the fake ssh executable and its companion commands.
+// Call the returned function to clean up.
+func fakeSshExe(t *testing.T, ctx context.Context) (
+	sshExeDir string,
+	cleanup func(),
+) {
+	sshExeDir, ok := fakessh.FakeSshPath()
+	for _, exe := range []string{
+		fakessh.SCPEXENAME,
+		fakessh.UPLOADEXENAME,
+		fakessh.DOWNLOADEXENAME,
+	} {
+		_, err := os.Stat(filepath.Join(sshExeDir, exe))
+		ok = ok && err == nil
+	}
+	if ok {
+		return sshExeDir, func() {}
+	}
+	sshExeDir, err := fakessh.GoBuildFakeSsh(ctx)
+	if err != nil {
+		os.RemoveAll(sshExeDir)
+		t.Skip("ssh executable not found or buildable")
+	}
+	return sshExeDir, func() { os.RemoveAll(sshExeDir) }
+}
+
 func TestServer(t *testing.T) {
 	var err error = nil
 
@@ -67,7 +120,7 @@ func TestServer(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	srv, err := fakessh.NewServer(comm, "")
+	srv, err := fakessh.NewServer(comm, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -135,7 +188,7 @@ func TestFakessh(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	srv, err := fakessh.NewServer(comm, "")
+	srv, err := fakessh.NewServer(comm, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -215,7 +268,7 @@ func TestNixCopyClosure(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	srv, err := fakessh.NewServer(comm, "")
+	srv, err := fakessh.NewServer(comm, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
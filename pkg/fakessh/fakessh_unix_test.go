@@ -8,20 +8,32 @@
 package fakessh_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/packer/packer"
+	"github.com/pkg/sftp"
 	"github.com/yookoala/realpath"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/sys/unix"
 
 	"github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
 	"github.com/leocp1/packer-provisioner-fakessh/pkg/localcommunicator"
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/sshtest"
 )
 
 var tests = []struct {
@@ -92,7 +104,7 @@ func TestGitClone(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	srv, err := fakessh.NewServer(comm, "")
+	srv, err := fakessh.NewServer(comm, "", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -164,3 +176,3043 @@ func TestGitClone(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// Run the fake ssh command with flags that change its behaviour
+func TestFakesshFlags(t *testing.T) {
+	ctx := context.Background()
+
+	comm, err := localcommunicator.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := fakessh.NewServer(comm, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvChan := make(chan error)
+	go func() {
+		srvChan <- srv.Serve()
+	}()
+
+	sshExeDir, ok := fakessh.FakeSshPath()
+	if !ok {
+		sshExeDir, err = fakessh.GoBuildFakeSsh(ctx)
+		defer os.RemoveAll(sshExeDir)
+		if err != nil {
+			t.Skip("ssh executable not found or buildable")
+		}
+	}
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// Avoid login scripts of the user's shell in the login shell tests
+	shell, shellSet := os.LookupEnv("SHELL")
+	os.Setenv("SHELL", "/bin/sh")
+	defer func() {
+		if shellSet {
+			os.Setenv("SHELL", shell)
+		} else {
+			os.Unsetenv("SHELL")
+		}
+	}()
+
+	flagTests := []struct {
+		name     string
+		args     []string
+		env      []string
+		stdin    string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:     "stdin",
+			args:     []string{"user@host", "cat"},
+			stdin:    "test",
+			stdout:   "test",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "no stdin",
+			args:     []string{"-n", "user@host", "cat"},
+			stdin:    "test",
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "no tty",
+			args:     []string{"-Tn", "user@host", "printf", "test"},
+			stdin:    "",
+			stdout:   "test",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:   "tty without a terminal",
+			args:   []string{"-t", "user@host", "printf", "test"},
+			stdin:  "",
+			stdout: "test",
+			stderr: "ssh: Pseudo-terminal will not be allocated because " +
+				"stdin is not a terminal.\n",
+			exitCode: 0,
+		},
+		{
+			name: "forced tty",
+			args: []string{"-tt", "user@host",
+				"test -t 0 && test -t 1 && printf tty; printf err >&2; exit 3"},
+			stdin:    "",
+			stdout:   "ttyerr",
+			stderr:   "",
+			exitCode: 3,
+		},
+		{
+			name:     "login shell",
+			args:     []string{"user@host"},
+			stdin:    "echo test\nexit 3\n",
+			stdout:   "test\n",
+			stderr:   "",
+			exitCode: 3,
+		},
+		{
+			name:     "login shell without stdin",
+			args:     []string{"-n", "user@host"},
+			stdin:    "echo test\nexit 3\n",
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name: "send env",
+			args: []string{"-o", "SendEnv=GIT_PROTOCOL SECRET", "user@host",
+				`printf %s "$GIT_PROTOCOL:$SECRET"`},
+			env:      []string{"GIT_PROTOCOL=version=2", "SECRET=hunter2"},
+			stdin:    "",
+			stdout:   "version=2:",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name: "set env",
+			args: []string{"-o", `SetEnv=LANG="C.UTF-8" LC_ALL='it''s'`,
+				"user@host", `printf %s "$LANG:$LC_ALL"`},
+			stdin:    "",
+			stdout:   "C.UTF-8:its",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "quiet",
+			args:     []string{"-q", "-Z", "user@host", "true"},
+			stdin:    "",
+			stdout:   "",
+			stderr:   "",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "quiet remote stderr",
+			args:     []string{"-q", "user@host", "printf test 1>&2"},
+			stdin:    "",
+			stdout:   "",
+			stderr:   "test",
+			exitCode: 0,
+		},
+	}
+
+	for i, tt := range flagTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			stdin := bytes.NewBufferString(tt.stdin)
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			cmd.Stdin = stdin
+			cmd.Env, err = fakessh.AddFakeSshPath(tt.env, sshExeDir, srv.Dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			ok := true
+			ok = ok && stdout.String() == tt.stdout
+			ok = ok && stderr.String() == tt.stderr
+			ok = ok && exitCode == tt.exitCode
+			if !ok {
+				actual := struct {
+					stdout   string
+					stderr   string
+					exitCode int
+				}{
+					stdout:   stdout.String(),
+					stderr:   stderr.String(),
+					exitCode: exitCode,
+				}
+				t.Errorf("failed for %#v ... (actual: %#v)", tt, actual)
+			}
+		})
+	}
+
+	t.Run("no command", func(t *testing.T) {
+		dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+		defer cancel()
+
+		stderr := &bytes.Buffer{}
+		cmd := exec.CommandContext(dctx, sshExe, "-N", "user@host")
+		cmd.Stderr = stderr
+		cmd.Env, err = fakessh.AddFakeSshPath(cmd.Env, sshExeDir, srv.Dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = cmd.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		exitChan := make(chan int)
+		go func() {
+			exitCode := fakessh.EXIT_FAILURE
+			err := cmd.Wait()
+			if exitError, ok := err.(*exec.ExitError); ok {
+				exitCode = exitError.ExitCode()
+			} else if err == nil {
+				exitCode = 0
+			}
+			exitChan <- exitCode
+		}()
+
+		select {
+		case exitCode := <-exitChan:
+			t.Fatalf("ssh -N exited early with %d: %s", exitCode, stderr)
+		case <-time.After(time.Second):
+		}
+
+		cmd.Process.Signal(os.Interrupt)
+		exitCode := <-exitChan
+		if exitCode != fakessh.EXIT_FAILURE || stderr.String() != "" {
+			t.Errorf(
+				"ssh -N interrupted: exit code %d, stderr %#v",
+				exitCode,
+				stderr.String(),
+			)
+		}
+	})
+
+	srv.Shutdown(ctx)
+	err = <-srvChan
+	if err != http.ErrServerClosed {
+		t.Error(err)
+	}
+}
+
+// Run commands as the user of the destination
+func TestSwitchUser(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		SwitchUserCommand: "env FAKESSH_USER={{.User}} sh -c {{.Command}}",
+		AllowedUsers:      []string{"deploy", "build*"},
+		CommUser:          "packer",
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	userTests := []struct {
+		name     string
+		args     []string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:     "destination user",
+			args:     []string{"deploy@host", `printf %s "$FAKESSH_USER"`},
+			stdout:   "deploy",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name: "login name",
+			args: []string{"-l", "builder", "host",
+				`printf %s "$FAKESSH_USER"`},
+			stdout:   "builder",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "quoting",
+			args:     []string{"deploy@host", `printf '%s\n' "it's" | sort`},
+			stdout:   "it's\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "communicator user",
+			args:     []string{"packer@host", `printf %s "$FAKESSH_USER"`},
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "no user",
+			args:     []string{"host", `printf %s "$FAKESSH_USER"`},
+			stdout:   "",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "not permitted",
+			args:     []string{"root@host", "true"},
+			stdout:   "",
+			stderr:   "ssh: user \"root\" is not permitted\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "scp not permitted",
+			args:     []string{"root@host", "scp -t /tmp"},
+			stdout:   "",
+			stderr:   "ssh: user \"root\" is not permitted\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "rsync not permitted",
+			args:     []string{"root@host", "rsync --server -e.Lsfx . /tmp"},
+			stdout:   "",
+			stderr:   "ssh: user \"root\" is not permitted\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "semicolon in user",
+			args:     []string{"build;id@host", "true"},
+			stdout:   "",
+			stderr:   "ssh: invalid user name \"build;id\"\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "space in user",
+			args:     []string{"-l", "build id", "host", "true"},
+			stdout:   "",
+			stderr:   "ssh: invalid user name \"build id\"\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "command substitution in user",
+			args:     []string{"build$(id)@host", "true"},
+			stdout:   "",
+			stderr:   "ssh: invalid user name \"build$(id)\"\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+	}
+
+	for i, tt := range userTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			ok := true
+			ok = ok && stdout.String() == tt.stdout
+			ok = ok && stderr.String() == tt.stderr
+			ok = ok && exitCode == tt.exitCode
+			if !ok {
+				actual := struct {
+					stdout   string
+					stderr   string
+					exitCode int
+				}{
+					stdout:   stdout.String(),
+					stderr:   stderr.String(),
+					exitCode: exitCode,
+				}
+				t.Errorf("failed for %#v ... (actual: %#v)", tt, actual)
+			}
+		})
+	}
+}
+
+// Refuse destination users not in AllowedUsers without SwitchUserCommand
+func TestAllowedUsers(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		AllowedUsers: []string{"deploy"},
+		CommUser:     "packer",
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	userTests := []struct {
+		name     string
+		args     []string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:     "allowed user",
+			args:     []string{"deploy@host", "echo ok"},
+			stdout:   "ok\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "communicator user",
+			args:     []string{"packer@host", "echo ok"},
+			stdout:   "ok\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "no user",
+			args:     []string{"host", "echo ok"},
+			stdout:   "ok\n",
+			stderr:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "other user",
+			args:     []string{"root@host", "echo ok"},
+			stdout:   "",
+			stderr:   "ssh: user \"root\" is not permitted\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+	}
+
+	for i, tt := range userTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			ok := true
+			ok = ok && stdout.String() == tt.stdout
+			ok = ok && stderr.String() == tt.stderr
+			ok = ok && exitCode == tt.exitCode
+			if !ok {
+				actual := struct {
+					stdout   string
+					stderr   string
+					exitCode int
+				}{
+					stdout:   stdout.String(),
+					stderr:   stderr.String(),
+					exitCode: exitCode,
+				}
+				t.Errorf("failed for %#v ... (actual: %#v)", tt, actual)
+			}
+		})
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		ExecuteCommand: `export FAKESSH_ENV="{{.Env}}"; ` +
+			`cd {{.WorkDir}} && ` +
+			`FAKESSH_HOST={{.Host}} FAKESSH_USER={{.User}} sh -c {{.Command}}`,
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	workDir, err := ioutil.TempDir("", "fakessh-workdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir)
+	workDir, err = filepath.EvalSymlinks(workDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Shell syntax in the working directory is not run
+	workDir = filepath.Join(workDir, "work dir;$(exit 1)")
+	err = os.Mkdir(workDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTests := []struct {
+		name     string
+		args     []string
+		env      []string
+		stdout   string
+		exitCode int
+	}{
+		{
+			name: "destination",
+			args: []string{"deploy@example.com",
+				`printf %s@%s "$FAKESSH_USER" "$FAKESSH_HOST"`},
+			env:      nil,
+			stdout:   "deploy@example.com",
+			exitCode: 0,
+		},
+		{
+			name:     "working directory",
+			args:     []string{"host", "pwd"},
+			env:      nil,
+			stdout:   workDir + "\n",
+			exitCode: 0,
+		},
+		{
+			name: "environment",
+			args: []string{"-o", "SendEnv=LANG", "host",
+				`printf '%s\n' "$FAKESSH_ENV" "$LANG"`},
+			env:      []string{"LANG=C.UTF-8"},
+			stdout:   "LANG='C.UTF-8'\nC.UTF-8\n",
+			exitCode: 0,
+		},
+		{
+			name:     "exit code",
+			args:     []string{"host", "exit 3"},
+			env:      nil,
+			stdout:   "",
+			exitCode: 3,
+		},
+	}
+
+	for i, tt := range executeTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Dir = workDir
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(tt.env, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			ok := true
+			ok = ok && stdout.String() == tt.stdout
+			ok = ok && stderr.String() == ""
+			ok = ok && exitCode == tt.exitCode
+			if !ok {
+				actual := struct {
+					stdout   string
+					stderr   string
+					exitCode int
+				}{
+					stdout:   stdout.String(),
+					stderr:   stderr.String(),
+					exitCode: exitCode,
+				}
+				t.Errorf("failed for %#v ... (actual: %#v)", tt, actual)
+			}
+		})
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	ctx := context.Background()
+
+	sshSrv, err := sshtest.NewServer(
+		"tester", "secret", []string{"FAKESSH_HOSTNAME=second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshSrv.Close()
+	sshComm, err := sshSrv.Communicator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		SwitchUserCommand: "env FAKESSH_USER={{.User}} sh -c {{.Command}}",
+		CommUser:          "packer",
+		Routes: []fakessh.Route{
+			{
+				Hosts:    []string{"second", "*.second.test"},
+				Comm:     sshComm,
+				CommUser: "tester",
+			},
+			{
+				Hosts:    []string{"build"},
+				Comm:     nil,
+				CommUser: "packer",
+			},
+		},
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	routeTests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		stdout   string
+		exitCode int
+	}{
+		{
+			name: "second host",
+			args: []string{"second",
+				`printf %s "$FAKESSH_HOSTNAME"; exit 3`},
+			stdin:    "",
+			stdout:   "second",
+			exitCode: 3,
+		},
+		{
+			name:     "second host pattern",
+			args:     []string{"ssh://vm.second.test:2222", "cat"},
+			stdin:    "hello",
+			stdout:   "hello",
+			exitCode: 0,
+		},
+		{
+			name: "second host user",
+			args: []string{"tester@second",
+				`printf %s "$FAKESSH_USER"`},
+			stdin:    "",
+			stdout:   "",
+			exitCode: 0,
+		},
+		{
+			name: "build host",
+			args: []string{"build",
+				`printf %s "$FAKESSH_HOSTNAME"`},
+			stdin:    "",
+			stdout:   "",
+			exitCode: 0,
+		},
+		{
+			name: "unmatched host",
+			args: []string{"deploy@other",
+				`printf %s%s "$FAKESSH_HOSTNAME" "$FAKESSH_USER"`},
+			stdin:    "",
+			stdout:   "deploy",
+			exitCode: 0,
+		},
+	}
+
+	for i, tt := range routeTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Stdin = strings.NewReader(tt.stdin)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			ok := true
+			ok = ok && stdout.String() == tt.stdout
+			ok = ok && stderr.String() == ""
+			ok = ok && exitCode == tt.exitCode
+			if !ok {
+				actual := struct {
+					stdout   string
+					stderr   string
+					exitCode int
+				}{
+					stdout:   stdout.String(),
+					stderr:   stderr.String(),
+					exitCode: exitCode,
+				}
+				t.Errorf("failed for %#v ... (actual: %#v)", tt, actual)
+			}
+		})
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		MatchHosts: []string{"build", "*.build.test"},
+		Routes: []fakessh.Route{
+			{Hosts: []string{"second"}},
+		},
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// a real ssh later in PATH, printing its arguments and environment, and
+	// the ssh it would run itself
+	realDir, err := ioutil.TempDir("", "fakessh-real")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(realDir)
+	err = ioutil.WriteFile(
+		filepath.Join(realDir, "ssh"),
+		[]byte("#!/bin/sh\n"+
+			`printf '%s|' "$0" "$@" "$FAKESSH_TEST" `+
+			`"${PACKER_FAKE_SSH_RPC_DIR-unset}" "$(command -v ssh)"; `+
+			`cat; exit 7`+"\n"),
+		0755,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realSsh := filepath.Join(realDir, "ssh")
+
+	passTests := []struct {
+		name     string
+		args     []string
+		stdout   string
+		exitCode int
+	}{
+		{
+			name:     "matched host",
+			args:     []string{"build", "printf %s", "$FAKESSH_TEST"},
+			stdout:   "",
+			exitCode: 0,
+		},
+		{
+			name:     "matched pattern",
+			args:     []string{"git@vm.build.test", "cat"},
+			stdout:   "stdin",
+			exitCode: 0,
+		},
+		{
+			name:     "route host",
+			args:     []string{"second", "true"},
+			stdout:   "",
+			exitCode: 0,
+		},
+		{
+			name: "unmatched host",
+			args: []string{"-p", "2222", "git@github.com",
+				"git-upload-pack", "'repo'"},
+			stdout: realSsh + "|-p|2222|git@github.com|git-upload-pack|'repo'|" +
+				"passed|unset|" + realSsh + "|stdin",
+			exitCode: 7,
+		},
+		{
+			name:     "unmatched host configuration",
+			args:     []string{"-G", "github.com"},
+			stdout:   realSsh + "|-G|github.com|passed|unset|" + realSsh + "|stdin",
+			exitCode: 7,
+		},
+		{
+			name:     "unmatched host version",
+			args:     []string{"-V", "github.com"},
+			stdout:   realSsh + "|-V|github.com|passed|unset|" + realSsh + "|stdin",
+			exitCode: 7,
+		},
+	}
+
+	for i, tt := range passTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			// exec the fake ssh through PATH like a script does
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Stdin = strings.NewReader("stdin")
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(
+				[]string{
+					"PATH=" + realDir + ":" + os.Getenv("PATH"),
+					"FAKESSH_TEST=passed",
+				},
+				sshExeDir,
+				srvDir,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			ok := true
+			ok = ok && stdout.String() == tt.stdout
+			ok = ok && stderr.String() == ""
+			ok = ok && exitCode == tt.exitCode
+			if !ok {
+				actual := struct {
+					stdout   string
+					stderr   string
+					exitCode int
+				}{
+					stdout:   stdout.String(),
+					stderr:   stderr.String(),
+					exitCode: exitCode,
+				}
+				t.Errorf("failed for %#v ... (actual: %#v)", tt, actual)
+			}
+		})
+	}
+}
+
+func TestSshConfig(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		SwitchUserCommand: "env FAKESSH_USER={{.User}} sh -c {{.Command}}",
+		MatchHosts:        []string{"build.test"},
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	config, err := ioutil.TempFile("", "fakessh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config.Name())
+	_, err = config.WriteString("Host vm\n" +
+		"    HostName build.test\n" +
+		"    User deploy\n" +
+		"    SetEnv LC_FAKESSH=set\n" +
+		`    RemoteCommand printf %s:%s "$FAKESSH_USER" "$LC_FAKESSH"` + "\n")
+	config.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	cmd := exec.CommandContext(dctx, sshExe, "-F", config.Name(), "vm")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode := localcommunicator.RunExitCode(cmd)
+
+	if stdout.String() != "deploy:set" || stderr.String() != "" ||
+		exitCode != 0 {
+		t.Errorf(
+			"failed ... (actual: stdout %#v, stderr %#v, exit code %d)",
+			stdout.String(), stderr.String(), exitCode,
+		)
+	}
+}
+
+// ssh -V and ssh -G work without the provisioner
+func TestProbe(t *testing.T) {
+	ctx := context.Background()
+
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	probeTests := []struct {
+		name     string
+		args     []string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:     "version",
+			args:     []string{"-V"},
+			stderr:   fakessh.SSHVERSION + "\n",
+			exitCode: 0,
+		},
+		{
+			name: "config",
+			args: []string{"-F", "none", "-G", "-p", "2222", "root@vm"},
+			stdout: "user root\n" +
+				"hostname vm\n" +
+				"port 2222\n" +
+				"addressfamily any\n",
+			exitCode: 0,
+		},
+		{
+			name:     "config without destination",
+			args:     []string{"-F", "none", "-G"},
+			exitCode: fakessh.EXIT_FAILURE,
+			stderr:   "ssh: no destination given\n",
+		},
+	}
+
+	for i, tt := range probeTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe, tt.args...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			cmd.Env = []string{}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			// the defaults of ssh -G follow the lines of tt.stdout
+			if !strings.HasPrefix(stdout.String(), tt.stdout) ||
+				stderr.String() != tt.stderr || exitCode != tt.exitCode {
+				t.Errorf(
+					"failed for %#v ... (actual: stdout %#v, stderr %#v, "+
+						"exit code %d)",
+					tt.args, stdout.String(), stderr.String(), exitCode,
+				)
+			}
+		})
+	}
+}
+
+// Steps run in order, sharing the ControlMaster sessions of the server
+func TestControlMaster(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	path := "/tmp/fakessh-cm-%r@%h:%p"
+	expanded := "/tmp/fakessh-cm-root@vm:22"
+	running := fmt.Sprintf("Master running (pid=%d)\r\n", os.Getpid())
+	notRunning := "ssh: Control socket connect(" + expanded +
+		"): No such file or directory\n"
+
+	controlTests := []struct {
+		name     string
+		args     []string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:     "no master",
+			args:     []string{"-O", "check", "-S", path, "root@vm"},
+			stderr:   notRunning,
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "no control path",
+			args:     []string{"-O", "check", "root@vm"},
+			stderr:   "ssh: No ControlPath specified for \"-O\" command\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "master without persist",
+			args:     []string{"-M", "-S", path, "root@vm", "printf master"},
+			stdout:   "master",
+			exitCode: 0,
+		},
+		{
+			name:     "master ended",
+			args:     []string{"-O", "check", "-S", path, "root@vm"},
+			stderr:   notRunning,
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name: "auto master with persist",
+			args: []string{"-o", "ControlMaster=auto",
+				"-o", "ControlPersist=60s", "-o", "ControlPath=" + path,
+				"root@vm", "exit 3"},
+			exitCode: 3,
+		},
+		{
+			name:     "persisted master",
+			args:     []string{"-O", "check", "-S", path, "root@vm"},
+			stderr:   running,
+			exitCode: 0,
+		},
+		{
+			name: "reuse master",
+			args: []string{"-o", "ControlMaster=auto", "-S", path,
+				"root@vm", "printf reused"},
+			stdout:   "reused",
+			exitCode: 0,
+		},
+		{
+			name:     "exit master",
+			args:     []string{"-O", "exit", "-S", path, "root@vm"},
+			stderr:   "Exit request sent.\r\n",
+			exitCode: 0,
+		},
+		{
+			name:     "exited master",
+			args:     []string{"-O", "exit", "-S", path, "root@vm"},
+			stderr:   notRunning,
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+		{
+			name:     "background master",
+			args:     []string{"-fNM", "-S", path, "root@vm"},
+			exitCode: 0,
+		},
+		{
+			name:     "background master running",
+			args:     []string{"-O", "check", "-S", path, "root@vm"},
+			stderr:   running,
+			exitCode: 0,
+		},
+		{
+			name:     "stop master",
+			args:     []string{"-O", "stop", "-S", path, "root@vm"},
+			stderr:   "Stop listening request sent.\r\n",
+			exitCode: 0,
+		},
+		{
+			name:     "unsupported command",
+			args:     []string{"-O", "forward", "-S", path, "root@vm"},
+			stderr:   "ssh: multiplex command \"forward\" is not supported\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+	}
+
+	for i, tt := range controlTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe,
+				append([]string{"-F", "none"}, tt.args...)...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			if stdout.String() != tt.stdout || stderr.String() != tt.stderr ||
+				exitCode != tt.exitCode {
+				t.Errorf(
+					"failed for %#v ... (actual: stdout %#v, stderr %#v, "+
+						"exit code %d)",
+					tt.args, stdout.String(), stderr.String(), exitCode,
+				)
+			}
+		})
+	}
+}
+
+// Start a TCP server on localhost answering the first line of every
+// connection with "echo: " and the line, and return its port.
+// Call the returned function to stop it.
+func startEchoServer(t *testing.T) (port int, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprintf(conn, "echo: %s", line)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() { ln.Close() }
+}
+
+// Start a TCP server greeting each connection with "ready\n" before
+// answering one line like startEchoServer
+func startGreetingServer(t *testing.T) (port int, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprint(conn, "ready\n")
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprintf(conn, "echo: %s", line)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, func() { ln.Close() }
+}
+
+func TestStdioForward(t *testing.T) {
+	ctx := context.Background()
+
+	port, stop := startEchoServer(t)
+	defer stop()
+
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	forwardTests := []struct {
+		name     string
+		config   *fakessh.ServerConfig
+		args     []string
+		stdin    string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name:     "default relay",
+			config:   nil,
+			args:     []string{"-W", fmt.Sprintf("127.0.0.1:%d", port), "vm"},
+			stdin:    "hello\n",
+			stdout:   "echo: hello\n",
+			exitCode: 0,
+		},
+		{
+			name:   "command ignored",
+			config: nil,
+			args: []string{"-N", "-W", fmt.Sprintf("[127.0.0.1]:%d", port),
+				"vm", "echo", "ignored"},
+			stdin:    "hello\n",
+			stdout:   "echo: hello\n",
+			exitCode: 0,
+		},
+		{
+			name: "relay command",
+			config: &fakessh.ServerConfig{
+				RelayCommand: "printf '%s %s' {{.Host}} {{.Port}}",
+			},
+			args:     []string{"-W", "db.internal:5432", "vm"},
+			stdout:   "db.internal 5432",
+			exitCode: 0,
+		},
+		{
+			name:     "bad target",
+			config:   nil,
+			args:     []string{"-W", "db.internal", "vm"},
+			stderr:   "ssh: Bad stdio forwarding specification 'db.internal'\n",
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+	}
+
+	for i, tt := range forwardTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			srvDir, shutdown := startServer(t, tt.config)
+			defer shutdown()
+
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe,
+				append([]string{"-F", "none"}, tt.args...)...)
+			cmd.Stdin = strings.NewReader(tt.stdin)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			if stdout.String() != tt.stdout || stderr.String() != tt.stderr ||
+				exitCode != tt.exitCode {
+				t.Errorf(
+					"failed for %#v ... (actual: stdout %#v, stderr %#v, "+
+						"exit code %d)",
+					tt.args, stdout.String(), stderr.String(), exitCode,
+				)
+			}
+		})
+	}
+}
+
+// Like OpenSSH, the fake ssh exits with the command while the writer of
+// stdin keeps it open, and leaves the shared stdin blocking
+func TestStdinKeptOpen(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "vm", "echo done")
+	cmd.Stdin = pr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode := localcommunicator.RunExitCode(cmd)
+	if dctx.Err() != nil {
+		t.Fatal("fake ssh did not exit with the command")
+	}
+	if stdout.String() != "done\n" || exitCode != 0 {
+		t.Errorf("bad result: stdout %#v, stderr %#v, exit code %d",
+			stdout.String(), stderr.String(), exitCode)
+	}
+
+	rc, err := pr.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flags int
+	err = rc.Control(func(fd uintptr) {
+		flags, err = unix.FcntlInt(fd, unix.F_GETFL, 0)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_NONBLOCK != 0 {
+		t.Errorf("stdin left non-blocking")
+	}
+}
+
+func TestLocalForward(t *testing.T) {
+	ctx := context.Background()
+
+	port, stop := startEchoServer(t)
+	defer stop()
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "-N",
+		"-L", fmt.Sprintf("127.0.0.1:%d:localhost:%d", localPort, port), "vm")
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localAddr := fmt.Sprintf("127.0.0.1:%d", localPort)
+	for i := 0; i < 3; i++ {
+		var conn net.Conn
+		for {
+			conn, err = net.Dial("tcp", localAddr)
+			if err == nil || dctx.Err() != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "hello %d\n", i)
+		reply, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("connection %d: %s", i, err)
+		}
+		if string(reply) != fmt.Sprintf("echo: hello %d\n", i) {
+			t.Errorf("bad reply on connection %d: %#v", i, string(reply))
+		}
+	}
+
+	// A port in use fails with ExitOnForwardFailure
+	failCmd := exec.CommandContext(dctx, sshExe, "-F", "none",
+		"-o", "ExitOnForwardFailure=yes",
+		"-L", fmt.Sprintf("127.0.0.1:%d:localhost:%d", localPort, port),
+		"vm", "true")
+	failCmd.Env = cmd.Env
+	failStderr := &bytes.Buffer{}
+	failCmd.Stderr = failStderr
+	exitCode := localcommunicator.RunExitCode(failCmd)
+	if exitCode != fakessh.EXIT_FAILURE || !strings.Contains(
+		failStderr.String(), "Could not request local forwarding") {
+		t.Errorf("bad forward failure: %d %#v", exitCode, failStderr.String())
+	}
+
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+	if stderr.String() != "" {
+		t.Errorf("bad stderr: %#v", stderr.String())
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	ctx := context.Background()
+
+	port, stop := startEchoServer(t)
+	defer stop()
+	greetingPort, stopGreeting := startGreetingServer(t)
+	defer stopGreeting()
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// ports nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guestPort := ln.Addr().(*net.TCPAddr).Port
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	greetingGuestPort := ln2.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	ln2.Close()
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "-N",
+		"-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", guestPort, port),
+		"-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d",
+			greetingGuestPort, greetingPort),
+		"vm")
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guestAddr := fmt.Sprintf("127.0.0.1:%d", guestPort)
+	for i := 0; i < 3; i++ {
+		var conn net.Conn
+		for {
+			conn, err = net.Dial("tcp", guestAddr)
+			if err == nil || dctx.Err() != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "hello %d\n", i)
+		reply, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("connection %d: %s", i, err)
+		}
+		if string(reply) != fmt.Sprintf("echo: hello %d\n", i) {
+			t.Errorf("bad reply on connection %d: %#v", i, string(reply))
+		}
+	}
+
+	// Connections open at the same time to a server speaking first
+	greetingAddr := fmt.Sprintf("127.0.0.1:%d", greetingGuestPort)
+	conns := []net.Conn{}
+	readers := []*bufio.Reader{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", greetingAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(MAXTESTTIME))
+		r := bufio.NewReader(conn)
+		greeting, err := r.ReadString('\n')
+		if err != nil || greeting != "ready\n" {
+			t.Fatalf("bad greeting on connection %d: %#v %v", i, greeting, err)
+		}
+		conns = append(conns, conn)
+		readers = append(readers, r)
+	}
+	for i := len(conns) - 1; i >= 0; i-- {
+		fmt.Fprintf(conns[i], "hello %d\n", i)
+		reply, err := ioutil.ReadAll(readers[i])
+		if err != nil {
+			t.Fatalf("connection %d: %s", i, err)
+		}
+		if string(reply) != fmt.Sprintf("echo: hello %d\n", i) {
+			t.Errorf("bad reply on connection %d: %#v", i, string(reply))
+		}
+	}
+
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+	if stderr.String() != "" {
+		t.Errorf("bad stderr: %#v", stderr.String())
+	}
+
+	// The guest stops listening once the fake ssh exits
+	for {
+		conn, err := net.Dial("tcp", guestAddr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if dctx.Err() != nil {
+			t.Fatal("guest still listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The remote command connects to a remote forward as soon as it starts
+func TestRemoteForwardCommand(t *testing.T) {
+	ctx := context.Background()
+
+	port, stop := startEchoServer(t)
+	defer stop()
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// a port nothing listens on and a port in use
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guestPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	usedPort := used.Addr().(*net.TCPAddr).Port
+
+	client := fmt.Sprintf(`python3 -c 'import socket, sys
+c = socket.create_connection(("127.0.0.1", %d))
+c.sendall(b"hello\n")
+c.shutdown(socket.SHUT_WR)
+sys.stdout.write(c.makefile().read())'`, guestPort)
+
+	forwardTests := []struct {
+		name     string
+		args     []string
+		stdout   string
+		stderr   string
+		exitCode int
+	}{
+		{
+			name: "connect from command",
+			args: []string{
+				"-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", guestPort, port),
+				"vm", client},
+			stdout:   "echo: hello\n",
+			exitCode: 0,
+		},
+		{
+			name: "port in use",
+			args: []string{
+				"-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", usedPort, port),
+				"vm", "echo done"},
+			stdout: "done\n",
+			stderr: fmt.Sprintf("ssh: Warning: remote port forwarding "+
+				"failed for listen port %d\n", usedPort),
+			exitCode: 0,
+		},
+		{
+			name: "port in use with ExitOnForwardFailure",
+			args: []string{"-o", "ExitOnForwardFailure=yes",
+				"-R", fmt.Sprintf("127.0.0.1:%d:127.0.0.1:%d", usedPort, port),
+				"vm", "echo done"},
+			stderr: fmt.Sprintf("ssh: Error: remote port forwarding "+
+				"failed for listen port %d\n", usedPort),
+			exitCode: fakessh.EXIT_FAILURE,
+		},
+	}
+
+	for i, tt := range forwardTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+
+			cmd := exec.CommandContext(dctx, sshExe,
+				append([]string{"-F", "none"}, tt.args...)...)
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			var err error = nil
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+
+			if stdout.String() != tt.stdout || stderr.String() != tt.stderr ||
+				exitCode != tt.exitCode {
+				t.Errorf(
+					"failed for %#v ... (actual: stdout %#v, stderr %#v, "+
+						"exit code %d)",
+					tt.args, stdout.String(), stderr.String(), exitCode,
+				)
+			}
+		})
+	}
+}
+
+func TestDynamicForward(t *testing.T) {
+	ctx := context.Background()
+
+	port, stop := startEchoServer(t)
+	defer stop()
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// a port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksPort := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "-N",
+		"-D", fmt.Sprintf("127.0.0.1:%d", socksPort), "vm")
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	portBytes := []byte{byte(port >> 8), byte(port)}
+	socksTests := []struct {
+		name    string
+		request []byte
+		reply   []byte
+	}{
+		{
+			name: "socks5 domain",
+			request: append(append([]byte{
+				5, 1, 0,
+				5, 1, 0, 3, 9}, "localhost"...), portBytes...),
+			reply: []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "socks5 ipv4",
+			request: append([]byte{
+				5, 2, 2, 0,
+				5, 1, 0, 1, 127, 0, 0, 1}, portBytes...),
+			reply: []byte{5, 0, 5, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "socks4",
+			request: append(append([]byte{4, 1}, portBytes...),
+				127, 0, 0, 1, 'u', 0),
+			reply: []byte{0, 0x5a, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name: "socks4a",
+			request: append(append(append([]byte{4, 1}, portBytes...),
+				0, 0, 0, 1, 0), "localhost\x00"...),
+			reply: []byte{0, 0x5a, 0, 0, 0, 0, 0, 0},
+		},
+	}
+
+	socksAddr := fmt.Sprintf("127.0.0.1:%d", socksPort)
+	for i, tt := range socksTests {
+		var conn net.Conn
+		for {
+			conn, err = net.Dial("tcp", socksAddr)
+			if err == nil || dctx.Err() != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(tt.request)
+		fmt.Fprintf(conn, "hello %d\n", i)
+		reply, err := ioutil.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		expected := string(tt.reply) + fmt.Sprintf("echo: hello %d\n", i)
+		if string(reply) != expected {
+			t.Errorf("%s: bad reply %#v", tt.name, string(reply))
+		}
+	}
+
+	cmd.Process.Signal(os.Interrupt)
+	cmd.Wait()
+	if stderr.String() != "" {
+		t.Errorf("bad stderr: %#v", stderr.String())
+	}
+}
+
+func TestProxyJumpCommand(t *testing.T) {
+	ctx := context.Background()
+
+	// an ssh on the guest printing its user and arguments
+	guestBin, err := ioutil.TempDir("", "fakessh-guest-bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(guestBin)
+	err = ioutil.WriteFile(
+		filepath.Join(guestBin, "ssh"),
+		[]byte("#!/bin/sh\nprintf '%s\\n' \"$FAKESSH_USER\" \"$@\"\ncat\n"),
+		0755,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The destination is only reached through the handled jump host
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		ExecuteCommand: "export PATH=" + fakessh.ShellQuote(guestBin) +
+			`:"$PATH" FAKESSH_USER={{.User}}; sh -c {{.Command}}`,
+		MatchHosts: []string{"vm"},
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none",
+		"-J", "builder@vm,gw", "-l", "root", "internal", "echo", "it's")
+	cmd.Stdin = strings.NewReader("input\n")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode := localcommunicator.RunExitCode(cmd)
+
+	expected := "builder\n-J\ngw\n-l\nroot\n--\ninternal\necho it's\ninput\n"
+	if exitCode != 0 || stdout.String() != expected || stderr.String() != "" {
+		t.Errorf("bad jump: %d %#v %#v",
+			exitCode, stdout.String(), stderr.String())
+	}
+}
+
+func TestAgentForward(t *testing.T) {
+	ctx := context.Background()
+
+	if _, err := exec.LookPath("ssh-add"); err != nil {
+		t.Skip("ssh-add not found")
+	}
+
+	// a local agent holding one key
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "fakessh-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentDir, err := ioutil.TempDir("", "fakessh-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(agentDir)
+	agentSock := filepath.Join(agentDir, "agent.sock")
+	ln, err := net.Listen("unix", agentSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "-A", "vm",
+		`echo "$SSH_AUTH_SOCK" && ssh-add -l && ssh-add -l`)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(
+		[]string{"SSH_AUTH_SOCK=" + agentSock}, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode := localcommunicator.RunExitCode(cmd)
+
+	lines := strings.Split(stdout.String(), "\n")
+	if exitCode != 0 || len(lines) != 4 || stderr.String() != "" ||
+		!strings.Contains(lines[1], "fakessh-test") ||
+		!strings.Contains(lines[2], "fakessh-test") {
+		t.Fatalf("bad agent forward: %d %#v %#v",
+			exitCode, stdout.String(), stderr.String())
+	}
+	// The socket is removed with the fake ssh
+	if _, err := os.Stat(filepath.Dir(lines[0])); !os.IsNotExist(err) {
+		t.Errorf("agent socket %s not removed: %v", lines[0], err)
+	}
+
+	// Without an agent, -A fails
+	stderr.Reset()
+	cmd = exec.CommandContext(dctx, sshExe, "-F", "none", "-A", "vm", "true")
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode = localcommunicator.RunExitCode(cmd)
+	if exitCode != fakessh.EXIT_FAILURE ||
+		!strings.Contains(stderr.String(), "Could not forward agent") {
+		t.Errorf("bad missing agent: %d %#v", exitCode, stderr.String())
+	}
+}
+
+// Communicator recording the commands it starts. If NoCodec is set, the
+// guest appears to have no compressor, and if Codec is set, it appears to
+// support only Codec.
+type recordComm struct {
+	packer.Communicator
+	NoCodec  bool
+	Codec    string
+	Commands []string
+	L        sync.Mutex
+}
+
+func (c *recordComm) Start(ctx context.Context, cmd *packer.RemoteCmd) error {
+	c.L.Lock()
+	c.Commands = append(c.Commands, cmd.Command)
+	c.L.Unlock()
+	if cmd.Command == fakessh.COMPRESSIONPROBECOMMAND {
+		switch {
+		case c.NoCodec:
+			cmd.Command = "true"
+		case c.Codec != "":
+			cmd.Command = "echo " + c.Codec
+		}
+	}
+	return c.Communicator.Start(ctx, cmd)
+}
+
+// Check if the last command started by c was compressed
+func (c *recordComm) Compressed() bool {
+	c.L.Lock()
+	defer c.L.Unlock()
+	if len(c.Commands) == 0 {
+		return false
+	}
+	return strings.HasPrefix(c.Commands[len(c.Commands)-1], "exec 7<&0")
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+
+	var long strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&long, "line %d\n", i)
+	}
+
+	compressionTests := []struct {
+		name        string
+		server      bool
+		compression string
+		noCodec     bool
+		codec       string
+		compressed  bool
+	}{
+		{
+			name:       "server default",
+			server:     true,
+			compressed: true,
+		},
+		{
+			name:        "requested",
+			compression: "yes",
+			compressed:  true,
+		},
+		{
+			name:        "refused",
+			server:      true,
+			compression: "no",
+			compressed:  false,
+		},
+		{
+			name:        "gzip command",
+			compression: "yes",
+			codec:       fakessh.CODECGZIP,
+			compressed:  true,
+		},
+		{
+			name:        "zstd command",
+			compression: "yes",
+			codec:       fakessh.CODECZSTD,
+			compressed:  true,
+		},
+		{
+			name:        "python3 gzip",
+			compression: "yes",
+			codec:       fakessh.CODECPYTHONGZIP,
+			compressed:  true,
+		},
+		{
+			name:        "no codec on guest",
+			compression: "yes",
+			noCodec:     true,
+			compressed:  false,
+		},
+	}
+
+	for i, ct := range compressionTests {
+		t.Run(fmt.Sprintf("%d: %s", i, ct.name), func(t *testing.T) {
+			codec := ct.codec
+			if codec == "" && !ct.noCodec {
+				out, _ := exec.Command(
+					"sh", "-c", fakessh.COMPRESSIONPROBECOMMAND).Output()
+				codec = strings.TrimSpace(string(out))
+			}
+			switch codec {
+			case "":
+				if !ct.noCodec {
+					t.Skip("no compressor found")
+				}
+			case fakessh.CODECPYTHONGZIP:
+				err := exec.Command("python3", "-c", "import zlib").Run()
+				if err != nil {
+					t.Skip("python3 with zlib not found")
+				}
+			default:
+				if _, err := exec.LookPath(codec); err != nil {
+					t.Skipf("%s not found", codec)
+				}
+			}
+
+			local, err := localcommunicator.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			comm := &recordComm{
+				Communicator: local,
+				NoCodec:      ct.noCodec,
+				Codec:        ct.codec,
+			}
+			srv, err := fakessh.NewServer(comm, "", &fakessh.ServerConfig{
+				Compression: ct.server,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			srvChan := make(chan error)
+			go func() {
+				srvChan <- srv.Serve()
+			}()
+			defer func() {
+				srv.Shutdown(ctx)
+				if err := <-srvChan; err != http.ErrServerClosed {
+					t.Error(err)
+				}
+			}()
+
+			streamTests := append([]struct {
+				name     string
+				cmd      string
+				stdin    string
+				stdout   string
+				stderr   string
+				exitCode int
+			}{
+				{
+					name:     "long stdin",
+					cmd:      "cat; printf done 1>&2",
+					stdin:    long.String(),
+					stdout:   long.String(),
+					stderr:   "done",
+					exitCode: 0,
+				},
+			}, tests[:len(tests)-1]...)
+			for _, tt := range streamTests {
+				stdout := &drwcBuffer{&bytes.Buffer{}}
+				stderr := &drwcBuffer{&bytes.Buffer{}}
+				stdin := &drwcBuffer{bytes.NewBufferString(tt.stdin)}
+				cmd := &fakessh.Cmd{
+					Command:     tt.cmd,
+					Compression: ct.compression,
+					Stdin:       stdin,
+					Stdout:      stdout,
+					Stderr:      stderr,
+				}
+
+				dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+				exitCode, err := fakessh.RunCmd(dctx, srv.Dir, cmd)
+				cancel()
+				if err != nil {
+					t.Error(err)
+				}
+
+				if stdout.B.String() != tt.stdout ||
+					stderr.B.String() != tt.stderr ||
+					exitCode != tt.exitCode {
+					t.Errorf(
+						"failed for %s ... (actual: stdout %d bytes, "+
+							"stderr %#v, exit code %d)",
+						tt.name, stdout.B.Len(), stderr.B.String(), exitCode,
+					)
+				}
+				if comm.Compressed() != ct.compressed {
+					t.Errorf("failed for %s ... (compressed: %v)",
+						tt.name, comm.Compressed())
+				}
+			}
+
+			// A request is answered before stdin ends
+			inR, inW, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inW.Close()
+			outR, outW, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer outR.Close()
+			cmd := &fakessh.Cmd{
+				Command:     "read l && echo \"$l\" && cat >/dev/null",
+				Compression: ct.compression,
+				Stdin:       inR,
+				Stdout:      outW,
+				Stderr:      &drwcBuffer{&bytes.Buffer{}},
+			}
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+			runChan := make(chan error, 1)
+			go func() {
+				_, err := fakessh.RunCmd(dctx, srv.Dir, cmd)
+				runChan <- err
+			}()
+			fmt.Fprintln(inW, "request")
+			outR.SetReadDeadline(time.Now().Add(MAXTESTTIME))
+			line, err := bufio.NewReader(outR).ReadString('\n')
+			if err != nil || line != "request\n" {
+				t.Errorf("no response before stdin ended: %#v %v", line, err)
+			}
+			inW.Close()
+			if err := <-runChan; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSftp(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	dir, err := ioutil.TempDir("", "fakessh-sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+	defer cancel()
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(dctx, sshExe, "-F", "none", "-s", "vm", "sftp")
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := client.Getwd()
+	if err != nil || wd != filepath.Clean(os.Getenv("HOME")) {
+		t.Errorf("bad working directory: %#v %v", wd, err)
+	}
+
+	sub := filepath.Join(dir, "sub")
+	if err := client.Mkdir(sub); err != nil {
+		t.Fatal(err)
+	}
+	a := filepath.Join(sub, "a.txt")
+	f, err := client.Create(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Chmod(0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(a)
+	if err != nil || string(content) != "hello" {
+		t.Errorf("bad upload: %#v %v", string(content), err)
+	}
+
+	fi, err := client.Stat(a)
+	if err != nil || fi.Size() != 5 || fi.Mode() != 0600 ||
+		fi.Name() != "a.txt" {
+		t.Errorf("bad stat: %#v %v", fi, err)
+	}
+	list, err := client.ReadDir(sub)
+	if err != nil || len(list) != 1 || list[0].Name() != "a.txt" {
+		t.Errorf("bad list: %#v %v", list, err)
+	}
+	if _, err := client.ReadDir(a); err == nil {
+		t.Errorf("listed a file")
+	}
+
+	f, err = client.Open(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err = ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(content) != "hello" {
+		t.Errorf("bad download: %#v %v", string(content), err)
+	}
+
+	f, err = client.OpenFile(a, os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("J")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content, err = ioutil.ReadFile(a)
+	if err != nil || string(content) != "Jello" {
+		t.Errorf("bad partial write: %#v %v", string(content), err)
+	}
+
+	b := filepath.Join(sub, "b.txt")
+	if err := client.Rename(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Stat(a); !os.IsNotExist(err) {
+		t.Errorf("renamed file still exists: %v", err)
+	}
+	if err := client.Symlink(b, a); err != nil {
+		t.Fatal(err)
+	}
+	target, err := client.ReadLink(a)
+	if err != nil || target != b {
+		t.Errorf("bad link: %#v %v", target, err)
+	}
+	if err := client.Rename(b, a); err == nil {
+		t.Errorf("renamed over an existing file")
+	}
+	if err := client.PosixRename(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RemoveDirectory(sub); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sub); !os.IsNotExist(err) {
+		t.Errorf("directory not removed: %v", err)
+	}
+
+	client.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("fake ssh failed: %v %#v", err, stderr.String())
+	}
+
+	// Other subsystems are refused
+	stderr.Reset()
+	cmd = exec.CommandContext(dctx, sshExe, "-F", "none", "-s", "vm", "netconf")
+	cmd.Stderr = stderr
+	cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exitCode := localcommunicator.RunExitCode(cmd)
+	if exitCode != fakessh.EXIT_FAILURE ||
+		stderr.String() != "ssh: subsystem request failed on channel 0\n" {
+		t.Errorf("bad subsystem: %d %#v", exitCode, stderr.String())
+	}
+}
+
+// The modification time of the files made by makeScpDir
+var scpMtime = time.Unix(1000000000, 0)
+
+// Make a directory with the file f, the directory src and the empty
+// directory dst for scp tests
+func makeScpDir(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "fakessh-scp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	files := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+	}{
+		{"f", "f", 0600},
+		{"src/a", "a", 0640},
+		{"src/sub/b", "b", 0600},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, f.name)
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(p, []byte(f.content), f.mode)
+		}
+		if err == nil {
+			err = os.Chtimes(p, scpMtime, scpMtime)
+		}
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	err = os.Mkdir(filepath.Join(dir, "dst"), 0755)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return dir, cleanup
+}
+
+// Check that the file p has content and permissions mode
+func hasScpFile(t *testing.T, p string, content string, mode os.FileMode) {
+	got, err := ioutil.ReadFile(p)
+	if err != nil || string(got) != content {
+		t.Errorf("bad %s: %#v %v", p, string(got), err)
+		return
+	}
+	fi, err := os.Stat(p)
+	if err != nil || fi.Mode().Perm() != mode {
+		t.Errorf("bad mode of %s: %v %v", p, fi.Mode(), err)
+	}
+}
+
+// Check that the copy of the directory src at p is complete
+func hasScpDir(t *testing.T, p string) {
+	hasScpFile(t, filepath.Join(p, "a"), "a", 0640)
+	hasScpFile(t, filepath.Join(p, "sub", "b"), "b", 0600)
+}
+
+// Check that the modification time of p was preserved
+func hasScpMtime(t *testing.T, p string) {
+	fi, err := os.Stat(p)
+	if err != nil || !fi.ModTime().Equal(scpMtime) {
+		t.Errorf("bad mtime of %s: %v %v", p, fi.ModTime(), err)
+	}
+}
+
+func TestScp(t *testing.T) {
+	ctx := context.Background()
+
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	scpExe := filepath.Join(sshExeDir, fakessh.SCPEXENAME)
+
+	// In the arguments and stderr, {} is replaced by the test directory made
+	// by makeScpDir
+	tests := []struct {
+		name     string
+		args     []string
+		exitCode int
+		stderr   string
+		check    func(t *testing.T, dir string)
+	}{
+		{
+			name: "upload into directory",
+			args: []string{"{}/f", "vm:{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "f"), "f", 0600)
+			},
+		},
+		{
+			name: "upload to new file",
+			args: []string{"{}/f", "user@vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name: "upload preserving times",
+			args: []string{"-p", "{}/f", "scp://vm/{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpMtime(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name: "upload directory into directory",
+			args: []string{"-r", "{}/src", "vm:{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "dst", "src"))
+			},
+		},
+		{
+			name: "upload directory to new directory",
+			args: []string{"-rp", "{}/src", "vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new"))
+				hasScpMtime(t, filepath.Join(dir, "new", "sub", "b"))
+			},
+		},
+		{
+			name:     "upload directory without -r",
+			args:     []string{"{}/src", "vm:{}/dst"},
+			exitCode: 1,
+			stderr:   "scp: {}/src: not a regular file\n",
+		},
+		{
+			name:     "upload missing file",
+			args:     []string{"{}/missing", "{}/f", "vm:{}/dst"},
+			exitCode: 1,
+			stderr:   "scp: {}/missing: No such file or directory\n",
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "f"), "f", 0600)
+			},
+		},
+		{
+			name: "download into directory",
+			args: []string{"vm:{}/f", "{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "f"), "f", 0600)
+			},
+		},
+		{
+			name: "download preserving times",
+			args: []string{"-p", "vm:{}/f", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+				hasScpMtime(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name: "download directory into directory",
+			args: []string{"-r", "vm:{}/src", "{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "dst", "src"))
+			},
+		},
+		{
+			name: "download directory to new directory",
+			args: []string{"-r", "-p", "vm:{}/src", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new"))
+				hasScpMtime(t, filepath.Join(dir, "new", "sub", "b"))
+			},
+		},
+		{
+			name:     "download missing file",
+			args:     []string{"vm:{}/missing", "{}/dst"},
+			exitCode: 1,
+			stderr:   "scp: {}/missing: No such file or directory\n",
+		},
+		{
+			name:     "several sources to a file",
+			args:     []string{"{}/f", "vm:{}/f", "vm:{}/f"},
+			exitCode: 1,
+			stderr:   "scp: {}/f: Not a directory\n",
+		},
+		{
+			name: "between guests",
+			args: []string{"-r", "vm:{}/src", "other:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name: "local copy",
+			args: []string{"{}/f", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name:     "usage",
+			args:     []string{"{}/f"},
+			exitCode: 1,
+			stderr:   fakessh.SCPUSAGE + "\n",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			dir, cleanup := makeScpDir(t)
+			defer cleanup()
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+			args := []string{"-F", "none"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "{}", dir))
+			}
+			stderr := &bytes.Buffer{}
+			cmd := exec.CommandContext(dctx, scpExe, args...)
+			cmd.Stderr = stderr
+			var err error
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+			expectedStderr := strings.ReplaceAll(tt.stderr, "{}", dir)
+			if exitCode != tt.exitCode || stderr.String() != expectedStderr {
+				t.Errorf("failed for %#v ... (got %d %#v)",
+					args, exitCode, stderr.String())
+			}
+			if tt.check != nil {
+				tt.check(t, dir)
+			}
+		})
+	}
+}
+
+// Copy guest files with relative paths, on guests without GNU stat, or for
+// other users
+func TestScpGuest(t *testing.T) {
+	ctx := context.Background()
+
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	scpExe := filepath.Join(sshExeDir, fakessh.SCPEXENAME)
+
+	// Guest commands run in the working directory of scp, and the
+	// Communicator resolves relative paths from the server directory
+	inWorkDir := &fakessh.ServerConfig{
+		ExecuteCommand: "cd {{.WorkDir}} && sh -c {{.Command}}",
+	}
+	// stat fails like on BSD and macOS
+	bsdStat := &fakessh.ServerConfig{
+		ExecuteCommand: `stat() { echo "stat: illegal option -- c" >&2; ` +
+			`return 1; }; eval {{.Command}}`,
+	}
+	onlyBuild := &fakessh.ServerConfig{
+		AllowedUsers: []string{"build"},
+	}
+	switchUser := &fakessh.ServerConfig{
+		SwitchUserCommand: "sh -c {{.Command}}",
+		CommUser:          "build",
+	}
+	notCopied := func(t *testing.T, dir string) {
+		_, err := os.Stat(filepath.Join(dir, "new"))
+		if !os.IsNotExist(err) {
+			t.Errorf("new was copied: %v", err)
+		}
+	}
+
+	// In the arguments, {} is replaced by the test directory made by
+	// makeScpDir, which is also the working directory of scp
+	tests := []struct {
+		name     string
+		config   *fakessh.ServerConfig
+		args     []string
+		exitCode int
+		stderr   string
+		check    func(t *testing.T, dir string)
+	}{
+		{
+			name:   "relative upload",
+			config: inWorkDir,
+			args:   []string{"f", "vm:new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name:   "relative download",
+			config: inWorkDir,
+			args:   []string{"-p", "vm:f", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+				hasScpMtime(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name:     "stat without -c",
+			config:   bsdStat,
+			args:     []string{"vm:{}/f", "{}/new"},
+			exitCode: 1,
+			stderr: "scp: stat on the guest does not support -c, " +
+				"install GNU coreutils\n",
+		},
+		{
+			name:   "permitted user",
+			config: onlyBuild,
+			args:   []string{"{}/f", "build@vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name:     "user not permitted",
+			config:   onlyBuild,
+			args:     []string{"{}/f", "root@vm:{}/new"},
+			exitCode: 1,
+			stderr:   "scp: user \"root\" is not permitted\n",
+			check:    notCopied,
+		},
+		{
+			name:   "Communicator user",
+			config: switchUser,
+			args:   []string{"{}/f", "build@vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name:     "switched user",
+			config:   switchUser,
+			args:     []string{"-r", "{}/src", "root@vm:{}/new"},
+			exitCode: 1,
+			stderr: "scp: files can not be copied as user \"root\", " +
+				"only as the Communicator user\n",
+			check: notCopied,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			srvDir, shutdown := startServer(t, tt.config)
+			defer shutdown()
+			dir, cleanup := makeScpDir(t)
+			defer cleanup()
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+			args := []string{"-F", "none"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "{}", dir))
+			}
+			stderr := &bytes.Buffer{}
+			cmd := exec.CommandContext(dctx, scpExe, args...)
+			cmd.Dir = dir
+			cmd.Stderr = stderr
+			var err error
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+			if exitCode != tt.exitCode || stderr.String() != tt.stderr {
+				t.Errorf("failed for %#v ... (got %d %#v)",
+					args, exitCode, stderr.String())
+			}
+			if tt.check != nil {
+				tt.check(t, dir)
+			}
+		})
+	}
+}
+
+func TestScpRemote(t *testing.T) {
+	ctx := context.Background()
+
+	realScp, err := exec.LookPath("scp")
+	if err != nil {
+		t.Skip("scp not found")
+	}
+	srvDir, shutdown := startServer(t, nil)
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+	sshExe := filepath.Join(sshExeDir, fakessh.SSHEXENAME)
+
+	// The real scp runs scp -t or scp -f through the fake ssh, so the
+	// server plays the remote side of the legacy protocol.
+	// In the arguments and stderr, {} is replaced by the test directory
+	// made by makeScpDir.
+	tests := []struct {
+		name string
+		args []string
+		// Shadow touch and stat with those of BSD on the guest
+		bsd      bool
+		exitCode int
+		stderr   string
+		check    func(t *testing.T, dir string)
+	}{
+		{
+			name: "upload into directory",
+			args: []string{"{}/f", "vm:{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "f"), "f", 0600)
+			},
+		},
+		{
+			name: "upload directory into directory",
+			args: []string{"-r", "{}/src", "vm:{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "dst", "src"))
+			},
+		},
+		{
+			name: "upload directory to new directory",
+			args: []string{"-rp", "{}/src", "vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new"))
+				hasScpMtime(t, filepath.Join(dir, "new", "sub", "b"))
+			},
+		},
+		{
+			name: "download preserving times",
+			args: []string{"-p", "vm:{}/f", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+				hasScpMtime(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name: "download directory into directory",
+			args: []string{"-r", "vm:{}/src", "{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "dst", "src"))
+			},
+		},
+		{
+			name: "download directory to new directory",
+			args: []string{"-rp", "vm:{}/src", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new"))
+				hasScpMtime(t, filepath.Join(dir, "new", "sub", "b"))
+			},
+		},
+		{
+			name:     "download missing file",
+			args:     []string{"vm:{}/missing", "{}/dst"},
+			exitCode: 1,
+			stderr:   "scp: {}/missing: No such file or directory\n",
+		},
+		{
+			name: "upload preserving times with BSD touch",
+			args: []string{"-p", "{}/f", "vm:{}/new"},
+			bsd:  true,
+			check: func(t *testing.T, dir string) {
+				hasScpMtime(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name: "upload directory preserving times with BSD touch",
+			args: []string{"-rp", "{}/src", "vm:{}/new"},
+			bsd:  true,
+			check: func(t *testing.T, dir string) {
+				hasScpMtime(t, filepath.Join(dir, "new", "sub", "b"))
+			},
+		},
+		{
+			name:     "download with BSD stat",
+			args:     []string{"vm:{}/f", "{}/new"},
+			bsd:      true,
+			exitCode: 1,
+			stderr: "scp: stat on the guest does not support -c, " +
+				"install GNU coreutils\n",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			dir, cleanup := makeScpDir(t)
+			defer cleanup()
+			if tt.bsd {
+				restore := bsdTools(t, dir)
+				defer restore()
+			}
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+			args := []string{"-O", "-S", sshExe, "-F", "none"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "{}", dir))
+			}
+			stderr := &bytes.Buffer{}
+			cmd := exec.CommandContext(dctx, realScp, args...)
+			cmd.Stderr = stderr
+			var err error
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+			expectedStderr := strings.ReplaceAll(tt.stderr, "{}", dir)
+			if exitCode != tt.exitCode || stderr.String() != expectedStderr {
+				t.Errorf("failed for %#v ... (got %d %#v)",
+					args, exitCode, stderr.String())
+			}
+			if tt.check != nil {
+				tt.check(t, dir)
+			}
+		})
+	}
+}
+
+// Put touch and stat commands failing like those of BSD for GNU options
+// first in PATH, in a new directory of dir, until restore is called
+func bsdTools(t *testing.T, dir string) (restore func()) {
+	realTouch, err := exec.LookPath("touch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "bsd-bin")
+	scripts := map[string]string{
+		"touch": "for a; do case $a in -d) " +
+			"echo 'touch: illegal option -- d' >&2; exit 1;; esac; done\n" +
+			"exec " + realTouch + " \"$@\"\n",
+		"stat": "echo 'stat: illegal option -- c' >&2; exit 1\n",
+	}
+	err = os.Mkdir(bin, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, script := range scripts {
+		err := ioutil.WriteFile(filepath.Join(bin, name),
+			[]byte("#!/bin/sh\n"+script), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", bin+string(os.PathListSeparator)+path)
+	return func() { os.Setenv("PATH", path) }
+}
+
+func TestRsyncFallback(t *testing.T) {
+	ctx := context.Background()
+
+	rsync, err := exec.LookPath("rsync")
+	if err != nil {
+		t.Skip("rsync not found")
+	}
+	// The guest does not find rsync
+	srvDir, shutdown := startServer(t, &fakessh.ServerConfig{
+		ExecuteCommand: `case {{.Command}} in *"command -v rsync"*) ` +
+			`exit 1;; esac; sh -c {{.Command}}`,
+	})
+	defer shutdown()
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+
+	// In the arguments, {} is replaced by the test directory made by
+	// makeScpDir
+	tests := []struct {
+		name   string
+		args   []string
+		fails  bool
+		stderr string
+		check  func(t *testing.T, dir string)
+	}{
+		{
+			name: "push directory",
+			args: []string{"-a", "{}/src", "vm:{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "dst", "src"))
+				hasScpMtime(t, filepath.Join(dir, "dst", "src", "sub", "b"))
+			},
+		},
+		{
+			name: "push contents to new directory",
+			args: []string{"-r", "{}/src/", "vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new", "a"), "a", 0640)
+			},
+		},
+		{
+			name: "push excluding files",
+			args: []string{"-a", "--exclude=sub", "{}/src", "vm:{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "src", "a"), "a", 0640)
+				_, err := os.Stat(filepath.Join(dir, "dst", "src", "sub"))
+				if !os.IsNotExist(err) {
+					t.Errorf("sub not excluded: %v", err)
+				}
+			},
+		},
+		{
+			name: "push dry run",
+			args: []string{"-an", "{}/f", "vm:{}/new"},
+			check: func(t *testing.T, dir string) {
+				_, err := os.Stat(filepath.Join(dir, "new"))
+				if !os.IsNotExist(err) {
+					t.Errorf("new copied: %v", err)
+				}
+			},
+		},
+		{
+			name: "pull directory",
+			args: []string{"-a", "vm:{}/src", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new", "src"))
+				hasScpMtime(t, filepath.Join(dir, "new", "src", "a"))
+			},
+		},
+		{
+			name:   "pull missing file",
+			args:   []string{"vm:{}/missing", "{}/new"},
+			fails:  true,
+			stderr: "No such file or directory",
+		},
+		{
+			name:   "delete",
+			args:   []string{"-r", "--delete", "{}/src/", "vm:{}/dst"},
+			fails:  true,
+			stderr: "--delete can not be emulated",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			dir, cleanup := makeScpDir(t)
+			defer cleanup()
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+			args := []string{"-e", "ssh -F none"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "{}", dir))
+			}
+			stderr := &bytes.Buffer{}
+			cmd := exec.CommandContext(dctx, rsync, args...)
+			cmd.Stderr = stderr
+			var err error
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+			if (exitCode != 0) != tt.fails ||
+				!strings.Contains(stderr.String(), tt.stderr) {
+				t.Errorf("failed for %#v ... (got %d %#v)",
+					args, exitCode, stderr.String())
+			}
+			if tt.check != nil {
+				tt.check(t, dir)
+			}
+		})
+	}
+}
+
+func TestPackerTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	sshExeDir, cleanup := fakeSshExe(t, ctx)
+	defer cleanup()
+
+	onlyBuild := &fakessh.ServerConfig{
+		AllowedUsers: []string{"build"},
+	}
+	switchUser := &fakessh.ServerConfig{
+		SwitchUserCommand: "sh -c {{.Command}}",
+		CommUser:          "build",
+	}
+	notCopied := func(t *testing.T, dir string) {
+		_, err := os.Stat(filepath.Join(dir, "new"))
+		if !os.IsNotExist(err) {
+			t.Errorf("new was copied: %v", err)
+		}
+	}
+
+	// In the arguments and stderr, {} is replaced by the test directory
+	// made by makeScpDir. Without -q, stderr only has to start with
+	// progress.
+	tests := []struct {
+		name     string
+		config   *fakessh.ServerConfig
+		exe      string
+		args     []string
+		exitCode int
+		stderr   string
+		progress string
+		check    func(t *testing.T, dir string)
+	}{
+		{
+			name:     "upload file with progress",
+			exe:      fakessh.UPLOADEXENAME,
+			args:     []string{"vm", "{}/src/a", "{}/new"},
+			progress: fmt.Sprintf("%-32s 100%% %8s ", "a", "1B"),
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "a", 0640)
+			},
+		},
+		{
+			name: "upload files into directory",
+			exe:  fakessh.UPLOADEXENAME,
+			args: []string{"-pq", "vm", "{}/f", "{}/src/a", "{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "f"), "f", 0600)
+				hasScpFile(t, filepath.Join(dir, "dst", "a"), "a", 0640)
+				hasScpMtime(t, filepath.Join(dir, "dst", "a"))
+			},
+		},
+		{
+			name: "upload directory excluding files",
+			exe:  fakessh.UPLOADEXENAME,
+			args: []string{"-rq", "-x", "b", "vm", "{}/src", "{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "src", "a"), "a", 0640)
+				_, err := os.Stat(filepath.Join(dir, "dst", "src", "sub", "b"))
+				if !os.IsNotExist(err) {
+					t.Errorf("b not excluded: %v", err)
+				}
+			},
+		},
+		{
+			name:     "download file with progress",
+			exe:      fakessh.DOWNLOADEXENAME,
+			args:     []string{"-p", "vm", "{}/src/a", "{}/new"},
+			progress: fmt.Sprintf("%-32s 100%% %8s ", "a", "1B"),
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "a", 0640)
+				hasScpMtime(t, filepath.Join(dir, "new"))
+			},
+		},
+		{
+			name: "download directory",
+			exe:  fakessh.DOWNLOADEXENAME,
+			args: []string{"-rpq", "vm", "{}/src", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpDir(t, filepath.Join(dir, "new"))
+				hasScpMtime(t, filepath.Join(dir, "new", "sub", "b"))
+			},
+		},
+		{
+			name: "download directory excluding files",
+			exe:  fakessh.DOWNLOADEXENAME,
+			args: []string{"-rq", "-x", "sub", "vm", "{}/src", "{}/dst"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "dst", "src", "a"), "a", 0640)
+				_, err := os.Stat(filepath.Join(dir, "dst", "src", "sub"))
+				if !os.IsNotExist(err) {
+					t.Errorf("sub not excluded: %v", err)
+				}
+			},
+		},
+		{
+			name:     "download missing file",
+			exe:      fakessh.DOWNLOADEXENAME,
+			args:     []string{"-q", "vm", "{}/missing", "{}/dst"},
+			exitCode: 1,
+			stderr: "packer-download: {}/missing: " +
+				"No such file or directory\n",
+		},
+		{
+			name:   "upload as permitted user",
+			config: onlyBuild,
+			exe:    fakessh.UPLOADEXENAME,
+			args:   []string{"-q", "build@vm", "{}/f", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name:     "upload as user not permitted",
+			config:   onlyBuild,
+			exe:      fakessh.UPLOADEXENAME,
+			args:     []string{"-q", "root@vm", "{}/f", "{}/new"},
+			exitCode: 1,
+			stderr:   "packer-upload: user \"root\" is not permitted\n",
+			check:    notCopied,
+		},
+		{
+			name:   "download as Communicator user",
+			config: switchUser,
+			exe:    fakessh.DOWNLOADEXENAME,
+			args:   []string{"-q", "build@vm", "{}/f", "{}/new"},
+			check: func(t *testing.T, dir string) {
+				hasScpFile(t, filepath.Join(dir, "new"), "f", 0600)
+			},
+		},
+		{
+			name:     "download as switched user",
+			config:   switchUser,
+			exe:      fakessh.DOWNLOADEXENAME,
+			args:     []string{"-rq", "root@vm", "{}/src", "{}/new"},
+			exitCode: 1,
+			stderr: "packer-download: files can not be copied as user " +
+				"\"root\", only as the Communicator user\n",
+			check: notCopied,
+		},
+		{
+			name:     "usage",
+			exe:      fakessh.UPLOADEXENAME,
+			args:     []string{"vm", "{}/f"},
+			exitCode: 1,
+			stderr:   fakessh.UPLOADUSAGE + "\n",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			srvDir, shutdown := startServer(t, tt.config)
+			defer shutdown()
+			dir, cleanup := makeScpDir(t)
+			defer cleanup()
+
+			dctx, cancel := context.WithTimeout(ctx, MAXTESTTIME)
+			defer cancel()
+			args := []string{"-F", "none"}
+			for _, arg := range tt.args {
+				args = append(args, strings.ReplaceAll(arg, "{}", dir))
+			}
+			stderr := &bytes.Buffer{}
+			cmd := exec.CommandContext(
+				dctx, filepath.Join(sshExeDir, tt.exe), args...)
+			cmd.Stderr = stderr
+			var err error
+			cmd.Env, err = fakessh.AddFakeSshPath(nil, sshExeDir, srvDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			exitCode := localcommunicator.RunExitCode(cmd)
+			ok := stderr.String() == strings.ReplaceAll(tt.stderr, "{}", dir)
+			if tt.progress != "" {
+				ok = strings.HasPrefix(stderr.String(), tt.progress)
+			}
+			if exitCode != tt.exitCode || !ok {
+				t.Errorf("failed for %s %#v ... (got %d %#v)",
+					tt.exe, args, exitCode, stderr.String())
+			}
+			if tt.check != nil {
+				tt.check(t, dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+const (
+	// Command relaying stdin and stdout to a TCP port, run by the
+	// Communicator for ssh -W.
+	// Use nc or socat if the guest has them, and fall back to bash /dev/tcp.
+	DEFAULTRELAYCOMMAND = `if command -v nc >/dev/null 2>&1; then ` +
+		`exec nc {{.Host}} {{.Port}}; ` +
+		`elif command -v socat >/dev/null 2>&1; then ` +
+		`exec socat - TCP:{{.Host}}:{{.Port}}; ` +
+		`else exec bash -c ` +
+		`'exec 3<>"/dev/tcp/$0/$1" && { cat <&0 >&3 2>/dev/null & exec cat <&3; }' ` +
+		`{{.Host}} {{.Port}}; fi`
+	// Command accepting TCP connections and multiplexing them over stdin
+	// and stdout, run by the Communicator for ssh -R.
+	// Connections are multiplexed in the frames read by frameMux.
+	DEFAULTLISTENCOMMAND = `exec python3 -c '` + pythonMux +
+		`' {{.Host}} {{.Port}}`
+)
+
+// A host and port to connect to from the guest
+type HostPort struct {
+	Host string
+	Port int
+}
+
+func (hp HostPort) String() string {
+	return net.JoinHostPort(hp.Host, strconv.Itoa(hp.Port))
+}
+
+// Parse a forwarding target like "host:port" or "[::1]:port"
+func ParseHostPort(s string) (HostPort, error) {
+	host := ""
+	port := ""
+	if strings.HasPrefix(s, "[") {
+		k := strings.Index(s, "]:")
+		if k < 0 {
+			return HostPort{}, fmt.Errorf("missing port in %q", s)
+		}
+		host = s[1:k]
+		port = s[k+2:]
+	} else {
+		k := strings.IndexByte(s, ':')
+		if k < 0 {
+			return HostPort{}, fmt.Errorf("missing port in %q", s)
+		}
+		host = s[:k]
+		port = s[k+1:]
+	}
+	if host == "" {
+		return HostPort{}, fmt.Errorf("missing host in %q", s)
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return HostPort{}, err
+	}
+	return HostPort{Host: host, Port: p}, nil
+}
+
+// A local port forwarded to a target on the guest (ssh -L)
+type LocalForward struct {
+	// Local address to listen on. If empty, listen on localhost. "*"
+	// listens on all interfaces.
+	BindAddress string
+	BindPort    int
+	Target      HostPort
+}
+
+// Address to listen on, like net.Listen expects
+func (f LocalForward) ListenAddress() string {
+	bind := f.BindAddress
+	switch bind {
+	case "":
+		bind = "localhost"
+	case "*":
+		bind = ""
+	}
+	return net.JoinHostPort(bind, strconv.Itoa(f.BindPort))
+}
+
+// Parse a local forwarding specification like "8080:localhost:80" or
+// "127.0.0.1:8080:[::1]:80"
+func ParseLocalForward(spec string) (LocalForward, error) {
+	bind, port, target, err := parseForwardSpec(spec)
+	if err != nil {
+		return LocalForward{}, err
+	}
+	return LocalForward{BindAddress: bind, BindPort: port, Target: target}, nil
+}
+
+// A port on the guest forwarded to a local target (ssh -R)
+type RemoteForward struct {
+	// Guest address to listen on. If empty, listen on localhost. "*"
+	// listens on all interfaces.
+	BindAddress string
+	BindPort    int
+	// Local target
+	Target HostPort
+}
+
+// Guest address to listen on
+func (f RemoteForward) ListenAddress() HostPort {
+	bind := f.BindAddress
+	switch bind {
+	case "":
+		bind = "localhost"
+	case "*":
+		bind = "0.0.0.0"
+	}
+	return HostPort{Host: bind, Port: f.BindPort}
+}
+
+// Parse a remote forwarding specification like "3128:localhost:3128" or
+// "*:8080:cache.local:80"
+func ParseRemoteForward(spec string) (RemoteForward, error) {
+	bind, port, target, err := parseForwardSpec(spec)
+	if err != nil {
+		return RemoteForward{}, err
+	}
+	return RemoteForward{BindAddress: bind, BindPort: port, Target: target}, nil
+}
+
+// A local port whose connections are forwarded to the targets they request
+// with SOCKS (ssh -D)
+type DynamicForward struct {
+	// Local address to listen on. If empty, listen on localhost. "*"
+	// listens on all interfaces.
+	BindAddress string
+	BindPort    int
+}
+
+// Address to listen on, like net.Listen expects
+func (f DynamicForward) ListenAddress() string {
+	return LocalForward{BindAddress: f.BindAddress, BindPort: f.BindPort}.
+		ListenAddress()
+}
+
+// Parse a dynamic forwarding specification like "1080" or "*:1080"
+func ParseDynamicForward(spec string) (DynamicForward, error) {
+	fields := splitForwardSpec(spec)
+	bind := ""
+	switch len(fields) {
+	case 1:
+	case 2:
+		bind = fields[0]
+		fields = fields[1:]
+	default:
+		return DynamicForward{},
+			fmt.Errorf("bad forwarding specification %q", spec)
+	}
+	port, err := parsePort(fields[0])
+	if err != nil {
+		return DynamicForward{}, err
+	}
+	return DynamicForward{BindAddress: bind, BindPort: port}, nil
+}
+
+// Parse a forwarding specification of the form
+// [bind_address:]port:host:hostport
+func parseForwardSpec(spec string) (string, int, HostPort, error) {
+	fields := splitForwardSpec(spec)
+	bind := ""
+	switch len(fields) {
+	case 3:
+	case 4:
+		bind = fields[0]
+		fields = fields[1:]
+	default:
+		return "", 0, HostPort{},
+			fmt.Errorf("bad forwarding specification %q", spec)
+	}
+	port, err := parsePort(fields[0])
+	if err != nil {
+		return "", 0, HostPort{}, err
+	}
+	if fields[1] == "" {
+		return "", 0, HostPort{}, fmt.Errorf("missing host in %q", spec)
+	}
+	targetPort, err := parsePort(fields[2])
+	if err != nil {
+		return "", 0, HostPort{}, err
+	}
+	return bind, port, HostPort{Host: fields[1], Port: targetPort}, nil
+}
+
+// Split a forwarding specification at colons outside of square brackets,
+// removing the brackets
+func splitForwardSpec(spec string) []string {
+	fields := []string{}
+	field := strings.Builder{}
+	bracketed := false
+	for i := 0; i < len(spec); i++ {
+		switch c := spec[i]; {
+		case c == '[' && field.Len() == 0 && !bracketed:
+			bracketed = true
+		case c == ']' && bracketed:
+			bracketed = false
+		case c == ':' && !bracketed:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// Data available to relay and listen command templates
+type RelayTemplate struct {
+	// The host to connect to or listen on, quoted for a POSIX shell
+	Host string
+	// The port to connect to or listen on
+	Port int
+}
+
+// Render a relay command template with data
+func RenderRelayCommand(tpl string, data *RelayTemplate) (string, error) {
+	return interpolate.Render(tpl, &interpolate.Context{Data: data})
+}
+
+// Build the command relaying stdin and stdout to target
+func (ssh *RpcSsh) relayCommand(target *HostPort) (string, error) {
+	tpl := ssh.Config.RelayCommand
+	if tpl == "" {
+		tpl = DEFAULTRELAYCOMMAND
+	}
+	return RenderRelayCommand(tpl, &RelayTemplate{
+		Host: ShellQuote(target.Host),
+		Port: target.Port,
+	})
+}
+
+// Build the command accepting connections on addr and multiplexing them
+// over stdin and stdout
+func (ssh *RpcSsh) listenCommand(addr *HostPort) (string, error) {
+	tpl := ssh.Config.ListenCommand
+	if tpl == "" {
+		tpl = DEFAULTLISTENCOMMAND
+	}
+	return RenderRelayCommand(tpl, &RelayTemplate{
+		Host: ShellQuote(addr.Host),
+		Port: addr.Port,
+	})
+}
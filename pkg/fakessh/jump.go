@@ -0,0 +1,225 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// The ssh command run on a jump host for the remaining hops
+	JUMPSSHCOMMAND = "ssh"
+)
+
+// Flags of the fake ssh that only make sense locally, and are not passed on
+// from a jump host
+const localOnlyFlags = "fFGVMSiIEbO"
+
+// Options that only make sense locally, and are not passed on from a jump
+// host
+var localOnlyOptions = []string{
+	"ProxyJump",
+	"ProxyCommand",
+	"ControlMaster",
+	"ControlPath",
+	"ControlPersist",
+	"IdentityFile",
+	"CertificateFile",
+}
+
+// Get the jump hosts from -J or the ProxyJump option, in order.
+//
+// Returns nil if there are none or ProxyJump is "none".
+func (inv *Invocation) ProxyJump() []string {
+	value, ok := inv.FlagArg('J')
+	if !ok {
+		value, ok = inv.Option("ProxyJump")
+	}
+	if !ok || value == "" || strings.EqualFold(value, "none") {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// Get the invocation connecting to the jump host hop, of the form
+// [user@]host[:port] or an ssh:// URI.
+//
+// Like OpenSSH, the jump host is resolved with the same ssh_config files as
+// the destination.
+func (inv *Invocation) JumpInvocation(hop string) (*Invocation, error) {
+	args := []string{"ssh"}
+	if path, ok := inv.FlagArg('F'); ok {
+		args = append(args, "-F", path)
+	}
+	if !strings.HasPrefix(strings.ToLower(hop), "ssh://") {
+		hop = "ssh://" + hop
+	}
+	jump, err := ParseArgs(append(args, hop))
+	if err != nil {
+		return nil, err
+	}
+	jump.skipExec = inv.skipExec
+	err = jump.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return jump, nil
+}
+
+// Build the argv of the ssh command a jump host runs for the remaining hops
+// rest.
+//
+// The flags and -o options of inv are passed on, except those naming local
+// files or local sessions. Like OpenSSH, the last hop connects to the host
+// name, user and port resolved by ReadConfig, which are passed with -l, -p
+// and the destination. The remote command is passed as a single argument.
+// Since the argv is rebuilt from the parsed command line, flags are grouped
+// by letter.
+func (inv *Invocation) OnwardArgs(rest []string) []string {
+	args := []string{JUMPSSHCOMMAND}
+	for i := 0; i < len(SSHOPTSTRING); i++ {
+		f := SSHOPTSTRING[i]
+		switch {
+		case f == ':', f == 'J', f == 'l', f == 'p':
+			continue
+		case strings.IndexByte(localOnlyFlags, f) >= 0:
+			continue
+		}
+		flag := "-" + string(f)
+		for n := 0; n < inv.Flags[f]; n++ {
+			args = append(args, flag)
+		}
+		for _, val := range inv.FlagArgs[f] {
+			if f == 'o' && isLocalOnlyOption(val) {
+				continue
+			}
+			args = append(args, flag, val)
+		}
+	}
+	if len(rest) > 0 {
+		args = append(args, "-J", strings.Join(rest, ","))
+	}
+	if inv.User != "" {
+		args = append(args, "-l", inv.User)
+	}
+	if inv.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(inv.Port))
+	}
+	args = append(args, "--", inv.HostName)
+	if len(inv.Command) > 0 {
+		args = append(args, ArgvToSh(inv.Command))
+	}
+	return args
+}
+
+// Check if the -o option val only makes sense locally
+func isLocalOnlyOption(val string) bool {
+	key, _, err := parseOption(val)
+	if err != nil {
+		return false
+	}
+	for _, local := range localOnlyOptions {
+		if strings.EqualFold(key, local) {
+			return true
+		}
+	}
+	return false
+}
+
+// Run the ssh command for the remaining hops of inv on the jump host of the
+// first hop, and return the exit code.
+//
+// The jump host is handled by the fake ssh server, since Ssh passes
+// invocations with unhandled jump hosts to the real ssh.
+func jumpCommand(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	hops []string,
+	quiet bool,
+) int {
+	if len(inv.LocalForwards) > 0 || len(inv.RemoteForwards) > 0 ||
+		len(inv.DynamicForwards) > 0 {
+		diagf(quiet, "port forwarding is not supported with ProxyJump")
+		return EXIT_FAILURE
+	}
+	jump, err := inv.JumpInvocation(hops[0])
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	onward := inv.OnwardArgs(hops[1:])
+	quoted := make([]string, len(onward))
+	for i, arg := range onward {
+		quoted[i] = ShellQuote(arg)
+	}
+
+	// An unknown working directory is passed as the empty string
+	workDir, _ := os.Getwd()
+	cmd := &Cmd{
+		Command:     strings.Join(quoted, " "),
+		NoStdin:     inv.Flag('n'),
+		Env:         inv.Env(os.Environ()),
+		User:        jump.User,
+		Host:        jump.HostName,
+		WorkDir:     workDir,
+		Compression: inv.Compression(),
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      noCloseFile{os.Stderr},
+	}
+	if cmd.NoStdin {
+		cmd.Stdin = nil
+	} else {
+		cmd.Stdin, err = pollableStdin()
+		if err != nil {
+			diagf(quiet, "%s", err)
+			return EXIT_FAILURE
+		}
+	}
+
+	// The onward ssh forwards the agent from the jump host
+	agent, err := startAgentForward(ctx, dir, inv, Cmd{
+		User:    cmd.User,
+		Host:    cmd.Host,
+		WorkDir: cmd.WorkDir,
+	})
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	if agent != nil {
+		defer agent.Close()
+		cmd.AgentSocket = agent.Path
+	}
+
+	// The onward ssh requests a pseudo-terminal if it runs in one
+	tty, warn := inv.RequestTTY(terminal.IsTerminal(int(os.Stdin.Fd())))
+	if warn != "" {
+		diagf(quiet, "%s", warn)
+	}
+	if tty {
+		pty, err := startPty(ctx, dir, cmd)
+		if err != nil {
+			diagf(quiet, "%s", err)
+			return EXIT_FAILURE
+		}
+		defer pty.Close()
+	}
+
+	exitCode, err := RunCmd(ctx, dir, cmd)
+	if err != nil {
+		if ctx.Err() == nil {
+			diagf(quiet, "%s", err)
+		}
+		return EXIT_FAILURE
+	}
+	return exitCode
+}
@@ -0,0 +1,117 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	. "github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+func TestProxyJump(t *testing.T) {
+	config, err := ioutil.TempFile("", "fakessh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config.Name())
+	_, err = config.WriteString(`Host internal
+    HostName 10.0.0.5
+    User deploy
+    ProxyJump builder@vm
+
+Host vm
+    User packer
+    Port 2222
+`)
+	config.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jumpTests := []struct {
+		name     string
+		args     []string
+		hops     []string
+		jumpUser string
+		jumpHost string
+		onward   []string
+	}{
+		{
+			name: "flag",
+			args: []string{"ssh", "-F", "none", "-J", "builder@vm:2200,gw",
+				"-tt", "-i", "id", "-o", "SendEnv=LANG",
+				"-o", "ControlPath=none", "-l", "root", "internal",
+				"uname", "-a"},
+			hops:     []string{"builder@vm:2200", "gw"},
+			jumpUser: "builder",
+			jumpHost: "vm",
+			onward: []string{"ssh", "-o", "SendEnv=LANG", "-t", "-t",
+				"-J", "gw", "-l", "root", "--", "internal", "uname -a"},
+		},
+		{
+			name:     "config",
+			args:     []string{"ssh", "-F", config.Name(), "-N", "internal"},
+			hops:     []string{"builder@vm"},
+			jumpUser: "builder",
+			jumpHost: "vm",
+			onward: []string{"ssh", "-N", "-l", "deploy", "--",
+				"10.0.0.5"},
+		},
+		{
+			name:     "jump host from config",
+			args:     []string{"ssh", "-F", config.Name(), "-J", "vm", "db"},
+			hops:     []string{"vm"},
+			jumpUser: "packer",
+			jumpHost: "vm",
+			onward:   []string{"ssh", "--", "db"},
+		},
+		{
+			name: "none",
+			args: []string{"ssh", "-F", config.Name(), "-o", "ProxyJump=none",
+				"internal"},
+			hops: nil,
+		},
+	}
+
+	for i, tt := range jumpTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = inv.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hops := inv.ProxyJump()
+			if !reflect.DeepEqual(hops, tt.hops) {
+				t.Fatalf("failed for %#v ... (expected hops %#v, but got %#v)",
+					tt.args, tt.hops, hops)
+			}
+			if hops == nil {
+				return
+			}
+			jump, err := inv.JumpInvocation(hops[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			onward := inv.OnwardArgs(hops[1:])
+			if jump.User != tt.jumpUser || jump.HostName != tt.jumpHost ||
+				!reflect.DeepEqual(onward, tt.onward) {
+				t.Errorf(
+					"failed for %#v ... (got jump host %s@%s, onward %#v)",
+					tt.args,
+					jump.User,
+					jump.HostName,
+					onward,
+				)
+			}
+		})
+	}
+}
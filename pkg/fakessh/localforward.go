@@ -0,0 +1,156 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Listeners of the local forwards of a fake ssh command
+type localForwarder struct {
+	lns []net.Listener
+	// Forwarded connections that are still open
+	conns sync.WaitGroup
+}
+
+// Listen on the local and dynamic forwards of inv and relay every accepted
+// connection to its target through the fake ssh server with working
+// directory dir. Connections to dynamic forwards request their target with
+// SOCKS.
+//
+// Like OpenSSH, a port that can not be listened on is reported and skipped,
+// unless ExitOnForwardFailure is set.
+func startLocalForwards(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	quiet bool,
+) (*localForwarder, error) {
+	exitOnFailure := false
+	if v, ok := inv.Option("ExitOnForwardFailure"); ok {
+		exitOnFailure = v == "yes"
+	}
+
+	f := &localForwarder{}
+	listen := func(addr string, target *HostPort) error {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			if exitOnFailure {
+				f.Close()
+				return fmt.Errorf("Could not request local forwarding: %s", err)
+			}
+			diagf(quiet, "Could not request local forwarding: %s", err)
+			return nil
+		}
+		f.lns = append(f.lns, ln)
+		go f.serve(ctx, dir, inv, ln, target)
+		return nil
+	}
+	for _, fwd := range inv.LocalForwards {
+		target := fwd.Target
+		if err := listen(fwd.ListenAddress(), &target); err != nil {
+			return nil, err
+		}
+	}
+	for _, fwd := range inv.DynamicForwards {
+		if err := listen(fwd.ListenAddress(), nil); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Accept connections on ln until it is closed.
+// If target is nil, each connection requests its target with SOCKS.
+func (f *localForwarder) serve(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	ln net.Listener,
+	target *HostPort,
+) {
+	quiet := inv.Flag('q')
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		f.conns.Add(1)
+		go func() {
+			defer f.conns.Done()
+			defer conn.Close()
+			connTarget := target
+			if connTarget == nil {
+				requested, err := socksConnect(conn)
+				if err != nil {
+					diagf(quiet, "dynamic forwarding failed: %s", err)
+					return
+				}
+				connTarget = &requested
+			}
+			err := relayConn(ctx, dir, inv, conn, *connTarget)
+			if err != nil && ctx.Err() == nil {
+				diagf(quiet, "forwarding to %s failed: %s", connTarget, err)
+			}
+		}()
+	}
+}
+
+// Stop listening and wait until the forwarded connections are closed
+func (f *localForwarder) Close() error {
+	for _, ln := range f.lns {
+		ln.Close()
+	}
+	f.conns.Wait()
+	return nil
+}
+
+// Relay conn to target on the guest of the ssh destination of inv
+func relayConn(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	conn net.Conn,
+	target HostPort,
+) error {
+	var stdin deadlineReaderCloser = conn
+	var stdout deadlineWriterCloser = conn
+	// Half close TCP connections, so each direction ends on its own
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		stdin = tcpReadCloser{tcpConn}
+		stdout = tcpWriteCloser{tcpConn}
+	}
+	_, err := RunCmd(ctx, dir, &Cmd{
+		User:         inv.User,
+		Host:         inv.HostName,
+		StdioForward: &target,
+		Stdin:        stdin,
+		Stdout:       stdout,
+		Stderr:       noCloseFile{os.Stderr},
+	})
+	return err
+}
+
+// A TCP connection whose Close only closes the reading side
+type tcpReadCloser struct {
+	*net.TCPConn
+}
+
+func (c tcpReadCloser) Close() error {
+	return c.CloseRead()
+}
+
+// A TCP connection whose Close only closes the writing side
+type tcpWriteCloser struct {
+	*net.TCPConn
+}
+
+func (c tcpWriteCloser) Close() error {
+	return c.CloseWrite()
+}
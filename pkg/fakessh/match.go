@@ -0,0 +1,70 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"strings"
+)
+
+// Check if s matches an OpenSSH style pattern.
+//
+// '*' matches any sequence of characters and '?' matches any one character.
+func MatchPattern(s string, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if MatchPattern(s[i:], pattern) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		s = s[1:]
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// Check if s matches any pattern in patterns
+func MatchAnyPattern(s string, patterns []string) bool {
+	for _, p := range patterns {
+		if MatchPattern(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if s matches a list of patterns that may be negated with '!'.
+//
+// Like OpenSSH, s must match at least one pattern and no negated pattern.
+func MatchPatternList(s string, patterns []string) bool {
+	matched := false
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			if MatchPattern(s, p[1:]) {
+				return false
+			}
+		} else if MatchPattern(s, p) {
+			matched = true
+		}
+	}
+	return matched
+}
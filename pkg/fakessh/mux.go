@@ -0,0 +1,326 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	// Longest frame sent by the fake ssh to a multiplexing listen command
+	MUXMAXFRAME = 32 * 1024
+)
+
+// Multiplex the connections to the unix socket in argv, or to the TCP host
+// and port in argv, over stdin and stdout in the frames read by frameMux.
+// Contains no single quotes.
+const pythonMux = `
+import os, socket, struct, sys, threading
+try:
+    if len(sys.argv) == 2:
+        try:
+            os.unlink(sys.argv[1])
+        except OSError:
+            pass
+        ln = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+        ln.bind(sys.argv[1])
+    else:
+        host, port = sys.argv[1], int(sys.argv[2])
+        info = socket.getaddrinfo(host, port, 0, socket.SOCK_STREAM)[0]
+        ln = socket.socket(info[0], socket.SOCK_STREAM)
+        ln.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+        ln.bind(info[4])
+    ln.listen(16)
+except OSError:
+    sys.exit(1)
+lock = threading.Lock()
+stopped = threading.Event()
+conns = {}
+done = {}
+def send(i, data):
+    with lock:
+        sys.stdout.buffer.write(struct.pack(">II", i, len(data)) + data)
+        sys.stdout.buffer.flush()
+def finish(i, way):
+    with lock:
+        done[i].add(way)
+        if len(done[i]) == 2:
+            conns.pop(i).close()
+            del done[i]
+        if stopped.is_set() and not conns:
+            os._exit(0)
+def recv(i, conn):
+    while True:
+        try:
+            data = conn.recv(32768)
+        except OSError:
+            data = b""
+        if not data:
+            break
+        send(i, data)
+    send(i, b"")
+    finish(i, "recv")
+def accept():
+    i = 0
+    while True:
+        try:
+            conn = ln.accept()[0]
+        except OSError:
+            return
+        i += 1
+        with lock:
+            conns[i] = conn
+            done[i] = set()
+        send(i, b"")
+        threading.Thread(target=recv, args=(i, conn), daemon=True).start()
+send(0, b"")
+threading.Thread(target=accept, daemon=True).start()
+def read(n):
+    b = b""
+    while len(b) < n:
+        d = os.read(0, n - len(b))
+        if not d:
+            sys.exit(0)
+        b += d
+    return b
+while True:
+    i, n = struct.unpack(">II", read(8))
+    data = read(n)
+    if i == 0:
+        with lock:
+            stopped.set()
+            try:
+                ln.shutdown(socket.SHUT_RDWR)
+            except OSError:
+                pass
+            ln.close()
+            if not conns:
+                os._exit(0)
+        continue
+    with lock:
+        conn = conns.get(i)
+    if conn is None:
+        continue
+    try:
+        if n:
+            conn.sendall(data)
+        else:
+            conn.shutdown(socket.SHUT_WR)
+    except OSError:
+        pass
+    if not n:
+        finish(i, "send")
+`
+
+// Connections accepted by a listen command on the guest, multiplexed over
+// its stdin and stdout.
+//
+// Data of each connection is sent in frames of a 4 byte connection number,
+// a 4 byte length and the data, with integers in big endian. The listen
+// command sends a frame for connection 0 once it listens. It numbers
+// connections from 1 in the order it accepts them, and sends a frame of
+// length 0 when it accepts one. A later frame of length 0 ends the data of
+// a connection in its direction. A frame for connection 0 sent to the
+// listen command asks it to stop accepting connections and exit once its
+// connections are closed.
+type frameMux struct {
+	// Connect the local end of a new connection
+	dial func() (net.Conn, error)
+	// Stdin of the listen command
+	w  net.Conn
+	wl sync.Mutex
+	// Closed once the listen command listens
+	ready chan struct{}
+	// Open connections by connection number
+	conns map[uint32]*muxConn
+	// Highest connection number opened
+	last uint32
+	l    sync.Mutex
+}
+
+// A connection of the listen command and its local end
+type muxConn struct {
+	// Local end, set once it is connected
+	conn net.Conn
+	// Data waiting to be written to conn, where empty data ends it
+	pending [][]byte
+	// Signalled with the lock of the frameMux held when pending grows or
+	// closed is set
+	cond   *sync.Cond
+	closed bool
+	// Number of directions that ended
+	ends int
+}
+
+// Multiplex the connections of a listen command with stdin w, and connect
+// each one with dial
+func newFrameMux(w net.Conn, dial func() (net.Conn, error)) *frameMux {
+	return &frameMux{
+		dial:  dial,
+		w:     w,
+		ready: make(chan struct{}),
+		conns: make(map[uint32]*muxConn),
+	}
+}
+
+// Relay the frames read from the stdout r of the listen command to the
+// local connections, until r ends.
+//
+// Each connection is written by its own goroutine, so a slow local end
+// does not hold up the others.
+func (m *frameMux) demux(r io.Reader) {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			m.closeConns()
+			return
+		}
+		id := binary.BigEndian.Uint32(header[:4])
+		data := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			m.closeConns()
+			return
+		}
+
+		if id == 0 {
+			select {
+			case <-m.ready:
+			default:
+				close(m.ready)
+			}
+			continue
+		}
+
+		m.l.Lock()
+		c, ok := m.conns[id]
+		if !ok && id > m.last {
+			m.last = id
+			c = &muxConn{cond: sync.NewCond(&m.l)}
+			m.conns[id] = c
+			go m.write(id, c)
+		} else if ok {
+			c.pending = append(c.pending, data)
+			c.cond.Signal()
+		}
+		m.l.Unlock()
+	}
+}
+
+// Connect the local end of connection id and write the data of the listen
+// command to it
+func (m *frameMux) write(id uint32, c *muxConn) {
+	conn, err := m.dial()
+	m.l.Lock()
+	if err != nil || c.closed {
+		delete(m.conns, id)
+		m.l.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+		m.send(id, nil)
+		return
+	}
+	c.conn = conn
+	go m.mux(id, c)
+
+	// Data is dropped once a write fails, until the listen command ends it
+	for {
+		for len(c.pending) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			m.l.Unlock()
+			return
+		}
+		data := c.pending[0]
+		c.pending = c.pending[1:]
+		m.l.Unlock()
+
+		if len(data) == 0 {
+			if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+			m.finish(id)
+			return
+		}
+		if err == nil {
+			_, err = conn.Write(data)
+		}
+		m.l.Lock()
+	}
+}
+
+// Relay the data of the local end of connection id to the listen command
+func (m *frameMux) mux(id uint32, c *muxConn) {
+	buf := make([]byte, MUXMAXFRAME)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			if m.send(id, buf[:n]) != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	m.send(id, nil)
+	m.finish(id)
+}
+
+// Count an ended direction of connection id, and close it once both ended
+func (m *frameMux) finish(id uint32) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	c, ok := m.conns[id]
+	if !ok {
+		return
+	}
+	c.ends++
+	if c.ends == 2 {
+		delete(m.conns, id)
+		c.conn.Close()
+	}
+}
+
+// Send a frame to the listen command
+func (m *frameMux) send(id uint32, data []byte) error {
+	frame := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(frame[:4], id)
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(data)))
+	copy(frame[8:], data)
+	m.wl.Lock()
+	defer m.wl.Unlock()
+	_, err := m.w.Write(frame)
+	return err
+}
+
+// Ask the listen command to stop accepting connections
+func (m *frameMux) stop() error {
+	return m.send(0, nil)
+}
+
+func (m *frameMux) closeConns() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	for id, c := range m.conns {
+		c.closed = true
+		c.cond.Broadcast()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		delete(m.conns, id)
+	}
+}
+
+// Close stdin of the listen command and the local connections
+func (m *frameMux) Close() error {
+	err := m.w.Close()
+	m.closeConns()
+	return err
+}
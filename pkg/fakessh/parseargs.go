@@ -0,0 +1,494 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// The OpenSSH getopt string.
+	// A character followed by a colon takes an argument.
+	SSHOPTSTRING = "1246ab:c:e:fgi:kl:m:no:p:qstvxAB:CD:E:F:GI:J:KL:MNO:P:Q:R:S:TVw:W:XYy"
+)
+
+// An error in the ssh command line
+type UsageError struct {
+	Msg string
+}
+
+func (e *UsageError) Error() string {
+	return e.Msg
+}
+
+// A configuration option passed with -o
+type Option struct {
+	Key string
+	// The unparsed value
+	Value string
+}
+
+// Split the value of the option into arguments.
+//
+// Like OpenSSH, arguments are separated by whitespace and may be quoted with
+// single or double quotes.
+func (o Option) Args() []string {
+	return splitConfigArgs(o.Value)
+}
+
+// A parsed ssh command line
+type Invocation struct {
+	// Destination as written on the command line
+	Destination string
+	// Host part of the destination
+	Host string
+	// Host to connect to, from the HostName option or Host.
+	// Set by ReadConfig.
+	HostName string
+	// User from -l, -o User or the destination, in order of precedence
+	User string
+	// Port from -p, -o Port or an ssh:// destination. 0 if unset.
+	Port int
+	// True if the destination was given as an ssh:// URI
+	URI bool
+	// Options passed with -o, in command line order, followed by the options
+	// read from ssh_config files by ReadConfig
+	Options []Option
+	// Number of times each flag without an argument was passed
+	Flags map[byte]int
+	// Arguments of each flag that takes one, in command line order
+	FlagArgs map[byte][]string
+	// Ports forwarded with -L or the LocalForward option, in order
+	LocalForwards []LocalForward
+	// Ports forwarded with -R or the RemoteForward option, in order
+	RemoteForwards []RemoteForward
+	// Ports forwarded with -D or the DynamicForward option, in order
+	DynamicForwards []DynamicForward
+	// Target of ssh -W. The remote command is not run if it is set.
+	StdioForward *HostPort
+	// The remote command argv
+	Command []string
+	// Do not run the commands of Match exec criteria in ReadConfig
+	skipExec bool
+}
+
+// Check if flag f was passed
+func (inv *Invocation) Flag(f byte) bool {
+	return inv.Flags[f] > 0
+}
+
+// Get the last argument passed to flag f
+func (inv *Invocation) FlagArg(f byte) (string, bool) {
+	args := inv.FlagArgs[f]
+	if len(args) == 0 {
+		return "", false
+	}
+	return args[len(args)-1], true
+}
+
+// Get the first value passed with -o for the case insensitive key.
+//
+// Like OpenSSH, the first value obtained for an option is the one used.
+func (inv *Invocation) Option(key string) (string, bool) {
+	for _, o := range inv.Options {
+		if strings.EqualFold(o.Key, key) {
+			return o.Value, true
+		}
+	}
+	return "", false
+}
+
+// Return a function checking if flag f is known by the getopt string
+// optstring, and if it takes an argument
+func optTakesArg(optstring string) func(f byte) (known bool, hasArg bool) {
+	return func(f byte) (bool, bool) {
+		i := strings.IndexByte(optstring, f)
+		if f == ':' || i < 0 {
+			return false, false
+		}
+		return true, i+1 < len(optstring) && optstring[i+1] == ':'
+	}
+}
+
+// An option parsed by getopt
+type getoptFlag struct {
+	Flag byte
+	// The argument of Flag if HasArg is set
+	Arg    string
+	HasArg bool
+}
+
+// Parse the options at the start of args with BSD getopt semantics, until
+// the first operand or "--". takesArg checks if a flag is known and if it
+// takes an argument.
+//
+// Returns the options, the number of arguments parsed and whether "--"
+// ended the options. On error, the options before the invalid one are
+// returned.
+func getopt(
+	args []string,
+	takesArg func(f byte) (known bool, hasArg bool),
+) ([]getoptFlag, int, bool, error) {
+	flags := []getoptFlag{}
+	i := 0
+	for i < len(args) {
+		arg := args[i]
+		if arg == "--" {
+			return flags, i + 1, true, nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		i++
+		for j := 1; j < len(arg); j++ {
+			f := arg[j]
+			known, hasArg := takesArg(f)
+			if !known {
+				return flags, i, false, &UsageError{
+					Msg: fmt.Sprintf("illegal option -- %c", f),
+				}
+			}
+			if !hasArg {
+				flags = append(flags, getoptFlag{Flag: f})
+				continue
+			}
+			var val string
+			if j+1 < len(arg) {
+				val = arg[j+1:]
+			} else if i < len(args) {
+				val = args[i]
+				i++
+			} else {
+				return flags, i, false, &UsageError{
+					Msg: fmt.Sprintf("option requires an argument -- %c", f),
+				}
+			}
+			flags = append(flags, getoptFlag{Flag: f, Arg: val, HasArg: true})
+			break
+		}
+	}
+	return flags, i, false, nil
+}
+
+// Parse the arguments of ssh (including argv[0]) the way OpenSSH does.
+//
+// Options are parsed with BSD getopt semantics until the destination. Like
+// OpenSSH, option parsing restarts after the destination, and the first
+// argument that is not an option starts the remote command. An argument of
+// "--" ends option parsing.
+//
+// A missing destination is not an error, since some invocations (like
+// ssh -V) do not need one.
+func ParseArgs(args []string) (*Invocation, error) {
+	inv := &Invocation{
+		Flags:    make(map[byte]int),
+		FlagArgs: make(map[byte][]string),
+		Command:  []string{},
+	}
+	if len(args) == 0 {
+		return inv, nil
+	}
+
+	i := 1
+	for {
+		flags, n, terminated, optErr :=
+			getopt(args[i:], optTakesArg(SSHOPTSTRING))
+		i += n
+		for _, f := range flags {
+			if !f.HasArg {
+				inv.Flags[f.Flag]++
+				continue
+			}
+			err := inv.addFlagArg(f.Flag, f.Arg)
+			if err != nil {
+				return inv, err
+			}
+		}
+		if optErr != nil {
+			return inv, optErr
+		}
+
+		if i >= len(args) || inv.Destination != "" {
+			break
+		}
+		err := inv.setDestination(args[i])
+		if err != nil {
+			return inv, err
+		}
+		i++
+		if terminated {
+			break
+		}
+	}
+
+	inv.Command = append(inv.Command, args[i:]...)
+	return inv, nil
+}
+
+// Record argument val of flag f
+func (inv *Invocation) addFlagArg(f byte, val string) error {
+	inv.FlagArgs[f] = append(inv.FlagArgs[f], val)
+	switch f {
+	case 'l':
+		if inv.User == "" {
+			inv.User = val
+		}
+	case 'p':
+		if inv.Port == 0 {
+			port, err := parsePort(val)
+			if err != nil {
+				return err
+			}
+			inv.Port = port
+		}
+	case 'O':
+		if inv.StdioForward != nil {
+			return &UsageError{
+				Msg: "Cannot specify multiplexing command with -W",
+			}
+		}
+		if !isControlOp(val) {
+			return &UsageError{Msg: "Invalid multiplex command."}
+		}
+	case 'J':
+		if len(inv.FlagArgs['J']) > 1 {
+			return &UsageError{Msg: "Only a single -J option is permitted"}
+		}
+	case 'L':
+		fwd, err := ParseLocalForward(val)
+		if err != nil {
+			return &UsageError{
+				Msg: fmt.Sprintf("Bad local forwarding specification '%s'", val),
+			}
+		}
+		inv.LocalForwards = append(inv.LocalForwards, fwd)
+	case 'R':
+		fwd, err := ParseRemoteForward(val)
+		if err != nil {
+			return &UsageError{
+				Msg: fmt.Sprintf("Bad remote forwarding specification '%s'", val),
+			}
+		}
+		inv.RemoteForwards = append(inv.RemoteForwards, fwd)
+	case 'D':
+		fwd, err := ParseDynamicForward(val)
+		if err != nil {
+			return &UsageError{
+				Msg: fmt.Sprintf("Bad dynamic forwarding specification '%s'", val),
+			}
+		}
+		inv.DynamicForwards = append(inv.DynamicForwards, fwd)
+	case 'W':
+		if inv.StdioForward != nil {
+			return &UsageError{Msg: "stdio forward already specified"}
+		}
+		if len(inv.FlagArgs['O']) > 0 {
+			return &UsageError{Msg: "Cannot specify stdio forward with -O"}
+		}
+		target, err := ParseHostPort(val)
+		if err != nil {
+			return &UsageError{
+				Msg: fmt.Sprintf("Bad stdio forwarding specification '%s'", val),
+			}
+		}
+		inv.StdioForward = &target
+	case 'o':
+		key, value, err := parseOption(val)
+		if err != nil {
+			return err
+		}
+		return inv.addOption(key, value)
+	}
+	return nil
+}
+
+// Record a configuration option, from -o or an ssh_config file
+func (inv *Invocation) addOption(key string, value string) error {
+	inv.Options = append(inv.Options, Option{Key: key, Value: value})
+	args := splitConfigArgs(value)
+	if len(args) == 0 {
+		return nil
+	}
+	switch {
+	case strings.EqualFold(key, "LocalForward"):
+		spec := strings.Join(args, ":")
+		fwd, err := ParseLocalForward(spec)
+		if err != nil || len(args) != 2 {
+			return &UsageError{
+				Msg: fmt.Sprintf("Bad local forwarding specification '%s'", value),
+			}
+		}
+		inv.LocalForwards = append(inv.LocalForwards, fwd)
+	case strings.EqualFold(key, "RemoteForward"):
+		spec := strings.Join(args, ":")
+		fwd, err := ParseRemoteForward(spec)
+		if err != nil || len(args) != 2 {
+			return &UsageError{
+				Msg: fmt.Sprintf("Bad remote forwarding specification '%s'", value),
+			}
+		}
+		inv.RemoteForwards = append(inv.RemoteForwards, fwd)
+	case strings.EqualFold(key, "DynamicForward"):
+		fwd, err := ParseDynamicForward(args[0])
+		if err != nil || len(args) != 1 {
+			return &UsageError{
+				Msg: fmt.Sprintf(
+					"Bad dynamic forwarding specification '%s'", value),
+			}
+		}
+		inv.DynamicForwards = append(inv.DynamicForwards, fwd)
+	case strings.EqualFold(key, "User") && inv.User == "":
+		inv.User = args[0]
+	case strings.EqualFold(key, "Port") && inv.Port == 0:
+		port, err := parsePort(args[0])
+		if err != nil {
+			return err
+		}
+		inv.Port = port
+	}
+	return nil
+}
+
+// Parse a destination of the form [user@]host or ssh://[user@]host[:port]
+func (inv *Invocation) setDestination(dest string) error {
+	inv.Destination = dest
+	user := ""
+	host := dest
+	port := 0
+
+	if strings.HasPrefix(strings.ToLower(dest), "ssh://") {
+		inv.URI = true
+		rest := strings.TrimSuffix(dest[len("ssh://"):], "/")
+		if strings.ContainsAny(rest, "/?#") {
+			return &UsageError{Msg: fmt.Sprintf("invalid URI %q", dest)}
+		}
+		if k := strings.LastIndexByte(rest, '@'); k >= 0 {
+			user = rest[:k]
+			rest = rest[k+1:]
+		}
+		host = rest
+		portStr := ""
+		if strings.HasPrefix(rest, "[") {
+			k := strings.IndexByte(rest, ']')
+			if k < 0 {
+				return &UsageError{Msg: fmt.Sprintf("invalid URI %q", dest)}
+			}
+			host = rest[1:k]
+			if k+1 < len(rest) {
+				if rest[k+1] != ':' {
+					return &UsageError{Msg: fmt.Sprintf("invalid URI %q", dest)}
+				}
+				portStr = rest[k+2:]
+			}
+		} else if k := strings.IndexByte(rest, ':'); k >= 0 {
+			host = rest[:k]
+			portStr = rest[k+1:]
+		}
+		if portStr != "" {
+			p, err := parsePort(portStr)
+			if err != nil {
+				return err
+			}
+			port = p
+		}
+	} else if k := strings.LastIndexByte(dest, '@'); k >= 0 {
+		user = dest[:k]
+		host = dest[k+1:]
+	}
+
+	if host == "" || (strings.Contains(dest, "@") && user == "") {
+		return &UsageError{Msg: fmt.Sprintf("invalid destination %q", dest)}
+	}
+	inv.Host = host
+	if inv.User == "" {
+		inv.User = user
+	}
+	if inv.Port == 0 {
+		inv.Port = port
+	}
+	return nil
+}
+
+// Parse a port number between 1 and 65535
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, &UsageError{Msg: fmt.Sprintf("Bad port '%s'", s)}
+	}
+	return port, nil
+}
+
+// Split an ssh_config style line like "Key=Value" or "Key Value".
+func parseOption(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	k := strings.IndexAny(s, "= \t")
+	if k <= 0 {
+		return "", "", &UsageError{Msg: fmt.Sprintf("invalid option %q", s)}
+	}
+	key := s[:k]
+	value := strings.TrimLeft(s[k:], " \t")
+	if strings.HasPrefix(value, "=") {
+		value = strings.TrimLeft(value[1:], " \t")
+	}
+	value = strings.TrimRight(value, " \t")
+	return key, value, nil
+}
+
+// Split an ssh_config style value into whitespace separated arguments.
+//
+// Arguments may be quoted with single or double quotes, and a backslash
+// escapes a following quote or backslash.
+func splitConfigArgs(s string) []string {
+	args := []string{}
+	b := strings.Builder{}
+	inArg := false
+	var quote byte = 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) &&
+			(s[i+1] == '\\' || s[i+1] == '"' || s[i+1] == '\''):
+			i++
+			b.WriteByte(s[i])
+			inArg = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			b.WriteByte(c)
+		case c == '"' || c == '\'':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t':
+			if inArg {
+				args = append(args, b.String())
+				b.Reset()
+				inArg = false
+			}
+		default:
+			b.WriteByte(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, b.String())
+	}
+	return args
+}
+
+// Convert an array of strings into a sh command
+//
+// Currently just concatenates with a space between each argument
+func ArgvToSh(cmd []string) string {
+	b := strings.Builder{}
+	for i, arg := range cmd {
+		fmt.Fprintf(&b, "%s", arg)
+		if i < len(cmd)-1 {
+			fmt.Fprintf(&b, " ")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,1102 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh_test
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	. "github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+// The parts of an Invocation checked by TestParseArgs
+//
+// flags holds each boolean flag repeated by its count, in byte order.
+type parsedArgs struct {
+	host     string
+	user     string
+	port     int
+	uri      bool
+	flags    string
+	flagArgs map[byte][]string
+	options  []Option
+	command  []string
+}
+
+func toParsedArgs(inv *Invocation) parsedArgs {
+	fs := make([]byte, 0)
+	for f, n := range inv.Flags {
+		for i := 0; i < n; i++ {
+			fs = append(fs, f)
+		}
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i] < fs[j] })
+	return parsedArgs{
+		host:     inv.Host,
+		user:     inv.User,
+		port:     inv.Port,
+		uri:      inv.URI,
+		flags:    string(fs),
+		flagArgs: inv.FlagArgs,
+		options:  inv.Options,
+		command:  inv.Command,
+	}
+}
+
+// Argument vectors produced by real programs
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		expected parsedArgs
+	}{
+		{
+			name:  "echo",
+			input: []string{"ssh", "user@localhost", "--", "echo", "test"},
+			expected: parsedArgs{
+				host:     "localhost",
+				user:     "user",
+				flags:    "",
+				flagArgs: map[byte][]string{},
+				command:  []string{"echo", "test"},
+			},
+		},
+		{
+			name: "nix base",
+			input: []string{"ssh", "user@host", "-x", "-a",
+				"-i", "$HOME/.ssh/id_rsa.pub",
+				"-C",
+				"nix-daemon --stdio",
+			},
+			expected: parsedArgs{
+				host:  "host",
+				user:  "user",
+				flags: "Cax",
+				flagArgs: map[byte][]string{
+					'i': {"$HOME/.ssh/id_rsa.pub"},
+				},
+				command: []string{"nix-daemon --stdio"},
+			},
+		},
+		{
+			name: "nix socket",
+			input: []string{"ssh", "user@host", "-x", "-a",
+				"-S", "/tmp/ssh.sock",
+				"nix-daemon --stdio",
+			},
+			expected: parsedArgs{
+				host:     "host",
+				user:     "user",
+				flags:    "ax",
+				flagArgs: map[byte][]string{'S': {"/tmp/ssh.sock"}},
+				command:  []string{"nix-daemon --stdio"},
+			},
+		},
+		{
+			name: "nix chatty",
+			input: []string{"ssh", "user@host", "-x", "-a",
+				"-v",
+				"nix-daemon --stdio",
+			},
+			expected: parsedArgs{
+				host:     "host",
+				user:     "user",
+				flags:    "avx",
+				flagArgs: map[byte][]string{},
+				command:  []string{"nix-daemon --stdio"},
+			},
+		},
+		{
+			name: "nix socket create",
+			input: []string{"ssh", "user@host", "-M", "-N",
+				"-S", "/tmp/ssh.sock",
+				"-o", "LocalCommand=echo started",
+				"-o", "PermitLocalCommand=yes",
+			},
+			expected: parsedArgs{
+				host:  "host",
+				user:  "user",
+				flags: "MN",
+				flagArgs: map[byte][]string{
+					'S': {"/tmp/ssh.sock"},
+					'o': {"LocalCommand=echo started", "PermitLocalCommand=yes"},
+				},
+				options: []Option{
+					{Key: "LocalCommand", Value: "echo started"},
+					{Key: "PermitLocalCommand", Value: "yes"},
+				},
+				command: []string{},
+			},
+		},
+		{
+			name: "nix-copy-closure",
+			input: []string{"ssh", "root@server", "-x", "-a",
+				"-oPermitLocalCommand=yes", "-oLocalCommand=echo started",
+				"--", "nix-store", "--serve", "--write",
+			},
+			expected: parsedArgs{
+				host:  "server",
+				user:  "root",
+				flags: "ax",
+				flagArgs: map[byte][]string{
+					'o': {"PermitLocalCommand=yes", "LocalCommand=echo started"},
+				},
+				options: []Option{
+					{Key: "PermitLocalCommand", Value: "yes"},
+					{Key: "LocalCommand", Value: "echo started"},
+				},
+				command: []string{"nix-store", "--serve", "--write"},
+			},
+		},
+		{
+			name: "nix ssh-ng uri",
+			input: []string{"ssh", "ssh://builder@[::1]:2222", "-x", "-a",
+				"--", "nix-daemon", "--stdio",
+			},
+			expected: parsedArgs{
+				host:     "::1",
+				user:     "builder",
+				port:     2222,
+				uri:      true,
+				flags:    "ax",
+				flagArgs: map[byte][]string{},
+				command:  []string{"nix-daemon", "--stdio"},
+			},
+		},
+		{
+			name: "git",
+			input: []string{"ssh", "-o", "SendEnv=GIT_PROTOCOL",
+				"git@githost", "git-upload-pack '/srv/repo.git'",
+			},
+			expected: parsedArgs{
+				host:     "githost",
+				user:     "git",
+				flags:    "",
+				flagArgs: map[byte][]string{'o': {"SendEnv=GIT_PROTOCOL"}},
+				options:  []Option{{Key: "SendEnv", Value: "GIT_PROTOCOL"}},
+				command:  []string{"git-upload-pack '/srv/repo.git'"},
+			},
+		},
+		{
+			name: "git port ipv4",
+			input: []string{"ssh", "-o", "SendEnv=GIT_PROTOCOL", "-4",
+				"-p", "2222", "git@githost", "git-receive-pack 'repo.git'",
+			},
+			expected: parsedArgs{
+				host:  "githost",
+				user:  "git",
+				port:  2222,
+				flags: "4",
+				flagArgs: map[byte][]string{
+					'o': {"SendEnv=GIT_PROTOCOL"},
+					'p': {"2222"},
+				},
+				options: []Option{{Key: "SendEnv", Value: "GIT_PROTOCOL"}},
+				command: []string{"git-receive-pack 'repo.git'"},
+			},
+		},
+		{
+			name: "rsync",
+			input: []string{"ssh", "-l", "deploy", "server",
+				"rsync", "--server", "-vlogDtpre.iLsfxC", ".", "/dst",
+			},
+			expected: parsedArgs{
+				host:     "server",
+				user:     "deploy",
+				flags:    "",
+				flagArgs: map[byte][]string{'l': {"deploy"}},
+				command: []string{
+					"rsync", "--server", "-vlogDtpre.iLsfxC", ".", "/dst",
+				},
+			},
+		},
+		{
+			name: "scp",
+			input: []string{"ssh", "-x",
+				"-oPermitLocalCommand=no", "-oClearAllForwardings=yes",
+				"-oRemoteCommand=none", "-oRequestTTY=no",
+				"-oForwardAgent=no", "-p", "2200", "-l", "deploy",
+				"--", "server", "scp -t -- /dst",
+			},
+			expected: parsedArgs{
+				host:  "server",
+				user:  "deploy",
+				port:  2200,
+				flags: "x",
+				flagArgs: map[byte][]string{
+					'o': {
+						"PermitLocalCommand=no", "ClearAllForwardings=yes",
+						"RemoteCommand=none", "RequestTTY=no",
+						"ForwardAgent=no",
+					},
+					'p': {"2200"},
+					'l': {"deploy"},
+				},
+				options: []Option{
+					{Key: "PermitLocalCommand", Value: "no"},
+					{Key: "ClearAllForwardings", Value: "yes"},
+					{Key: "RemoteCommand", Value: "none"},
+					{Key: "RequestTTY", Value: "no"},
+					{Key: "ForwardAgent", Value: "no"},
+				},
+				command: []string{"scp -t -- /dst"},
+			},
+		},
+		{
+			name: "scp sftp",
+			input: []string{"ssh", "-oForwardX11 no", "-oForwardAgent no",
+				"-oPermitLocalCommand no", "-oClearAllForwardings yes",
+				"-l", "deploy", "-s", "--", "server", "sftp",
+			},
+			expected: parsedArgs{
+				host:  "server",
+				user:  "deploy",
+				flags: "s",
+				flagArgs: map[byte][]string{
+					'o': {
+						"ForwardX11 no", "ForwardAgent no",
+						"PermitLocalCommand no", "ClearAllForwardings yes",
+					},
+					'l': {"deploy"},
+				},
+				options: []Option{
+					{Key: "ForwardX11", Value: "no"},
+					{Key: "ForwardAgent", Value: "no"},
+					{Key: "PermitLocalCommand", Value: "no"},
+					{Key: "ClearAllForwardings", Value: "yes"},
+				},
+				command: []string{"sftp"},
+			},
+		},
+		{
+			name: "ansible",
+			input: []string{"ssh", "-C",
+				"-o", "ControlMaster=auto", "-o", "ControlPersist=60s",
+				"-o", "KbdInteractiveAuthentication=no",
+				"-o", "PasswordAuthentication=no",
+				"-o", `User="deploy"`, "-o", "ConnectTimeout=10",
+				"-o", "ControlPath=/home/u/.ansible/cp/0a1b2c3d4e",
+				"-tt", "server", `/bin/sh -c 'echo ~deploy && sleep 0'`,
+			},
+			expected: parsedArgs{
+				host:  "server",
+				user:  "deploy",
+				flags: "Ctt",
+				flagArgs: map[byte][]string{
+					'o': {
+						"ControlMaster=auto", "ControlPersist=60s",
+						"KbdInteractiveAuthentication=no",
+						"PasswordAuthentication=no",
+						`User="deploy"`, "ConnectTimeout=10",
+						"ControlPath=/home/u/.ansible/cp/0a1b2c3d4e",
+					},
+				},
+				options: []Option{
+					{Key: "ControlMaster", Value: "auto"},
+					{Key: "ControlPersist", Value: "60s"},
+					{Key: "KbdInteractiveAuthentication", Value: "no"},
+					{Key: "PasswordAuthentication", Value: "no"},
+					{Key: "User", Value: `"deploy"`},
+					{Key: "ConnectTimeout", Value: "10"},
+					{Key: "ControlPath", Value: "/home/u/.ansible/cp/0a1b2c3d4e"},
+				},
+				command: []string{`/bin/sh -c 'echo ~deploy && sleep 0'`},
+			},
+		},
+		{
+			name:  "bundled with argument",
+			input: []string{"ssh", "-Tp", "22", "host", "true"},
+			expected: parsedArgs{
+				host:     "host",
+				port:     22,
+				flags:    "T",
+				flagArgs: map[byte][]string{'p': {"22"}},
+				command:  []string{"true"},
+			},
+		},
+		{
+			name:  "bundled with attached argument",
+			input: []string{"ssh", "-4Aikey", "-p22", "host", "-x", "ls", "-l"},
+			expected: parsedArgs{
+				host:  "host",
+				port:  22,
+				flags: "4Ax",
+				flagArgs: map[byte][]string{
+					'i': {"key"},
+					'p': {"22"},
+				},
+				command: []string{"ls", "-l"},
+			},
+		},
+		{
+			name:  "first user wins",
+			input: []string{"ssh", "-l", "first", "second@host"},
+			expected: parsedArgs{
+				host:     "host",
+				user:     "first",
+				flags:    "",
+				flagArgs: map[byte][]string{'l': {"first"}},
+				command:  []string{},
+			},
+		},
+		{
+			name:  "no destination",
+			input: []string{"ssh", "-V"},
+			expected: parsedArgs{
+				flags:    "V",
+				flagArgs: map[byte][]string{},
+				command:  []string{},
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.input)
+			if err != nil {
+				t.Fatalf("failed for %#v ... (%s)", tt.input, err)
+			}
+			got := toParsedArgs(inv)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v)",
+					tt.input,
+					tt.expected,
+					got,
+				)
+			}
+		})
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+	}{
+		{
+			name:  "unknown flag",
+			input: []string{"ssh", "-Z", "host"},
+		},
+		{
+			name:  "missing argument",
+			input: []string{"ssh", "host", "-p"},
+		},
+		{
+			name:  "bad port",
+			input: []string{"ssh", "-p", "ssh", "host"},
+		},
+		{
+			name:  "bad uri port",
+			input: []string{"ssh", "ssh://host:70000"},
+		},
+		{
+			name:  "empty user",
+			input: []string{"ssh", "@host"},
+		},
+		{
+			name:  "bad control command",
+			input: []string{"ssh", "-O", "restart", "host"},
+		},
+		{
+			name:  "bad stdio forward",
+			input: []string{"ssh", "-W", "localhost", "host"},
+		},
+		{
+			name:  "stdio forward twice",
+			input: []string{"ssh", "-W", "a:22", "-W", "b:22", "host"},
+		},
+		{
+			name:  "stdio forward with control command",
+			input: []string{"ssh", "-O", "check", "-W", "a:22", "host"},
+		},
+		{
+			name:  "bad remote forward",
+			input: []string{"ssh", "-R", "8080", "host"},
+		},
+		{
+			name:  "bad dynamic forward",
+			input: []string{"ssh", "-D", "localhost:socks", "host"},
+		},
+		{
+			name:  "jump host twice",
+			input: []string{"ssh", "-J", "a", "-J", "b", "host"},
+		},
+		{
+			name:  "uri path",
+			input: []string{"ssh", "ssh://host/path"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			_, err := ParseArgs(tt.input)
+			if _, ok := err.(*UsageError); !ok {
+				t.Errorf(
+					"failed for %#v ... (expected UsageError, but got %#v)",
+					tt.input,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseLocalForward(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected LocalForward
+		listen   string
+		err      bool
+	}{
+		{
+			spec: "8080:localhost:80",
+			expected: LocalForward{
+				BindPort: 8080,
+				Target:   HostPort{Host: "localhost", Port: 80},
+			},
+			listen: "localhost:8080",
+		},
+		{
+			spec: "*:5432:db.internal:5432",
+			expected: LocalForward{
+				BindAddress: "*",
+				BindPort:    5432,
+				Target:      HostPort{Host: "db.internal", Port: 5432},
+			},
+			listen: ":5432",
+		},
+		{
+			spec: "[::1]:8080:[fd00::2]:80",
+			expected: LocalForward{
+				BindAddress: "::1",
+				BindPort:    8080,
+				Target:      HostPort{Host: "fd00::2", Port: 80},
+			},
+			listen: "[::1]:8080",
+		},
+		{spec: "8080:localhost", err: true},
+		{spec: "http:localhost:80", err: true},
+		{spec: "8080::80", err: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.spec), func(t *testing.T) {
+			got, err := ParseLocalForward(tt.spec)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error for %#v", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed for %#v: %s", tt.spec, err)
+			}
+			if got != tt.expected || got.ListenAddress() != tt.listen {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v listening "+
+						"on %#v)",
+					tt.spec,
+					tt.expected,
+					got,
+					got.ListenAddress(),
+				)
+			}
+		})
+	}
+}
+
+func TestParseRemoteForward(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected RemoteForward
+		listen   HostPort
+		err      bool
+	}{
+		{
+			spec: "3128:localhost:3128",
+			expected: RemoteForward{
+				BindPort: 3128,
+				Target:   HostPort{Host: "localhost", Port: 3128},
+			},
+			listen: HostPort{Host: "localhost", Port: 3128},
+		},
+		{
+			spec: "*:8080:cache.local:80",
+			expected: RemoteForward{
+				BindAddress: "*",
+				BindPort:    8080,
+				Target:      HostPort{Host: "cache.local", Port: 80},
+			},
+			listen: HostPort{Host: "0.0.0.0", Port: 8080},
+		},
+		{spec: "3128:localhost", err: true},
+		{spec: "3128:localhost:squid", err: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.spec), func(t *testing.T) {
+			got, err := ParseRemoteForward(tt.spec)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error for %#v", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed for %#v: %s", tt.spec, err)
+			}
+			if got != tt.expected || got.ListenAddress() != tt.listen {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v listening "+
+						"on %#v)",
+					tt.spec,
+					tt.expected,
+					got,
+					got.ListenAddress(),
+				)
+			}
+		})
+	}
+}
+
+func TestParseDynamicForward(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected DynamicForward
+		listen   string
+		err      bool
+	}{
+		{
+			spec:     "1080",
+			expected: DynamicForward{BindPort: 1080},
+			listen:   "localhost:1080",
+		},
+		{
+			spec:     "*:1080",
+			expected: DynamicForward{BindAddress: "*", BindPort: 1080},
+			listen:   ":1080",
+		},
+		{
+			spec:     "[::1]:1080",
+			expected: DynamicForward{BindAddress: "::1", BindPort: 1080},
+			listen:   "[::1]:1080",
+		},
+		{spec: "socks", err: true},
+		{spec: "localhost:1080:proxy", err: true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.spec), func(t *testing.T) {
+			got, err := ParseDynamicForward(tt.spec)
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error for %#v", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed for %#v: %s", tt.spec, err)
+			}
+			if got != tt.expected || got.ListenAddress() != tt.listen {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v listening "+
+						"on %#v)",
+					tt.spec,
+					tt.expected,
+					got,
+					got.ListenAddress(),
+				)
+			}
+		})
+	}
+}
+
+func TestArgvToSh(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		expected string
+	}{
+		{
+			name:     "bell",
+			input:    []string{"printf", "\a\n"},
+			expected: "printf \a\n",
+		},
+		{
+			name:     "nix-daemon",
+			input:    []string{"nix-daemon --stdio"},
+			expected: "nix-daemon --stdio",
+		},
+		{
+			name:     "empty",
+			input:    []string{},
+			expected: "",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			got := ArgvToSh(tt.input)
+			if got != tt.expected {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v)",
+					tt.input,
+					tt.expected,
+					got,
+				)
+			}
+		})
+	}
+}
+
+func TestShellSplit(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []string
+		ok       bool
+	}{
+		{
+			name:     "scp sink",
+			input:    "scp -t -- /tmp/dst",
+			expected: []string{"scp", "-t", "--", "/tmp/dst"},
+			ok:       true,
+		},
+		{
+			name:     "quotes",
+			input:    `scp -f 'a b'"c\"d" e\ f`,
+			expected: []string{"scp", "-f", `a bc"d`, "e f"},
+			ok:       true,
+		},
+		{
+			name:     "empty quotes",
+			input:    "echo '' \"\"",
+			expected: []string{"echo", "", ""},
+			ok:       true,
+		},
+		{
+			name:     "empty",
+			input:    "  ",
+			expected: []string{},
+			ok:       true,
+		},
+		{
+			name:  "expansion",
+			input: "scp -f $HOME/f",
+		},
+		{
+			name:  "expansion in double quotes",
+			input: `scp -f "$HOME"`,
+		},
+		{
+			name:  "glob",
+			input: "scp -f /tmp/*",
+		},
+		{
+			name:  "tilde",
+			input: "scp -f ~/f",
+		},
+		{
+			name:  "list",
+			input: "cd /tmp; scp -t .",
+		},
+		{
+			name:  "assignment",
+			input: "LANG=C scp -t .",
+		},
+		{
+			name:  "unterminated quote",
+			input: "scp -t 'a",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			got, ok := ShellSplit(tt.input)
+			if ok != tt.ok || (ok && !reflect.DeepEqual(got, tt.expected)) {
+				t.Errorf(
+					"failed for %#v ... (expected %#v %v, but got %#v %v)",
+					tt.input,
+					tt.expected,
+					tt.ok,
+					got,
+					ok,
+				)
+			}
+		})
+	}
+}
+
+func TestInvocationCompression(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		expected string
+	}{
+		{
+			name:     "unset",
+			input:    []string{"ssh", "host"},
+			expected: "",
+		},
+		{
+			name:     "flag",
+			input:    []string{"ssh", "-C", "host"},
+			expected: "yes",
+		},
+		{
+			name:     "option",
+			input:    []string{"ssh", "-o", "Compression=yes", "host"},
+			expected: "yes",
+		},
+		{
+			name:     "option off",
+			input:    []string{"ssh", "-o", "compression no", "host"},
+			expected: "no",
+		},
+		{
+			name:     "flag over option",
+			input:    []string{"ssh", "-o", "Compression=no", "-C", "host"},
+			expected: "yes",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := inv.Compression()
+			if got != tt.expected {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v)",
+					tt.input,
+					tt.expected,
+					got,
+				)
+			}
+		})
+	}
+}
+
+func TestParseScpArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		flags    map[byte]int
+		flagArgs map[byte][]string
+		operands []ScpPath
+	}{
+		{
+			name:     "upload",
+			input:    []string{"scp", "-rp", "-P", "2222", "dir", "host:/dst"},
+			flags:    map[byte]int{'r': 1, 'p': 1},
+			flagArgs: map[byte][]string{'P': {"2222"}},
+			operands: []ScpPath{
+				{Arg: "dir", Path: "dir"},
+				{Arg: "host:/dst", Destination: "host", Path: "/dst"},
+			},
+		},
+		{
+			name: "download",
+			input: []string{"scp", "-o", "User=other", "-F", "none",
+				"user@host:file", "user@host:", "."},
+			flags: map[byte]int{},
+			flagArgs: map[byte][]string{
+				'o': {"User=other"},
+				'F': {"none"},
+			},
+			operands: []ScpPath{
+				{Arg: "user@host:file", Destination: "user@host", Path: "file"},
+				{Arg: "user@host:", Destination: "user@host", Path: ""},
+				{Arg: ".", Path: "."},
+			},
+		},
+		{
+			name: "local colons",
+			input: []string{"scp", "--", "-r", "./a:b", ":c",
+				"dir/host:d"},
+			flags:    map[byte]int{},
+			flagArgs: map[byte][]string{},
+			operands: []ScpPath{
+				{Arg: "-r", Path: "-r"},
+				{Arg: "./a:b", Path: "./a:b"},
+				{Arg: ":c", Path: ":c"},
+				{Arg: "dir/host:d", Path: "dir/host:d"},
+			},
+		},
+		{
+			name:     "ipv6",
+			input:    []string{"scp", "[::1]:a", "user@[fe80::1]:/b"},
+			flags:    map[byte]int{},
+			flagArgs: map[byte][]string{},
+			operands: []ScpPath{
+				{Arg: "[::1]:a", Destination: "::1", Path: "a"},
+				{Arg: "user@[fe80::1]:/b", Destination: "user@fe80::1", Path: "/b"},
+			},
+		},
+		{
+			name: "uri",
+			input: []string{"scp", "scp://user@host:2222/a%20b",
+				"scp://host//abs", "scp://host"},
+			flags:    map[byte]int{},
+			flagArgs: map[byte][]string{},
+			operands: []ScpPath{
+				{
+					Arg:         "scp://user@host:2222/a%20b",
+					Destination: "ssh://user@host:2222",
+					Path:        "a b",
+				},
+				{
+					Arg:         "scp://host//abs",
+					Destination: "ssh://host",
+					Path:        "/abs",
+				},
+				{Arg: "scp://host", Destination: "ssh://host"},
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			sinv, err := ParseScpArgs(tt.input)
+			if err != nil {
+				t.Fatalf("failed for %#v ... (%s)", tt.input, err)
+			}
+			if !reflect.DeepEqual(sinv.Flags, tt.flags) ||
+				!reflect.DeepEqual(sinv.FlagArgs, tt.flagArgs) ||
+				!reflect.DeepEqual(sinv.Operands, tt.operands) {
+				t.Errorf(
+					"failed for %#v ... (got %#v)",
+					tt.input,
+					sinv,
+				)
+			}
+		})
+	}
+}
+
+func TestParseScpArgsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+	}{
+		{
+			name:  "unknown flag",
+			input: []string{"scp", "-Z", "a", "host:"},
+		},
+		{
+			name:  "missing argument",
+			input: []string{"scp", "-P"},
+		},
+		{
+			name:  "bad port",
+			input: []string{"scp", "-P", "ssh", "a", "host:"},
+		},
+		{
+			name:  "empty user",
+			input: []string{"scp", "a", "@host:b"},
+		},
+		{
+			name:  "bad uri port",
+			input: []string{"scp", "a", "scp://host:70000/b"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			_, err := ParseScpArgs(tt.input)
+			if _, ok := err.(*UsageError); !ok {
+				t.Errorf(
+					"failed for %#v ... (expected UsageError, but got %#v)",
+					tt.input,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseRsyncServer(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		expected    *RsyncServer
+		unsupported string
+	}{
+		{
+			name:  "receiver",
+			input: "rsync --server -vlogDtpre.iLsfxCIvu . /tmp/dst",
+			expected: &RsyncServer{
+				Flags:   "vlogDtpr",
+				Options: []string{"-vlogDtpre.iLsfxCIvu"},
+				Paths:   []string{"/tmp/dst"},
+			},
+		},
+		{
+			name: "sender",
+			input: "rsync --server --sender -logDtpre.iLsfxCIvu " +
+				"--exclude-from=- . src 'a b/'",
+			expected: &RsyncServer{
+				Sender: true,
+				Flags:  "logDtpr",
+				Options: []string{"--sender", "-logDtpre.iLsfxCIvu",
+					"--exclude-from=-"},
+				Paths: []string{"src", "a b/"},
+			},
+		},
+		{
+			name:  "delete",
+			input: "rsync --server -re.iLsfxCIvu --delete-during . dst",
+			expected: &RsyncServer{
+				Flags:   "r",
+				Options: []string{"-re.iLsfxCIvu", "--delete-during"},
+				Paths:   []string{"dst"},
+			},
+			unsupported: "--delete-during",
+		},
+		{
+			name:  "guest directory",
+			input: "rsync --server -re.iLsfxCIvu --link-dest . . dst",
+			expected: &RsyncServer{
+				Flags:   "r",
+				Options: []string{"-re.iLsfxCIvu", "--link-dest", "."},
+				Paths:   []string{"dst"},
+			},
+			unsupported: "--link-dest",
+		},
+		{
+			name:  "update",
+			input: "rsync --server -ue.iLsfxCIvu . dst",
+			expected: &RsyncServer{
+				Flags:   "u",
+				Options: []string{"-ue.iLsfxCIvu"},
+				Paths:   []string{"dst"},
+			},
+			unsupported: "-u",
+		},
+		{
+			name:  "relative sender",
+			input: "rsync --server --sender -Re.iLsfxCIvu . src",
+			expected: &RsyncServer{
+				Sender:  true,
+				Flags:   "R",
+				Options: []string{"--sender", "-Re.iLsfxCIvu"},
+				Paths:   []string{"src"},
+			},
+			unsupported: "-R",
+		},
+		{
+			name:  "other command",
+			input: "rsync --version",
+		},
+		{
+			name:  "several destinations",
+			input: "rsync --server -r . a b",
+		},
+		{
+			name:  "shell",
+			input: "rsync --server -r . ~/dst",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			got := ParseRsyncServer(tt.input)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v)",
+					tt.input,
+					tt.expected,
+					got,
+				)
+			}
+			if got != nil && got.Unsupported() != tt.unsupported {
+				t.Errorf(
+					"failed for %#v ... (expected unsupported %#v, but got %#v)",
+					tt.input,
+					tt.unsupported,
+					got.Unsupported(),
+				)
+			}
+		})
+	}
+}
+
+func TestParseTransferArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []string
+		expected *TransferInvocation
+	}{
+		{
+			name:  "upload",
+			input: []string{"packer-upload", "-rp", "vm", "a", "b", "/dst"},
+			expected: &TransferInvocation{
+				Flags:       map[byte]int{'r': 1, 'p': 1},
+				FlagArgs:    map[byte][]string{},
+				Destination: "vm",
+				Paths:       []string{"a", "b", "/dst"},
+			},
+		},
+		{
+			name: "excludes",
+			input: []string{"packer-download", "-x", "*.log", "-x.git",
+				"-Fconfig", "--", "ssh://user@vm:22", "src", "-"},
+			expected: &TransferInvocation{
+				Flags: map[byte]int{},
+				FlagArgs: map[byte][]string{
+					'x': {"*.log", ".git"},
+					'F': {"config"},
+				},
+				Destination: "ssh://user@vm:22",
+				Paths:       []string{"src", "-"},
+			},
+		},
+		{
+			name:  "no destination",
+			input: []string{"packer-upload", "-q"},
+			expected: &TransferInvocation{
+				Flags:    map[byte]int{'q': 1},
+				FlagArgs: map[byte][]string{},
+				Paths:    []string{},
+			},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			got, err := ParseTransferArgs(tt.input)
+			if err != nil || !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf(
+					"failed for %#v ... (expected %#v, but got %#v %v)",
+					tt.input,
+					tt.expected,
+					got,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestParseTransferArgsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string
+	}{
+		{
+			name:  "unknown flag",
+			input: []string{"packer-upload", "-P", "22", "vm", "a", "b"},
+		},
+		{
+			name:  "missing argument",
+			input: []string{"packer-download", "-x"},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			_, err := ParseTransferArgs(tt.input)
+			if _, ok := err.(*UsageError); !ok {
+				t.Errorf(
+					"failed for %#v ... (expected UsageError, but got %#v)",
+					tt.input,
+					err,
+				)
+			}
+		})
+	}
+}
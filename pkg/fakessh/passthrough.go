@@ -0,0 +1,108 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/envmap"
+)
+
+// Find the real ssh executable, the first one on PATH that is not this one
+func RealSshPath() (string, error) {
+	return realExePath(SSHEXENAME)
+}
+
+// Find the real scp executable, the first one on PATH that is not this one
+func RealScpPath() (string, error) {
+	return realExePath(SCPEXENAME)
+}
+
+// Find the first executable named name on PATH that is not this one
+func realExePath(name string) (string, error) {
+	selfFi, err := selfStat()
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" || !dirHasExe(dir, name) || isSelfExe(dir, name, selfFi) {
+			continue
+		}
+		return filepath.Join(dir, name), nil
+	}
+	return "", fmt.Errorf("real %s executable not found in PATH",
+		strings.TrimSuffix(name, ".exe"))
+}
+
+// Stat the executable of this process
+func selfStat() (os.FileInfo, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(self)
+}
+
+// Check if the executable named name in dir is the one at selfFi
+func isSelfExe(dir string, name string, selfFi os.FileInfo) bool {
+	fi, err := os.Stat(filepath.Join(dir, name))
+	return err == nil && os.SameFile(fi, selfFi)
+}
+
+// Remove this fake ssh from the environment slice es.
+//
+// The directories of PATH holding it and the RPC directory are dropped, so
+// the real ssh and the commands it runs, like a ProxyCommand, do not run the
+// fake ssh again.
+func RealSshEnv(es []string) ([]string, error) {
+	selfFi, err := selfStat()
+	if err != nil {
+		return es, err
+	}
+	em := envmap.NewEnvMap()
+	em.M["PATH"] = &envmap.Path{}
+	err = em.AddSlice(es)
+	if err != nil {
+		return es, err
+	}
+	path := em.M["PATH"].(*envmap.Path)
+	if len(path.S) == 0 {
+		em.Unset["PATH"] = struct{}{}
+	}
+	newpath := make([]string, 0, len(path.S))
+	for _, dir := range path.S {
+		if dir != "" && isSelfExe(dir, SSHEXENAME, selfFi) {
+			continue
+		}
+		newpath = append(newpath, dir)
+	}
+	path.S = newpath
+	em.Unset[RPCDirEnvVarName] = struct{}{}
+	return em.EnvSlice(), nil
+}
+
+// Run the real ssh with the arguments of this process, and its environment
+// without the fake ssh, and return its exit code
+func passThrough(quiet bool) int {
+	sshExe, err := RealSshPath()
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	env, err := RealSshEnv(os.Environ())
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	exitCode, err := execSsh(sshExe, os.Args, env)
+	if err != nil {
+		diagf(quiet, "%s: %s", sshExe, err)
+	}
+	return exitCode
+}
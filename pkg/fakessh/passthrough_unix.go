@@ -0,0 +1,19 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build darwin linux
+
+package fakessh
+
+import (
+	"syscall"
+)
+
+// Replace the current process with the ssh executable at path.
+//
+// Only returns on error.
+func execSsh(path string, args []string, env []string) (int, error) {
+	err := syscall.Exec(path, args, env)
+	return EXIT_FAILURE, err
+}
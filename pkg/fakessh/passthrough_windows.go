@@ -0,0 +1,33 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fakessh
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Run the ssh executable at path with the stdio of the current process and
+// return its exit code.
+func execSsh(path string, args []string, env []string) (int, error) {
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   args,
+		Env:    env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+	err := cmd.Run()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return exitError.ExitCode(), nil
+	}
+	if err != nil {
+		return EXIT_FAILURE, err
+	}
+	return 0, nil
+}
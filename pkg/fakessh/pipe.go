@@ -6,6 +6,8 @@ package fakessh
 
 import (
 	"io"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/leocp1/packer-provisioner-fakessh/pkg/ctxio"
 )
@@ -15,6 +17,16 @@ type pipe struct {
 	Dir string
 }
 
+// Number of pipes made by this process
+var pipeCount uint64
+
+// Get a name for a new pipe that is unique in this process, so commands run
+// concurrently get their own pipes
+func pipeSuffix(name string) string {
+	n := atomic.AddUint64(&pipeCount, 1)
+	return strconv.FormatUint(n, 10) + "-" + name
+}
+
 type deadlineReaderCloser interface {
 	ctxio.DeadlineReader
 	io.Closer
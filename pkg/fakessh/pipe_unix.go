@@ -26,7 +26,7 @@ func makePipe(name string) (pipe, error) {
 	pname := strings.Join([]string{
 		filepath.Join(os.TempDir(), "packer-provisioner-fakessh"),
 		strconv.Itoa(os.Getpid()),
-		name,
+		pipeSuffix(name),
 	}, "-")
 	err := unix.Mkfifo(pname, PIPEPERM)
 	return pipe{Dir: pname}, err
@@ -89,7 +89,7 @@ func makePipe(name string) (pipe, error) {
 	pname := strings.Join([]string{
 		`\\.\pipe\packer-provisioner-fakessh`,
 		strconv.Itoa(os.Getpid()),
-		name,
+		pipeSuffix(name),
 	}, "-")
 	return pipe{Dir: pname}, nil
 }
@@ -0,0 +1,286 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// Version banner printed by ssh -V.
+	// Tools parse the OpenSSH version at the start of the banner.
+	SSHVERSION = "OpenSSH_8.4p1 packer-provisioner-fakessh"
+
+	// Default algorithms of OpenSSH 8.4, printed by ssh -G
+	DEFAULTCIPHERS = "chacha20-poly1305@openssh.com," +
+		"aes128-ctr,aes192-ctr,aes256-ctr," +
+		"aes128-gcm@openssh.com,aes256-gcm@openssh.com"
+	DEFAULTKEYTYPES = "ecdsa-sha2-nistp256-cert-v01@openssh.com," +
+		"ecdsa-sha2-nistp384-cert-v01@openssh.com," +
+		"ecdsa-sha2-nistp521-cert-v01@openssh.com," +
+		"sk-ecdsa-sha2-nistp256-cert-v01@openssh.com," +
+		"ssh-ed25519-cert-v01@openssh.com," +
+		"sk-ssh-ed25519-cert-v01@openssh.com," +
+		"rsa-sha2-512-cert-v01@openssh.com," +
+		"rsa-sha2-256-cert-v01@openssh.com," +
+		"ssh-rsa-cert-v01@openssh.com," +
+		"ecdsa-sha2-nistp256,ecdsa-sha2-nistp384,ecdsa-sha2-nistp521," +
+		"sk-ecdsa-sha2-nistp256@openssh.com," +
+		"ssh-ed25519,sk-ssh-ed25519@openssh.com," +
+		"rsa-sha2-512,rsa-sha2-256,ssh-rsa"
+	DEFAULTKEXALGORITHMS = "curve25519-sha256,curve25519-sha256@libssh.org," +
+		"ecdh-sha2-nistp256,ecdh-sha2-nistp384,ecdh-sha2-nistp521," +
+		"diffie-hellman-group-exchange-sha256," +
+		"diffie-hellman-group16-sha512,diffie-hellman-group18-sha512," +
+		"diffie-hellman-group14-sha256"
+	DEFAULTCASIGNATUREALGORITHMS = "ecdsa-sha2-nistp256," +
+		"ecdsa-sha2-nistp384,ecdsa-sha2-nistp521," +
+		"sk-ecdsa-sha2-nistp256@openssh.com," +
+		"ssh-ed25519,sk-ssh-ed25519@openssh.com," +
+		"rsa-sha2-512,rsa-sha2-256"
+	DEFAULTMACS = "umac-64-etm@openssh.com,umac-128-etm@openssh.com," +
+		"hmac-sha2-256-etm@openssh.com,hmac-sha2-512-etm@openssh.com," +
+		"hmac-sha1-etm@openssh.com," +
+		"umac-64@openssh.com,umac-128@openssh.com," +
+		"hmac-sha2-256,hmac-sha2-512,hmac-sha1"
+)
+
+// Options that OpenSSH accumulates instead of using the first value
+var cumulativeOptions = []string{
+	"CertificateFile",
+	"DynamicForward",
+	"IdentityFile",
+	"LocalForward",
+	"RemoteForward",
+	"SendEnv",
+}
+
+// Options set by flags with an argument, like -i for IdentityFile
+var flagOptions = []struct {
+	Flag byte
+	Key  string
+}{
+	{'b', "BindAddress"},
+	{'c', "Ciphers"},
+	{'D', "DynamicForward"},
+	{'i', "IdentityFile"},
+	{'J', "ProxyJump"},
+	{'L', "LocalForward"},
+	{'m', "MACs"},
+	{'R', "RemoteForward"},
+	{'S', "ControlPath"},
+}
+
+// Options set to "yes" by flags without an argument, like -A for ForwardAgent
+var flagSwitches = []struct {
+	Flag byte
+	Key  string
+}{
+	{'A', "ForwardAgent"},
+	{'C', "Compression"},
+}
+
+// Options printed by ssh -G, in the order of OpenSSH 8.4, with the value
+// printed if an option is not set. Options with an empty default are only
+// printed if set. Defaults of cumulative options are separated by spaces.
+var dumpOptions = []struct {
+	Key     string
+	Default string
+}{
+	{"addressfamily", "any"},
+	{"batchmode", "no"},
+	{"canonicalizefallbacklocal", "yes"},
+	{"canonicalizehostname", "false"},
+	{"challengeresponseauthentication", "yes"},
+	{"checkhostip", "yes"},
+	{"compression", "no"},
+	{"controlmaster", "false"},
+	{"enablesshkeysign", "no"},
+	{"clearallforwardings", "no"},
+	{"exitonforwardfailure", "no"},
+	{"fingerprinthash", "SHA256"},
+	{"forwardx11", "no"},
+	{"forwardx11trusted", "no"},
+	{"gatewayports", "no"},
+	{"gssapiauthentication", "no"},
+	{"gssapidelegatecredentials", "no"},
+	{"hashknownhosts", "no"},
+	{"hostbasedauthentication", "no"},
+	{"identitiesonly", "no"},
+	{"kbdinteractiveauthentication", "yes"},
+	{"nohostauthenticationforlocalhost", "no"},
+	{"passwordauthentication", "yes"},
+	{"permitlocalcommand", "no"},
+	{"proxyusefdpass", "no"},
+	{"pubkeyauthentication", "yes"},
+	{"requesttty", "auto"},
+	{"streamlocalbindunlink", "no"},
+	{"stricthostkeychecking", "ask"},
+	{"tcpkeepalive", "yes"},
+	{"tunnel", "false"},
+	{"verifyhostkeydns", "false"},
+	{"visualhostkey", "no"},
+	{"updatehostkeys", "false"},
+	{"canonicalizemaxdots", "1"},
+	{"connectionattempts", "1"},
+	{"forwardx11timeout", "1200"},
+	{"numberofpasswordprompts", "3"},
+	{"serveralivecountmax", "3"},
+	{"serveraliveinterval", "0"},
+	{"bindaddress", ""},
+	{"bindinterface", ""},
+	{"ciphers", DEFAULTCIPHERS},
+	{"controlpath", ""},
+	{"hostkeyalgorithms", DEFAULTKEYTYPES},
+	{"hostkeyalias", ""},
+	{"hostbasedkeytypes", DEFAULTKEYTYPES},
+	{"identityagent", ""},
+	{"ignoreunknown", ""},
+	{"kbdinteractivedevices", ""},
+	{"kexalgorithms", DEFAULTKEXALGORITHMS},
+	{"casignaturealgorithms", DEFAULTCASIGNATUREALGORITHMS},
+	{"localcommand", ""},
+	{"remotecommand", ""},
+	{"loglevel", "INFO"},
+	{"macs", DEFAULTMACS},
+	{"pkcs11provider", ""},
+	{"securitykeyprovider", "internal"},
+	{"preferredauthentications", ""},
+	{"pubkeyacceptedkeytypes", DEFAULTKEYTYPES},
+	{"revokedhostkeys", ""},
+	{"xauthlocation", "/usr/bin/xauth"},
+	{"dynamicforward", ""},
+	{"localforward", ""},
+	{"remoteforward", ""},
+	{"identityfile", "~/.ssh/id_rsa ~/.ssh/id_dsa ~/.ssh/id_ecdsa " +
+		"~/.ssh/id_ecdsa_sk ~/.ssh/id_ed25519 ~/.ssh/id_ed25519_sk " +
+		"~/.ssh/id_xmss"},
+	{"canonicaldomains", ""},
+	{"certificatefile", ""},
+	{"globalknownhostsfile",
+		"/etc/ssh/ssh_known_hosts /etc/ssh/ssh_known_hosts2"},
+	{"userknownhostsfile", "~/.ssh/known_hosts ~/.ssh/known_hosts2"},
+	{"sendenv", ""},
+	{"setenv", ""},
+	{"forwardagent", "no"},
+	{"connecttimeout", "none"},
+	{"tunneldevice", "any:any"},
+	// sic, like OpenSSH
+	{"canonicalizePermittedcnames", "none"},
+	{"controlpersist", "no"},
+	{"escapechar", "~"},
+	{"ipqos", "af21 cs1"},
+	{"rekeylimit", "0 0"},
+	{"streamlocalbindmask", "0177"},
+	{"proxycommand", ""},
+	{"proxyjump", ""},
+}
+
+// Write the effective configuration of inv like ssh -G.
+//
+// Call ReadConfig first. Like OpenSSH, user, hostname and port come first,
+// followed by every option of dumpOptions with its obtained or default value
+// and the other options obtained, with lowercase keywords. Values of
+// cumulative options like SendEnv are printed on separate lines.
+func (inv *Invocation) DumpConfig(w io.Writer) error {
+	port := inv.Port
+	if port == 0 {
+		port = 22
+	}
+	_, err := fmt.Fprintf(w, "user %s\nhostname %s\nport %d\n",
+		inv.remoteUser(), strings.ToLower(inv.HostName), port)
+	if err != nil {
+		return err
+	}
+
+	opts := inv.effectiveOptions()
+	seen := map[string]bool{"user": true, "hostname": true, "port": true}
+	for _, d := range dumpOptions {
+		key := strings.ToLower(d.Key)
+		seen[key] = true
+		err = dumpOption(w, d.Key, optionValues(opts, key), d.Default)
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range opts {
+		key := strings.ToLower(o.Key)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		err = dumpOption(w, key, optionValues(opts, key), "")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write a line for each of values of option key, or for def if there are
+// none
+func dumpOption(w io.Writer, key string, values []string, def string) error {
+	if len(values) == 0 && def != "" {
+		if isCumulativeOption(key) {
+			values = strings.Fields(def)
+		} else {
+			values = []string{def}
+		}
+	}
+	for _, v := range values {
+		_, err := fmt.Fprintf(w, "%s %s\n", key, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The values of option key in opts: every value of a cumulative option, or
+// the first value obtained otherwise
+func optionValues(opts []Option, key string) []string {
+	values := []string{}
+	for _, o := range opts {
+		if !strings.EqualFold(o.Key, key) {
+			continue
+		}
+		if !isCumulativeOption(key) {
+			return []string{strings.Join(o.Args(), " ")}
+		}
+		values = append(values, o.Args()...)
+	}
+	return values
+}
+
+// Options from flags followed by inv.Options.
+//
+// Like OpenSSH, flags are applied before any ssh_config file is read, so
+// their values are obtained first.
+func (inv *Invocation) effectiveOptions() []Option {
+	opts := []Option{}
+	for _, fo := range flagOptions {
+		for _, arg := range inv.FlagArgs[fo.Flag] {
+			opts = append(opts, Option{Key: fo.Key, Value: arg})
+		}
+	}
+	for _, fs := range flagSwitches {
+		if inv.Flag(fs.Flag) {
+			opts = append(opts, Option{Key: fs.Key, Value: "yes"})
+		}
+	}
+	return append(opts, inv.Options...)
+}
+
+// Check if OpenSSH accumulates the values of the option key
+func isCumulativeOption(key string) bool {
+	for _, c := range cumulativeOptions {
+		if strings.EqualFold(key, c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Time between updates of the progress meter on a terminal
+	PROGRESSINTERVAL = 200 * time.Millisecond
+	// Width of the file names shown by the progress meter
+	PROGRESSNAMEWIDTH = 32
+)
+
+// Shows the progress of copies like the progress meter of scp.
+//
+// On a terminal, the line of a copy is redrawn while it runs. Otherwise a
+// line is written when it ends.
+type progressMeter struct {
+	w   io.Writer
+	tty bool
+}
+
+// Run copy of the file or directory name of size bytes and show its
+// progress. copied returns the bytes copied so far, or is nil if the copy
+// can not be followed.
+func (m *progressMeter) show(
+	name string,
+	size int64,
+	copied func() int64,
+	copy func() error,
+) error {
+	start := time.Now()
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	drawn := false
+	if m.tty && copied != nil {
+		go func() {
+			defer close(stopped)
+			tick := time.NewTicker(PROGRESSINTERVAL)
+			defer tick.Stop()
+			for {
+				select {
+				case <-tick.C:
+					m.draw(name, copied(), size, time.Since(start))
+					drawn = true
+				case <-stop:
+					return
+				}
+			}
+		}()
+	} else {
+		close(stopped)
+	}
+
+	err := copy()
+	close(stop)
+	<-stopped
+	if err == nil {
+		m.draw(name, size, size, time.Since(start))
+	}
+	// A failed copy leaves its last line
+	if err == nil || drawn {
+		fmt.Fprintln(m.w)
+	}
+	return err
+}
+
+// Draw the line of a copy of size bytes with n bytes copied after elapsed
+func (m *progressMeter) draw(
+	name string,
+	n int64,
+	size int64,
+	elapsed time.Duration,
+) {
+	percent := int64(100)
+	if size > 0 && n < size {
+		percent = n * 100 / size
+	}
+	rate := int64(0)
+	if secs := elapsed.Seconds(); secs > 0 {
+		rate = int64(float64(n) / secs)
+	}
+	if len(name) > PROGRESSNAMEWIDTH {
+		name = name[:PROGRESSNAMEWIDTH]
+	}
+	secs := int64(elapsed.Seconds())
+	line := fmt.Sprintf("%-*s %3d%% %8s %8s/s %02d:%02d",
+		PROGRESSNAMEWIDTH, name, percent,
+		formatBytes(n), formatBytes(rate), secs/60, secs%60)
+	if m.tty {
+		line = "\r" + line
+	}
+	fmt.Fprint(m.w, line)
+}
+
+// Format a byte count with a binary unit, like 1.5MB
+func formatBytes(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f := float64(n) / 1024
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%cB", f, units[i])
+}
+
+// Return a random ID for RpcTransfer.ID
+func newTransferID() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(random), nil
+}
+
+// Return the total size of the regular files in the local directory p
+func localSize(p string) int64 {
+	size := int64(0)
+	filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,200 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// Command running {{.Command}} under a pseudo-terminal, run by the
+	// Communicator for ssh -t.
+	// Use the script of util-linux, and fall back to the BSD one.
+	DEFAULTPTYCOMMAND = `if script -qec true /dev/null >/dev/null 2>&1; then ` +
+		`exec script -qfec {{.Command}} /dev/null; ` +
+		`else exec script -q /dev/null sh -c {{.Command}}; fi`
+	// Directory of the files recording the pseudo-terminal of a command on
+	// the guest
+	PTYFILEDIR = "/tmp"
+	// Terminal type used if TERM is not set
+	DEFAULTTERM = "dumb"
+	// Window size used if stdin is not a terminal
+	DEFAULTROWS = 24
+	DEFAULTCOLS = 80
+)
+
+// A pseudo-terminal requested for a command
+type PtyRequest struct {
+	// The terminal type, set as TERM
+	Term string
+	// The initial window size
+	Rows int
+	Cols int
+	// A file on the guest recording the path of the pseudo-terminal, so its
+	// window size can be changed later
+	TtyFile string
+}
+
+// Check if a pseudo-terminal is requested, from -t, -T or the RequestTTY
+// option.
+//
+// Like OpenSSH, a single -t or RequestTTY yes only requests one if stdin is
+// a terminal, and warn is set otherwise. By default, one is requested for a
+// login shell if stdin is a terminal.
+func (inv *Invocation) RequestTTY(stdinIsTerminal bool) (tty bool, warn string) {
+	mode := "auto"
+	switch {
+	case inv.Flag('T'):
+		mode = "no"
+	case inv.Flags['t'] > 1:
+		mode = "force"
+	case inv.Flags['t'] == 1:
+		mode = "yes"
+	default:
+		if v, ok := inv.Option("RequestTTY"); ok {
+			mode = strings.ToLower(v)
+		}
+	}
+	if inv.Flag('N') || inv.StdioForward != nil {
+		return false, ""
+	}
+	switch mode {
+	case "force":
+		return true, ""
+	case "yes", "true":
+		if !stdinIsTerminal {
+			return false, "Pseudo-terminal will not be allocated because " +
+				"stdin is not a terminal."
+		}
+		return true, ""
+	case "auto":
+		return len(inv.Command) == 0 && stdinIsTerminal, ""
+	}
+	return false, ""
+}
+
+// Wrap command to run it under the pseudo-terminal of c.Pty.
+//
+// The command records the path of the pseudo-terminal in c.Pty.TtyFile,
+// sets its window size and exports TERM before it starts.
+func (ssh *RpcSsh) ptyCommand(command string, c *RpcCmd) (string, error) {
+	tpl := ssh.Config.PtyCommand
+	if tpl == "" {
+		tpl = DEFAULTPTYCOMMAND
+	}
+	inner := fmt.Sprintf(
+		"tty > %s; stty rows %d cols %d 2>/dev/null; "+
+			"TERM=%s; export TERM; exec sh -c %s",
+		ShellQuote(c.Pty.TtyFile),
+		c.Pty.Rows,
+		c.Pty.Cols,
+		ShellQuote(c.Pty.Term),
+		ShellQuote(command),
+	)
+	return RenderCommand(tpl, &CommandTemplate{
+		Command: ShellQuote(inner),
+		User:    ShellQuote(c.User),
+		Host:    ShellQuote(c.Host),
+		WorkDir: ShellQuote(c.WorkDir),
+	})
+}
+
+// A pseudo-terminal session of the fake ssh
+type ptySession struct {
+	dir string
+	cmd Cmd
+	req *PtyRequest
+	// State of the local terminal to restore, if it was made raw
+	state  *terminal.State
+	cancel context.CancelFunc
+}
+
+// Request a pseudo-terminal for cmd, put the local terminal in raw mode and
+// follow its window size, through the fake ssh server with working
+// directory dir.
+func startPty(ctx context.Context, dir string, cmd *Cmd) (*ptySession, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = DEFAULTTERM
+	}
+	p := &ptySession{
+		dir: dir,
+		cmd: Cmd{User: cmd.User, Host: cmd.Host, WorkDir: cmd.WorkDir},
+		req: &PtyRequest{
+			Term: term,
+			Rows: DEFAULTROWS,
+			Cols: DEFAULTCOLS,
+			TtyFile: path.Join(
+				PTYFILEDIR, "ssh-fakessh-"+hex.EncodeToString(random)+".tty"),
+		},
+	}
+
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		if cols, rows, err := terminal.GetSize(fd); err == nil {
+			p.req.Rows = rows
+			p.req.Cols = cols
+		}
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return nil, err
+		}
+		p.state = state
+
+		wctx, cancel := context.WithCancel(ctx)
+		p.cancel = cancel
+		go watchWindowSize(wctx, func() {
+			cols, rows, err := terminal.GetSize(fd)
+			if err == nil {
+				p.resize(wctx, rows, cols)
+			}
+		})
+	}
+	cmd.Pty = p.req
+	return p, nil
+}
+
+// Set the window size of the pseudo-terminal on the guest
+func (p *ptySession) resize(ctx context.Context, rows int, cols int) {
+	p.run(ctx, fmt.Sprintf(
+		`stty rows %d cols %d < "$(cat %s)" 2>/dev/null`,
+		rows, cols, ShellQuote(p.req.TtyFile),
+	))
+}
+
+// Run command as the user of the session on the guest, ignoring its output
+func (p *ptySession) run(ctx context.Context, command string) {
+	cmd := p.cmd
+	cmd.Command = command
+	cmd.NoStdin = true
+	cmd.Stdout = noCloseFile{os.Stderr}
+	cmd.Stderr = noCloseFile{os.Stderr}
+	RunCmd(ctx, p.dir, &cmd)
+}
+
+// Restore the local terminal and remove the file recording the
+// pseudo-terminal
+func (p *ptySession) Close() error {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if p.state != nil {
+		terminal.Restore(int(os.Stdin.Fd()), p.state)
+	}
+	p.run(context.Background(), "rm -f "+ShellQuote(p.req.TtyFile))
+	return nil
+}
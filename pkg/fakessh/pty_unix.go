@@ -0,0 +1,30 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build darwin linux
+
+package fakessh
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Call resize each time the window size of the terminal changes, until ctx
+// is cancelled
+func watchWindowSize(ctx context.Context, resize func()) {
+	sigwinch := make(chan os.Signal, 1)
+	signal.Notify(sigwinch, syscall.SIGWINCH)
+	defer signal.Stop(sigwinch)
+	for {
+		select {
+		case <-sigwinch:
+			resize()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package fakessh
+
+import "context"
+
+// Windows consoles do not signal window size changes, so the size is never
+// updated
+func watchWindowSize(ctx context.Context, resize func()) {
+	<-ctx.Done()
+}
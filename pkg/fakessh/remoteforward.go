@@ -0,0 +1,139 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+)
+
+// Listeners of the remote forwards of a fake ssh command
+type remoteForwarder struct {
+	// Connections of the running listen commands
+	muxes []*frameMux
+	// Listen commands that are still running
+	running sync.WaitGroup
+	l       sync.Mutex
+	closed  bool
+}
+
+// Listen on the guest for the remote forwards of inv and relay every
+// accepted connection to its local target through the fake ssh server with
+// working directory dir.
+//
+// The guest runs one listen command for each forward, which keeps
+// listening and multiplexes its connections over stdin and stdout. Like
+// OpenSSH, this returns once the guest listens, so a command run next can
+// connect to the forwards. A forward that can not listen is reported and
+// skipped, unless ExitOnForwardFailure is set.
+func startRemoteForwards(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	quiet bool,
+) (*remoteForwarder, error) {
+	exitOnFailure := false
+	if v, ok := inv.Option("ExitOnForwardFailure"); ok {
+		exitOnFailure = v == "yes"
+	}
+
+	f := &remoteForwarder{}
+	listening := make([]chan bool, len(inv.RemoteForwards))
+	for i, fwd := range inv.RemoteForwards {
+		listening[i] = make(chan bool, 1)
+		f.running.Add(1)
+		go f.serve(ctx, dir, inv, fwd, listening[i])
+	}
+	for i, fwd := range inv.RemoteForwards {
+		select {
+		case ok := <-listening[i]:
+			if ok {
+				continue
+			}
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+		msg := fmt.Sprintf(
+			"remote port forwarding failed for listen port %d", fwd.BindPort)
+		if exitOnFailure {
+			f.Close()
+			return nil, fmt.Errorf("Error: %s", msg)
+		}
+		diagf(quiet, "Warning: %s", msg)
+	}
+	return f, nil
+}
+
+// Run the listen command of fwd until it exits, and send on listening if it
+// listened
+func (f *remoteForwarder) serve(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	fwd RemoteForward,
+	listening chan<- bool,
+) {
+	defer f.running.Done()
+	listen := fwd.ListenAddress()
+	stdin, w := net.Pipe()
+	r, stdout := net.Pipe()
+	m := newFrameMux(w, func() (net.Conn, error) {
+		return net.Dial("tcp", fwd.Target.String())
+	})
+	defer m.Close()
+
+	f.l.Lock()
+	if f.closed {
+		f.l.Unlock()
+		listening <- false
+		return
+	}
+	f.muxes = append(f.muxes, m)
+	f.l.Unlock()
+
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-m.ready:
+			listening <- true
+		case <-exited:
+			select {
+			case <-m.ready:
+				listening <- true
+			default:
+				listening <- false
+			}
+		}
+	}()
+	defer close(exited)
+
+	go m.demux(r)
+	RunCmd(ctx, dir, &Cmd{
+		User:   inv.User,
+		Host:   inv.HostName,
+		Listen: &listen,
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: noCloseFile{os.Stderr},
+	})
+	r.Close()
+}
+
+// Stop the listeners and wait until the forwarded connections are closed
+func (f *remoteForwarder) Close() error {
+	f.l.Lock()
+	f.closed = true
+	muxes := f.muxes
+	f.l.Unlock()
+	for _, m := range muxes {
+		m.stop()
+	}
+	f.running.Wait()
+	return nil
+}
@@ -0,0 +1,57 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"github.com/hashicorp/packer/packer"
+)
+
+// A Communicator commands for some ssh destinations are sent to
+type Route struct {
+	// Patterns of destination hosts sent to Comm
+	Hosts []string
+	// If nil, use the Communicator of the server
+	Comm packer.Communicator
+	// The user Comm runs commands as.
+	// Commands for this user are not wrapped with SwitchUserCommand.
+	CommUser string
+}
+
+// Pick the Communicator for the destination host and the user it runs
+// commands as.
+//
+// The first route with a pattern matching host is used. If no route matches,
+// use the Communicator of the server.
+func (ssh *RpcSsh) route(host string) (packer.Communicator, string) {
+	for _, r := range ssh.Config.Routes {
+		if !MatchAnyPattern(host, r.Hosts) {
+			continue
+		}
+		if r.Comm == nil {
+			return ssh.Comm, r.CommUser
+		}
+		return r.Comm, r.CommUser
+	}
+	return ssh.Comm, ssh.Config.CommUser
+}
+
+// Check if commands for the destination host are handled by the server.
+//
+// If the server has no MatchHosts, every host is handled. Otherwise, host
+// must match MatchHosts or the hosts of a route.
+func (ssh *RpcSsh) handles(host string) bool {
+	if len(ssh.Config.MatchHosts) == 0 {
+		return true
+	}
+	if MatchAnyPattern(host, ssh.Config.MatchHosts) {
+		return true
+	}
+	for _, r := range ssh.Config.Routes {
+		if MatchAnyPattern(host, r.Hosts) {
+			return true
+		}
+	}
+	return false
+}
@@ -8,13 +8,22 @@ import (
 	"context"
 	"errors"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/packer/packer"
 
 	"github.com/leocp1/packer-provisioner-fakessh/pkg/ctxio"
 )
 
+const (
+	// Command run when no remote command is given.
+	// Like sshd, start the login shell, which reads commands from stdin.
+	LOGINSHELLCMD = `exec "${SHELL:-/bin/sh}" -l`
+)
+
 // RPC command pipe handles
+//
+// Stdin is nil if the command does not read stdin.
 type RpcState struct {
 	Stdin  deadlineReaderCloser
 	Stdout deadlineWriterCloser
@@ -25,24 +34,76 @@ type RpcState struct {
 //
 // If Comm is nil, do nothing
 type RpcSsh struct {
-	M    map[RpcCmd]RpcState
-	Comm packer.Communicator
-	L sync.RWMutex
+	// Pipes of commands, keyed by RpcCmd.StdoutPipe
+	M map[string]RpcState
+	// Expiry of the ControlMaster sessions, keyed by ControlPath.
+	// A zero time never expires.
+	Masters map[string]time.Time
+	Comm    packer.Communicator
+	Config  ServerConfig
+	// Compression codecs supported by the guests, keyed by Communicator.
+	// "" if a guest can not compress.
+	Codecs map[packer.Communicator]string
+	// Bytes copied by running Upload and Download calls, keyed by
+	// RpcTransfer.ID
+	Transfers map[string]*int64
+	// Closed when the server shuts down, cancelling running commands
+	Done chan struct{}
+	L    sync.RWMutex
 }
 
 // RPC argument
 type RpcCmd struct {
-	Cmd        string
-	StdinPipe  string
-	StdoutPipe string
-	StderrPipe string
+	// Command to run. If empty, run LOGINSHELLCMD.
+	Cmd string
+	// Do not open StdinPipe, run Cmd with empty stdin
+	NoStdin bool
+	// Do not run anything, wait until the call is cancelled
+	NoCommand bool
+	// Environment variables to set, like the output of `os.Environ()`
+	Env []string
+	// User of the ssh destination
+	User string
+	// Host of the ssh destination
+	Host string
+	// Working directory of the fake ssh command
+	WorkDir string
+	// If not nil, relay stdin and stdout to this TCP port instead of running
+	// Cmd
+	StdioForward *HostPort
+	// If not nil, relay stdin and stdout to the first connection accepted
+	// on this address instead of running Cmd
+	Listen *HostPort
+	// If not empty, relay stdin and stdout to the first connection accepted
+	// on this unix socket instead of running Cmd
+	ListenAgent string
+	// If not empty, SSH_AUTH_SOCK is set to this path for Cmd
+	AgentSocket string
+	// If not nil, run Cmd under a pseudo-terminal
+	Pty *PtyRequest
+	// "yes" or "no" to compress the streams of Cmd or not, or "" for the
+	// default of the server
+	Compression string
+	StdinPipe   string
+	StdoutPipe  string
+	StderrPipe  string
+}
+
+// Check if commands for the destination host are handled by the server
+func (ssh *RpcSsh) Handles(ctx context.Context, host string, handled *bool) error {
+	*handled = ssh.handles(host)
+	return nil
 }
 
 // Open pipes in preparation for command
 func (ssh *RpcSsh) OpenPipes(ctx context.Context, c *RpcCmd, exitCode *int) error {
-	inpipe, err := openReadPipe(ctx, c.StdinPipe)
-	if err != nil {
-		return err
+	var inpipe deadlineReaderCloser = nil
+	var err error = nil
+	if !c.NoStdin {
+		inpipe, err = openReadPipe(ctx, c.StdinPipe)
+		if err != nil {
+			return err
+		}
 	}
 	outpipe, err := openWritePipe(ctx, c.StdoutPipe)
 	if err != nil {
@@ -54,7 +115,7 @@ func (ssh *RpcSsh) OpenPipes(ctx context.Context, c *RpcCmd, exitCode *int) erro
 	}
 	ssh.L.Lock()
 	defer ssh.L.Unlock()
-	ssh.M[*c] = RpcState{
+	ssh.M[c.StdoutPipe] = RpcState{
 		Stdin:  inpipe,
 		Stdout: outpipe,
 		Stderr: errpipe,
@@ -63,11 +124,36 @@ func (ssh *RpcSsh) OpenPipes(ctx context.Context, c *RpcCmd, exitCode *int) erro
 }
 
 // Run command c on communicator and return exitcode
+//
+// The communicator is picked from the routes of the server by c.Host.
+// If c.StdioForward, c.Listen or c.ListenAgent is set, run the relay or
+// listen command instead of c.Cmd. Legacy scp -t and scp -f commands are
+// served by the server itself, unless they are switched to another user.
+// Accepted variables in c.Env are exported before running the command, and
+// the command is run as c.User if the server is configured to switch users.
+// If c.NoCommand is set, block until ctx is cancelled instead. The command is
+// cancelled when the server shuts down.
 func (ssh *RpcSsh) Run(ctx context.Context, c *RpcCmd, exitCode *int) error {
 	var err error = nil
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-ssh.Done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if c.NoCommand {
+		<-ctx.Done()
+		*exitCode = EXIT_FAILURE
+		return ctx.Err()
+	}
+
 	ssh.L.RLock()
-	pipes, ok := ssh.M[*c]
+	pipes, ok := ssh.M[c.StdoutPipe]
 	ssh.L.RUnlock()
 
 	if !ok {
@@ -76,20 +162,62 @@ func (ssh *RpcSsh) Run(ctx context.Context, c *RpcCmd, exitCode *int) error {
 	defer func() {
 		ssh.L.Lock()
 		defer ssh.L.Unlock()
-		delete(ssh.M, *c)
+		delete(ssh.M, c.StdoutPipe)
 	}()
 
+	if pipes.Stdin != nil {
+		defer pipes.Stdin.Close()
+	}
+	defer pipes.Stdout.Close()
+	defer pipes.Stderr.Close()
+
+	comm, commUser := ssh.route(c.Host)
+	if c.StdioForward == nil && c.Listen == nil && c.ListenAgent == "" {
+		// The server copies files as the Communicator user, so scp is run
+		// on the guest for other users
+		if s := parseScpRemote(c.Cmd); s != nil {
+			err = ssh.permitUser(c, commUser)
+			if err != nil {
+				return err
+			}
+			if !ssh.switchesUser(c, commUser) {
+				*exitCode = serveScp(ctx, comm, s, pipes)
+				return nil
+			}
+		}
+	}
+	var command string
+	codec := ""
+	if c.StdioForward != nil {
+		command, err = ssh.relayCommand(c.StdioForward)
+	} else if c.Listen != nil {
+		command, err = ssh.listenCommand(c.Listen)
+	} else if c.ListenAgent != "" {
+		command, err = ssh.agentListenCommand(c, commUser)
+	} else {
+		command, err = ssh.remoteCommand(c, commUser)
+		if err == nil && ssh.compresses(c) {
+			codec = ssh.compressionCodec(ctx, comm)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if codec != "" {
+		*exitCode, err = runCompressed(ctx, comm, command, codec, pipes)
+		return err
+	}
+
 	cmd := &packer.RemoteCmd{
-		Command: c.Cmd,
-		Stdin:   ctxio.ReaderAdapter(ctx, pipes.Stdin),
+		Command: command,
 		Stdout:  ctxio.WriterAdapter(ctx, pipes.Stdout),
 		Stderr:  ctxio.WriterAdapter(ctx, pipes.Stderr),
 	}
-	defer pipes.Stdin.Close()
-	defer pipes.Stdout.Close()
-	defer pipes.Stderr.Close()
+	if pipes.Stdin != nil {
+		cmd.Stdin = ctxio.ReaderAdapter(ctx, pipes.Stdin)
+	}
 
-	err = ssh.Comm.Start(ctx, cmd)
+	err = comm.Start(ctx, cmd)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,324 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Exit code of rsync for a partial transfer
+	RSYNC_EXIT_PARTIAL = 23
+	// Exit code of rsync when source files vanished
+	RSYNC_EXIT_VANISHED = 24
+	// Exit code of rsync when a requested action is not supported
+	RSYNC_EXIT_UNSUPPORTED = 4
+)
+
+// Options of rsync --server naming files of the guest, which take the next
+// argument as their value
+var rsyncGuestOptions = map[string]bool{
+	"--backup-dir":   true,
+	"--compare-dest": true,
+	"--copy-dest":    true,
+	"--files-from":   true,
+	"--link-dest":    true,
+	"--partial-dir":  true,
+	"--temp-dir":     true,
+}
+
+// Options of the receiver that compare with the files of the destination
+var rsyncReceiverOptions = map[string]bool{
+	"--existing":        true,
+	"--ignore-existing": true,
+	"--max-delete":      true,
+}
+
+// An rsync command in server mode, which the rsync client runs on the guest
+// through ssh and speaks the rsync protocol to on stdin and stdout
+type RsyncServer struct {
+	// Send files (rsync --server --sender) instead of receiving them
+	Sender bool
+	// Letters of the short options
+	Flags string
+	// The options between --server and the dot before the paths, in order
+	Options []string
+	// The destination of the receiver, or the sources of the sender
+	Paths []string
+}
+
+// Check if the short option f is set
+func (r *RsyncServer) Flag(f byte) bool {
+	return strings.IndexByte(r.Flags, f) >= 0
+}
+
+// Parse command as rsync --server, or return nil if it is another command
+// or needs a shell
+func ParseRsyncServer(command string) *RsyncServer {
+	words, ok := ShellSplit(command)
+	if !ok || len(words) < 3 || path.Base(words[0]) != "rsync" ||
+		words[1] != "--server" {
+		return nil
+	}
+	r := &RsyncServer{}
+	i := 2
+	for ; i < len(words) && words[i] != "."; i++ {
+		arg := words[i]
+		r.Options = append(r.Options, arg)
+		switch {
+		case arg == "--sender":
+			r.Sender = true
+		case rsyncGuestOptions[arg]:
+			if i+1 < len(words) {
+				i++
+				r.Options = append(r.Options, words[i])
+			}
+		case strings.HasPrefix(arg, "--"):
+		case strings.HasPrefix(arg, "-"):
+			// The letters after e are protocol flags rather than options
+			flags := arg[1:]
+			if k := strings.IndexByte(flags, 'e'); k >= 0 {
+				flags = flags[:k]
+			}
+			r.Flags += flags
+		default:
+			return nil
+		}
+	}
+	if i >= len(words) {
+		return nil
+	}
+	r.Paths = words[i+1:]
+	if len(r.Paths) == 0 || !r.Sender && len(r.Paths) != 1 {
+		return nil
+	}
+	return r
+}
+
+// Return an option of r that can not be emulated without rsync on the guest,
+// or the empty string
+func (r *RsyncServer) Unsupported() string {
+	for _, opt := range r.Options {
+		name := opt
+		if k := strings.IndexByte(opt, '='); k >= 0 {
+			name = opt[:k]
+		}
+		switch {
+		case strings.HasPrefix(name, "--delete") || rsyncGuestOptions[name]:
+			return name
+		case !r.Sender && rsyncReceiverOptions[name]:
+			return name
+		case r.Sender && name == "--remove-source-files":
+			return name
+		}
+	}
+	// Updates and backups compare with the files of the destination, and
+	// relative names would include the local copy of the sources
+	unsupported := "bu"
+	if r.Sender {
+		unsupported = "R"
+	}
+	for _, f := range []byte(unsupported) {
+		if r.Flag(f) {
+			return "-" + string(f)
+		}
+	}
+	return ""
+}
+
+// Check if rsync is found on the guest for cmd
+func guestHasRsync(ctx context.Context, dir string, cmd *Cmd) (bool, error) {
+	_, err := guestOutput(ctx, dir, Cmd{
+		Command: "command -v rsync",
+		User:    cmd.User,
+		Host:    cmd.Host,
+		WorkDir: cmd.WorkDir,
+	})
+	if _, ok := err.(*guestError); ok {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Run the rsync server r with the local rsync, in a local copy of the files
+// of the guest moved with the Communicator of cmd.Host.
+//
+// Like the fake scp, the files are copied as the Communicator user, so
+// destination users that commands are switched to are refused.
+func emulateRsyncServer(
+	ctx context.Context,
+	dir string,
+	cmd *Cmd,
+	r *RsyncServer,
+	quiet bool,
+) int {
+	if opt := r.Unsupported(); opt != "" {
+		diagf(quiet, "rsync not found on the guest, and %s can not be "+
+			"emulated without it", opt)
+		return RSYNC_EXIT_UNSUPPORTED
+	}
+	rsyncExe, err := exec.LookPath("rsync")
+	if err != nil {
+		diagf(quiet, "rsync not found on the guest, and %s", err)
+		return EXIT_FAILURE
+	}
+	err = PermitTransfer(ctx, dir, &RpcTransfer{
+		Host: cmd.Host,
+		User: cmd.User,
+	})
+	if err != nil {
+		diagf(quiet, "rsync not found on the guest, and %s", err)
+		return EXIT_FAILURE
+	}
+	tmp, err := ioutil.TempDir("", "fakessh-rsync")
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	defer os.RemoveAll(tmp)
+
+	e := &rsyncEmulation{
+		scpCopier: scpCopier{
+			ctx:       ctx,
+			dir:       dir,
+			recursive: true,
+			preserve:  r.Flag('t') || r.Flag('p'),
+		},
+		host:     cmd.Host,
+		user:     cmd.User,
+		server:   r,
+		rsyncExe: rsyncExe,
+		tmp:      tmp,
+		quiet:    quiet,
+	}
+	if r.Sender {
+		return e.send()
+	}
+	return e.receive()
+}
+
+// A run of the rsync server with the local rsync
+type rsyncEmulation struct {
+	scpCopier
+	host     string
+	user     string
+	server   *RsyncServer
+	rsyncExe string
+	// Local directory with the copies of the guest files
+	tmp   string
+	quiet bool
+}
+
+// Receive files into the local directory and upload them to the guest
+// destination
+func (e *rsyncEmulation) receive() int {
+	dest, err := e.guestPath(e.host, e.server.Paths[0])
+	if err != nil {
+		diagf(e.quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	guestDest := scpEnd{Host: e.host, User: e.user, Path: dest}
+	destIsDir, _ := e.isDir(guestDest)
+
+	// Like on the guest, an existing directory receives the files, and a
+	// new destination is created as a file or a directory
+	local := e.tmp
+	if !destIsDir {
+		local = filepath.Join(e.tmp, "dest")
+		if strings.HasSuffix(e.server.Paths[0], "/") {
+			local += string(filepath.Separator)
+		}
+	}
+	exitCode := e.run(local)
+	if exitCode != 0 && exitCode != RSYNC_EXIT_PARTIAL &&
+		exitCode != RSYNC_EXIT_VANISHED || e.server.Flag('n') {
+		return exitCode
+	}
+
+	if !destIsDir {
+		local = filepath.Join(e.tmp, "dest")
+		if _, err := os.Lstat(local); os.IsNotExist(err) {
+			return exitCode
+		}
+		err = e.upload(local, guestDest)
+	} else {
+		var entries []os.FileInfo
+		entries, err = ioutil.ReadDir(e.tmp)
+		for _, entry := range entries {
+			err = e.upload(filepath.Join(e.tmp, entry.Name()), guestDest)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		diagf(e.quiet, "%s", err)
+		return RSYNC_EXIT_PARTIAL
+	}
+	return exitCode
+}
+
+// Download the guest sources into the local directory and send them
+func (e *rsyncEmulation) send() int {
+	paths := []string{}
+	for i, p := range e.server.Paths {
+		src, err := e.guestPath(e.host, p)
+		if err != nil {
+			diagf(e.quiet, "%s", err)
+			return EXIT_FAILURE
+		}
+		local := filepath.Join(e.tmp, strconv.Itoa(i))
+		err = os.Mkdir(local, 0700)
+		if err != nil {
+			diagf(e.quiet, "%s", err)
+			return EXIT_FAILURE
+		}
+		// A missing source is still passed on to be reported by rsync
+		guestSrc := scpEnd{Host: e.host, User: e.user, Path: src}
+		err = e.download(guestSrc, local)
+		if err != nil && e.ctx.Err() == nil {
+			diagf(e.quiet, "%s", err)
+		}
+
+		// Like a trailing slash, a dot sends the contents of a directory
+		local = filepath.Join(local, path.Base(src))
+		if strings.HasSuffix(p, "/") || path.Base(p) == "." {
+			local += string(filepath.Separator)
+		}
+		paths = append(paths, local)
+	}
+	if e.ctx.Err() != nil {
+		return EXIT_FAILURE
+	}
+	return e.run(paths...)
+}
+
+// Run the local rsync server on paths with the stdio of this process and
+// return its exit code
+func (e *rsyncEmulation) run(paths ...string) int {
+	args := append([]string{"--server"}, e.server.Options...)
+	args = append(append(args, "."), paths...)
+	cmd := exec.CommandContext(e.ctx, e.rsyncExe, args...)
+	cmd.Dir = e.tmp
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return exitError.ExitCode()
+	}
+	if err != nil {
+		diagf(e.quiet, "%s: %s", e.rsyncExe, err)
+		return EXIT_FAILURE
+	}
+	return 0
+}
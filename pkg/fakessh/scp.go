@@ -0,0 +1,891 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The OpenSSH scp getopt string.
+	// A character followed by a colon takes an argument.
+	SCPOPTSTRING = "346ABCOTc:F:i:J:l:o:pP:qRrS:sv"
+
+	// Usage message of scp
+	SCPUSAGE = "usage: scp [-346ABCOpqRrsTv] [-c cipher] [-F ssh_config] " +
+		"[-i identity_file]\n" +
+		"           [-J destination] [-l limit] [-o ssh_option] " +
+		"[-P port]\n" +
+		"           [-S program] source ... target"
+
+	// Exit code of scp on failure
+	SCP_EXIT_FAILURE = 1
+
+	// Format of stat -c describing a guest file for scp: the raw mode in
+	// hex, the size, the access time and the modification time
+	SCPSTATFORMAT = "%f %s %X %Y"
+)
+
+// A parsed scp command line
+type ScpInvocation struct {
+	// Number of times each flag without an argument was passed
+	Flags map[byte]int
+	// Arguments of each flag that takes one, in command line order
+	FlagArgs map[byte][]string
+	// The sources followed by the target
+	Operands []ScpPath
+}
+
+// A file operand of scp
+type ScpPath struct {
+	// The operand as written on the command line
+	Arg string
+	// Destination of a remote file, [user@]host or ssh://[user@]host[:port],
+	// as passed to ssh. Empty for a local file.
+	Destination string
+	// Path of the file. Relative remote paths start from the home directory.
+	Path string
+}
+
+// Check if p is a file of an ssh destination
+func (p ScpPath) Remote() bool {
+	return p.Destination != ""
+}
+
+// Check if flag f was passed
+func (sinv *ScpInvocation) Flag(f byte) bool {
+	return sinv.Flags[f] > 0
+}
+
+// Get the last argument passed to flag f
+func (sinv *ScpInvocation) FlagArg(f byte) (string, bool) {
+	args := sinv.FlagArgs[f]
+	if len(args) == 0 {
+		return "", false
+	}
+	return args[len(args)-1], true
+}
+
+// Parse the arguments of scp (including argv[0]) the way OpenSSH does.
+//
+// Options are parsed with BSD getopt semantics until the first operand or
+// "--". Operands of the form [user@]host:[path] or
+// scp://[user@]host[:port][/path] are remote, and others are local.
+func ParseScpArgs(args []string) (*ScpInvocation, error) {
+	sinv := &ScpInvocation{
+		Flags:    make(map[byte]int),
+		FlagArgs: make(map[byte][]string),
+		Operands: []ScpPath{},
+	}
+
+	flags, n, _, err := getopt(args[1:], optTakesArg(SCPOPTSTRING))
+	for _, f := range flags {
+		if !f.HasArg {
+			sinv.Flags[f.Flag]++
+			continue
+		}
+		if f.Flag == 'P' {
+			if _, err := parsePort(f.Arg); err != nil {
+				return sinv, err
+			}
+		}
+		sinv.FlagArgs[f.Flag] = append(sinv.FlagArgs[f.Flag], f.Arg)
+	}
+	if err != nil {
+		return sinv, err
+	}
+
+	for _, arg := range args[1+n:] {
+		p, err := ParseScpPath(arg)
+		if err != nil {
+			return sinv, err
+		}
+		sinv.Operands = append(sinv.Operands, p)
+	}
+	return sinv, nil
+}
+
+// Parse an operand of scp
+func ParseScpPath(arg string) (ScpPath, error) {
+	p := ScpPath{Arg: arg, Path: arg}
+	if strings.HasPrefix(strings.ToLower(arg), "scp://") {
+		rest := arg[len("scp://"):]
+		p.Path = ""
+		if k := strings.IndexByte(rest, '/'); k >= 0 {
+			path, err := url.PathUnescape(rest[k+1:])
+			if err != nil {
+				return p, &UsageError{Msg: fmt.Sprintf("invalid URI %q", arg)}
+			}
+			p.Path = path
+			rest = rest[:k]
+		}
+		p.Destination = "ssh://" + rest
+		return p, (&Invocation{}).setDestination(p.Destination)
+	}
+
+	k := scpColon(arg)
+	if k < 0 {
+		return p, nil
+	}
+	dest := arg[:k]
+	if strings.HasSuffix(dest, "]") {
+		dest = strings.Replace(dest[:len(dest)-1], "[", "", 1)
+	}
+	p.Destination = dest
+	p.Path = arg[k+1:]
+	return p, (&Invocation{}).setDestination(dest)
+}
+
+// Find the colon ending the host of a remote scp operand, or return -1 for
+// a local file.
+//
+// Like OpenSSH, a host may be an IPv6 address in brackets, and a slash
+// before the colon makes the operand local.
+func scpColon(s string) int {
+	if strings.HasPrefix(s, ":") {
+		return -1
+	}
+	bracket := strings.HasPrefix(s, "[")
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '@' && i+1 < len(s) && s[i+1] == '[':
+			bracket = true
+		case s[i] == ']' && i+1 < len(s) && s[i+1] == ':' && bracket:
+			return i + 1
+		case s[i] == ':' && !bracket:
+			return i
+		case s[i] == '/':
+			return -1
+		}
+	}
+	return -1
+}
+
+// Resolve the destination of the remote operand p like the fake ssh, with
+// the ssh options passed to scp
+func (sinv *ScpInvocation) sshInvocation(p ScpPath) (*Invocation, error) {
+	args := []string{SSHEXENAME}
+	for _, f := range []byte("46ACqv") {
+		for i := 0; i < sinv.Flags[f]; i++ {
+			args = append(args, "-"+string(f))
+		}
+	}
+	for _, f := range []byte("cFiJo") {
+		for _, val := range sinv.FlagArgs[f] {
+			args = append(args, "-"+string(f), val)
+		}
+	}
+	if port, ok := sinv.FlagArg('P'); ok {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", p.Destination)
+
+	inv, err := ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = inv.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// The fake scp command.
+//
+// Files are copied with the Upload, UploadDir, Download and DownloadDir of
+// the Communicator of each remote host. The real scp is run if a host is not
+// handled by the server, and run with the fake ssh if a jump host is set.
+func Scp() int {
+	ctx := context.Background()
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, os.Kill)
+
+	go func() {
+		select {
+		case <-signalChan:
+			cancel()
+		case <-dctx.Done():
+		}
+	}()
+
+	sinv, err := ParseScpArgs(os.Args)
+	if err != nil {
+		scpErrorf("%s", err)
+	}
+	if err != nil || len(sinv.Operands) < 2 {
+		fmt.Fprintln(os.Stderr, SCPUSAGE)
+		return SCP_EXIT_FAILURE
+	}
+
+	rpcDir, envSet := os.LookupEnv(RPCDirEnvVarName)
+	if !envSet {
+		scpErrorf("%s is not set", RPCDirEnvVarName)
+		return SCP_EXIT_FAILURE
+	}
+
+	// Another ssh program is only honoured by the real scp
+	if _, ok := sinv.FlagArg('S'); ok {
+		return scpPassThrough(os.Args)
+	}
+
+	ends := make([]scpEnd, len(sinv.Operands))
+	for i, p := range sinv.Operands {
+		ends[i].Path = p.Path
+		if !p.Remote() {
+			continue
+		}
+		inv, err := sinv.sshInvocation(p)
+		if err != nil {
+			scpErrorf("%s", err)
+			return SCP_EXIT_FAILURE
+		}
+		if len(inv.ProxyJump()) > 0 {
+			return scpThroughFakeSsh(os.Args)
+		}
+		handled, err := HandlesHost(dctx, rpcDir, inv.HostName)
+		if err != nil {
+			scpErrorf("%s", err)
+			return SCP_EXIT_FAILURE
+		}
+		if !handled {
+			return scpPassThrough(os.Args)
+		}
+		ends[i].Host = inv.HostName
+		ends[i].User = inv.User
+		if ends[i].Path == "" {
+			ends[i].Path = "."
+		}
+	}
+
+	c := &scpCopier{
+		ctx:       dctx,
+		dir:       rpcDir,
+		recursive: sinv.Flag('r'),
+		preserve:  sinv.Flag('p'),
+	}
+	// Guest commands and file transfers get the same absolute paths
+	for i := range ends {
+		if !ends[i].Remote() {
+			continue
+		}
+		err := PermitTransfer(dctx, rpcDir, &RpcTransfer{
+			Host: ends[i].Host,
+			User: ends[i].User,
+		})
+		if err != nil {
+			scpErrorf("%s", err)
+			return SCP_EXIT_FAILURE
+		}
+		p, err := c.guestPath(ends[i].Host, ends[i].Path)
+		if err != nil {
+			scpErrorf("%s", scpGuestError(ends[i].Path, err))
+			return SCP_EXIT_FAILURE
+		}
+		ends[i].Path = p
+	}
+	target := ends[len(ends)-1]
+	sources := ends[:len(ends)-1]
+	if len(sources) > 1 {
+		isDir, err := c.isDir(target)
+		if err == nil && !isDir {
+			err = fmt.Errorf("%s: Not a directory", target.Path)
+		}
+		if err != nil {
+			scpErrorf("%s", err)
+			return SCP_EXIT_FAILURE
+		}
+	}
+
+	exitCode := 0
+	for _, src := range sources {
+		var err error
+		switch {
+		case !src.Remote() && !target.Remote():
+			err = c.localCopy(src.Path, target.Path)
+		case !src.Remote():
+			err = c.upload(src.Path, target)
+		case !target.Remote():
+			err = c.download(src, target.Path)
+		default:
+			err = c.remoteCopy(src, target)
+		}
+		if err != nil {
+			// cp reports its own errors
+			if _, ok := err.(*exec.ExitError); !ok {
+				scpErrorf("%s", err)
+			}
+			exitCode = SCP_EXIT_FAILURE
+		}
+		if dctx.Err() != nil {
+			return SCP_EXIT_FAILURE
+		}
+	}
+	return exitCode
+}
+
+// Print an error message of scp to stderr
+func scpErrorf(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "scp: "+format+"\n", a...)
+}
+
+// Run the real scp with args and the environment of this process and
+// return its exit code
+func scpPassThrough(args []string) int {
+	scpExe, err := RealScpPath()
+	if err != nil {
+		scpErrorf("%s", err)
+		return SCP_EXIT_FAILURE
+	}
+	exitCode, err := execSsh(scpExe, args, os.Environ())
+	if err != nil {
+		scpErrorf("%s: %s", scpExe, err)
+	}
+	return exitCode
+}
+
+// Run the real scp with the fake ssh next to this executable, which runs
+// scp on the guest through the jump hosts
+func scpThroughFakeSsh(args []string) int {
+	self, err := os.Executable()
+	if err != nil {
+		scpErrorf("%s", err)
+		return SCP_EXIT_FAILURE
+	}
+	sshExe := filepath.Join(filepath.Dir(self), SSHEXENAME)
+	newArgs := append([]string{args[0], "-S", sshExe}, args[1:]...)
+	return scpPassThrough(newArgs)
+}
+
+// A file of a copy, on the guest of Host or local if Host is empty
+type scpEnd struct {
+	// Host of the guest, resolved like the fake ssh
+	Host string
+	// User of the destination, checked by the server before any copy
+	User string
+	Path string
+}
+
+// Check if e is a file of a guest
+func (e scpEnd) Remote() bool {
+	return e.Host != ""
+}
+
+// Copies of scp through the fake ssh server
+type scpCopier struct {
+	ctx context.Context
+	// Working directory of the fake ssh server
+	dir string
+	// Copy directories (scp -r)
+	recursive bool
+	// Keep modes and times (scp -p)
+	preserve bool
+	// Patterns of files skipped in directories
+	exclude []string
+	// Shows the progress of copies if set
+	meter *progressMeter
+}
+
+// Attributes of a guest file
+type scpStat struct {
+	Mode  os.FileMode
+	Size  int64
+	Atime time.Time
+	Mtime time.Time
+}
+
+// Stat a guest file for scp, following symbolic links
+func scpStatCommand(p string) string {
+	return fmt.Sprintf("stat -L -c '%s' -- %s", SCPSTATFORMAT, ShellQuote(p))
+}
+
+// Parse the output of scpStatCommand
+func parseScpStat(out string) (*scpStat, error) {
+	fields := strings.Fields(out)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("bad stat output %q", out)
+	}
+	mode, err := strconv.ParseUint(fields[0], 16, 32)
+	if err != nil {
+		return nil, err
+	}
+	nums := [3]int64{}
+	for i, field := range fields[1:] {
+		nums[i], err = strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &scpStat{
+		Mode:  guestFileMode(uint32(mode)),
+		Size:  nums[0],
+		Atime: time.Unix(nums[1], 0),
+		Mtime: time.Unix(nums[2], 0),
+	}, nil
+}
+
+// Stat the guest file p of host, following symbolic links
+func (c *scpCopier) guestStat(host string, p string) (*scpStat, error) {
+	out, err := c.guestRun(host, scpStatCommand(p))
+	if err != nil {
+		return nil, scpGuestError(p, err)
+	}
+	return parseScpStat(out)
+}
+
+// Run command on the guest of host as the Communicator user and return its
+// stdout
+func (c *scpCopier) guestRun(host string, command string) (string, error) {
+	// An unknown working directory is passed as the empty string
+	workDir, _ := os.Getwd()
+	return guestOutput(c.ctx, c.dir, Cmd{
+		Command: command,
+		Host:    host,
+		WorkDir: workDir,
+	})
+}
+
+// Make the guest path p of host absolute, from the working directory of
+// commands on the guest. The Communicator may resolve relative paths from
+// another directory.
+func (c *scpCopier) guestPath(host string, p string) (string, error) {
+	if path.IsAbs(p) {
+		return p, nil
+	}
+	out, err := c.guestRun(host, "pwd")
+	if err != nil {
+		return "", err
+	}
+	return path.Join(strings.TrimSpace(out), p), nil
+}
+
+// Make the local path p absolute for the server, which resolves relative
+// paths from its own working directory
+func localPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	return abs
+}
+
+// Check if e is a directory
+func (c *scpCopier) isDir(e scpEnd) (bool, error) {
+	if e.Remote() {
+		st, err := c.guestStat(e.Host, e.Path)
+		if err != nil {
+			return false, err
+		}
+		return st.Mode.IsDir(), nil
+	}
+	fi, err := os.Stat(e.Path)
+	if err != nil {
+		return false, scpLocalError(e.Path, err)
+	}
+	return fi.IsDir(), nil
+}
+
+// Run copy of the file or directory name, showing its progress with c.meter
+// if set. size returns the size of the copy, and copied the bytes copied so
+// far, or is nil if unknown.
+func (c *scpCopier) withProgress(
+	name string,
+	size func() int64,
+	copied func() int64,
+	copy func() error,
+) error {
+	if c.meter == nil {
+		return copy()
+	}
+	return c.meter.show(name, size(), copied, copy)
+}
+
+// Set an ID to the file transfer t for c.meter, and return a function
+// reporting the bytes it copied so far
+func (c *scpCopier) follow(t *RpcTransfer) func() int64 {
+	if c.meter == nil {
+		return nil
+	}
+	id, err := newTransferID()
+	if err != nil {
+		return nil
+	}
+	t.ID = id
+	last := int64(0)
+	return func() int64 {
+		n, err := TransferProgress(c.ctx, c.dir, id)
+		if err == nil {
+			last = n
+		}
+		return last
+	}
+}
+
+// Return the total size of the regular files in the guest directory e
+func (c *scpCopier) guestSize(e scpEnd) int64 {
+	out, _ := c.guestRun(e.Host, fmt.Sprintf(
+		"cd -- %s && find . -type f -exec stat -c %%s {} +",
+		ShellQuote(e.Path),
+	))
+	size := int64(0)
+	for _, field := range strings.Fields(out) {
+		n, err := strconv.ParseInt(field, 10, 64)
+		if err == nil {
+			size += n
+		}
+	}
+	return size
+}
+
+// Copy the local file src to the guest file dst
+func (c *scpCopier) upload(src string, dst scpEnd) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return scpLocalError(src, err)
+	}
+	if !fi.IsDir() && !fi.Mode().IsRegular() || fi.IsDir() && !c.recursive {
+		return fmt.Errorf("%s: not a regular file", src)
+	}
+	dstIsDir, _ := c.isDir(dst)
+	remote := dst.Path
+	if dstIsDir {
+		remote = path.Join(remote, filepath.Base(src))
+	}
+
+	if !fi.IsDir() {
+		t := &RpcTransfer{
+			Host:   dst.Host,
+			User:   dst.User,
+			Remote: remote,
+			Local:  localPath(src),
+		}
+		err = c.withProgress(
+			filepath.Base(src),
+			func() int64 { return fi.Size() },
+			c.follow(t),
+			func() error { return UploadFile(c.ctx, c.dir, t) },
+		)
+		if err != nil {
+			return err
+		}
+		if c.preserve {
+			return c.guestPreserve(dst.Host, remote, src)
+		}
+		return nil
+	}
+
+	// Like the ssh Communicator, a directory without a trailing slash is
+	// uploaded into an existing directory, and only its contents otherwise
+	local := filepath.Clean(src)
+	uploadDir := func(t *RpcTransfer) error {
+		t.Exclude = c.exclude
+		return c.withProgress(
+			filepath.Base(local),
+			func() int64 { return localSize(local) },
+			nil,
+			func() error { return UploadDir(c.ctx, c.dir, t) },
+		)
+	}
+	if dstIsDir {
+		err = uploadDir(&RpcTransfer{
+			Host:   dst.Host,
+			User:   dst.User,
+			Remote: dst.Path,
+			Local:  localPath(local),
+		})
+	} else {
+		_, err = c.guestRun(dst.Host, fmt.Sprintf(
+			"mkdir -- %[1]s && chmod %[2]o -- %[1]s",
+			ShellQuote(remote), fi.Mode().Perm(),
+		))
+		if err != nil {
+			return scpGuestError(remote, err)
+		}
+		err = uploadDir(&RpcTransfer{
+			Host:   dst.Host,
+			User:   dst.User,
+			Remote: remote,
+			Local:  localPath(local) + string(filepath.Separator),
+		})
+	}
+	if err != nil {
+		return err
+	}
+	if c.preserve {
+		return c.guestPreserve(dst.Host, remote, local)
+	}
+	return nil
+}
+
+// Set the modes and modification times of the guest file remote and the
+// files below it to those of the local file local
+func (c *scpCopier) guestPreserve(host string, remote string, local string) error {
+	commands := []string{}
+	err := filepath.Walk(local, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, p)
+		if err != nil {
+			return err
+		}
+		guest := path.Join(remote, filepath.ToSlash(rel))
+		commands = append(commands, fmt.Sprintf(
+			"chmod %o -- %s && %s", fi.Mode().Perm(), ShellQuote(guest),
+			touchCommand('m', fi.ModTime(), guest),
+		))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Set the times of directories after those of their contents
+	for i, j := 0, len(commands)-1; i < j; i, j = i+1, j-1 {
+		commands[i], commands[j] = commands[j], commands[i]
+	}
+	_, err = c.guestRun(host, strings.Join(commands, " && "))
+	if err != nil {
+		return scpGuestError(remote, err)
+	}
+	return nil
+}
+
+// Copy the guest file src to the local file dst
+func (c *scpCopier) download(src scpEnd, dst string) error {
+	st, err := c.guestStat(src.Host, src.Path)
+	if err != nil {
+		return err
+	}
+	if !st.Mode.IsDir() && !st.Mode.IsRegular() ||
+		st.Mode.IsDir() && !c.recursive {
+		return fmt.Errorf("%s: not a regular file", src.Path)
+	}
+	dstFi, err := os.Stat(dst)
+	dstIsDir := err == nil && dstFi.IsDir()
+	local := dst
+	if dstIsDir {
+		local = filepath.Join(dst, path.Base(src.Path))
+	}
+	_, err = os.Stat(local)
+	created := os.IsNotExist(err)
+
+	if !st.Mode.IsDir() {
+		t := &RpcTransfer{
+			Host:   src.Host,
+			User:   src.User,
+			Remote: src.Path,
+			Local:  localPath(local),
+		}
+		err = c.withProgress(
+			path.Base(src.Path),
+			func() int64 { return st.Size },
+			c.follow(t),
+			func() error { return DownloadFile(c.ctx, c.dir, t) },
+		)
+	} else if !created && !dstIsDir {
+		return fmt.Errorf("%s: Not a directory", dst)
+	} else {
+		err = c.downloadDir(src, local)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Like scp, new files get the mode of the guest file
+	if created || c.preserve {
+		err = os.Chmod(local, st.Mode.Perm())
+		if err != nil {
+			return scpLocalError(local, err)
+		}
+	}
+	if !c.preserve {
+		return nil
+	}
+	if st.Mode.IsDir() {
+		return c.localPreserve(src, local)
+	}
+	return os.Chtimes(local, st.Atime, st.Mtime)
+}
+
+// Copy the guest directory src to the local directory dst, merged into dst
+// if it exists
+func (c *scpCopier) downloadDir(src scpEnd, dst string) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(dst), ".fakessh-scp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = c.withProgress(
+		path.Base(src.Path),
+		func() int64 { return c.guestSize(src) },
+		func() int64 { return localSize(tmp) },
+		func() error {
+			return DownloadDir(c.ctx, c.dir, &RpcTransfer{
+				Host:    src.Host,
+				User:    src.User,
+				Remote:  src.Path,
+				Local:   localPath(tmp),
+				Exclude: c.exclude,
+			})
+		},
+	)
+	if err != nil {
+		return err
+	}
+	// Like the ssh Communicator, the directory is usually downloaded into
+	// tmp, but some Communicators download its contents
+	got := filepath.Join(tmp, path.Base(src.Path))
+	if _, err := os.Stat(got); err != nil {
+		got = tmp
+	}
+	return mergeDir(got, dst)
+}
+
+// Set the modes, access and modification times of the local directory local
+// and the files below it to those of the guest directory src
+func (c *scpCopier) localPreserve(src scpEnd, local string) error {
+	out, err := c.guestRun(src.Host, fmt.Sprintf(
+		"cd -- %s && find . -exec stat -c '%%a %%X %%Y %%n' {} +",
+		ShellQuote(src.Path),
+	))
+	if err != nil {
+		return scpGuestError(src.Path, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	// Set the times of directories after those of their contents
+	for i := len(lines) - 1; i >= 0; i-- {
+		fields := strings.SplitN(lines[i], " ", 4)
+		if len(fields) != 4 {
+			return fmt.Errorf("bad stat output %q", lines[i])
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return err
+		}
+		atime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		mtime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		p := filepath.Join(local, filepath.FromSlash(fields[3]))
+		err = os.Chmod(p, os.FileMode(mode).Perm())
+		if err == nil {
+			err = os.Chtimes(p, time.Unix(atime, 0), time.Unix(mtime, 0))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the guest file src to the guest file dst through a local copy
+func (c *scpCopier) remoteCopy(src scpEnd, dst scpEnd) error {
+	tmp, err := ioutil.TempDir("", "fakessh-scp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = c.download(src, tmp)
+	if err != nil {
+		return err
+	}
+	return c.upload(filepath.Join(tmp, path.Base(src.Path)), dst)
+}
+
+// Copy the local file src to dst with cp, like scp
+func (c *scpCopier) localCopy(src string, dst string) error {
+	args := []string{}
+	if c.recursive {
+		args = append(args, "-r")
+	}
+	if c.preserve {
+		args = append(args, "-p")
+	}
+	args = append(args, "--", src, dst)
+	cmd := exec.CommandContext(c.ctx, "cp", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Move the local directory src to dst, or into dst if it is an existing
+// directory
+func mergeDir(src string, dst string) error {
+	fi, err := os.Stat(dst)
+	if os.IsNotExist(err) {
+		return os.Rename(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: Not a directory", dst)
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dst, entry.Name())
+		if entry.IsDir() {
+			err = mergeDir(from, to)
+		} else {
+			err = os.Rename(from, to)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe the error of a local file operation on p like scp
+func scpLocalError(p string, err error) error {
+	if perr, ok := err.(*os.PathError); ok {
+		msg := perr.Err.Error()
+		return fmt.Errorf("%s: %s", p, strings.ToUpper(msg[:1])+msg[1:])
+	}
+	return err
+}
+
+// Describe the error of a guest command on p like scp, from the last
+// message of its stderr
+func scpGuestError(p string, err error) error {
+	err = gnuStatError(err)
+	gerr, ok := err.(*guestError)
+	if !ok {
+		return err
+	}
+	msg := strings.TrimSpace(gerr.Stderr)
+	if k := strings.LastIndexByte(msg, '\n'); k >= 0 {
+		msg = msg[k+1:]
+	}
+	if k := strings.LastIndex(msg, ": "); k >= 0 {
+		msg = msg[k+2:]
+	}
+	if msg == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %s", p, msg)
+}
@@ -0,0 +1,764 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/ctxio"
+)
+
+// A legacy scp command in remote mode, which speaks the rcp protocol on
+// its stdin and stdout
+type scpRemote struct {
+	// Receive files into the target (scp -t) instead of sending them
+	// (scp -f)
+	Sink bool
+	// Copy directories (scp -r)
+	Recursive bool
+	// Keep modes and times (scp -p)
+	Preserve bool
+	// The target must be a directory (scp -d)
+	TargetDir bool
+	// The target of scp -t, or the sources of scp -f
+	Paths []string
+}
+
+// Parse command as scp -t or scp -f, or return nil if it is another
+// command or needs a shell
+func parseScpRemote(command string) *scpRemote {
+	words, ok := ShellSplit(command)
+	if !ok || len(words) < 2 || path.Base(words[0]) != "scp" {
+		return nil
+	}
+	s := &scpRemote{}
+	source := false
+	i := 1
+	for ; i < len(words); i++ {
+		arg := words[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for _, f := range arg[1:] {
+			switch f {
+			case 't':
+				s.Sink = true
+			case 'f':
+				source = true
+			case 'r':
+				s.Recursive = true
+			case 'p':
+				s.Preserve = true
+			case 'd':
+				s.TargetDir = true
+			case 'v', 'q':
+			default:
+				return nil
+			}
+		}
+	}
+	s.Paths = words[i:]
+	if s.Sink == source || len(s.Paths) == 0 || s.Sink && len(s.Paths) != 1 {
+		return nil
+	}
+	return s
+}
+
+// Serve the legacy scp command s on pipes with comm, and return its exit
+// code.
+//
+// Files are copied with the Upload and Download of comm, and directories
+// with UploadDir and DownloadDir through a local copy. Like sftp, files are
+// read and written as the Communicator user.
+func serveScp(
+	ctx context.Context,
+	comm packer.Communicator,
+	s *scpRemote,
+	pipes RpcState,
+) int {
+	var r io.Reader = eofReader{}
+	if pipes.Stdin != nil {
+		r = ctxio.ReaderAdapter(ctx, pipes.Stdin)
+	}
+	p := &scpPeer{
+		ctx:    ctx,
+		comm:   comm,
+		s:      s,
+		r:      bufio.NewReader(r),
+		w:      ctxio.WriterAdapter(ctx, pipes.Stdout),
+		stderr: ctxio.WriterAdapter(ctx, pipes.Stderr),
+	}
+	var err error
+	if s.Sink {
+		err = p.sink(s.Paths[0])
+	} else {
+		err = p.source(s.Paths)
+	}
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(p.stderr, "scp: %s\n", err)
+		return SCP_EXIT_FAILURE
+	}
+	if p.errs > 0 {
+		return SCP_EXIT_FAILURE
+	}
+	return 0
+}
+
+// A reader at its end
+type eofReader struct{}
+
+func (eofReader) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// The remote end of an scp transfer
+type scpPeer struct {
+	ctx  context.Context
+	comm packer.Communicator
+	s    *scpRemote
+	// The rcp protocol stream from and to the scp client
+	r      *bufio.Reader
+	w      io.Writer
+	stderr io.Writer
+	// Number of errors reported to the client
+	errs int
+}
+
+// An error the scp client reported with the rcp protocol
+type scpPeerError struct {
+	Msg string
+	// The client gave up the transfer
+	Fatal bool
+}
+
+func (e *scpPeerError) Error() string {
+	return e.Msg
+}
+
+// Report the error of one file to the client, which goes on with the
+// transfer
+func (p *scpPeer) report(err error) error {
+	p.errs++
+	_, werr := fmt.Fprintf(p.w, "\x01scp: %s\n", err)
+	return werr
+}
+
+// Tell the client the last message succeeded
+func (p *scpPeer) ok() error {
+	_, err := p.w.Write([]byte{0})
+	return err
+}
+
+// Read the response of the client to the last message
+func (p *scpPeer) ack() error {
+	c, err := p.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		return nil
+	}
+	msg, err := p.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	return &scpPeerError{Msg: strings.TrimSuffix(msg, "\n"), Fatal: c != 1}
+}
+
+// Run command with the Communicator and describe its error for the guest
+// file p
+func (p *scpPeer) run(command string, file string) (string, error) {
+	out, err := commOutput(p.ctx, p.comm, command)
+	if err != nil {
+		return out, scpGuestError(file, err)
+	}
+	return out, nil
+}
+
+// Run command with comm and return its stdout.
+//
+// A command exiting with an error returns a *guestError.
+func commOutput(
+	ctx context.Context,
+	comm packer.Communicator,
+	command string,
+) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := &packer.RemoteCmd{
+		Command: command,
+		Stdout:  stdout,
+		Stderr:  stderr,
+	}
+	err := comm.Start(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	exitCode := cmd.Wait()
+	if exitCode != 0 {
+		return "", &guestError{ExitCode: exitCode, Stderr: stderr.String()}
+	}
+	return stdout.String(), nil
+}
+
+// Send the guest files of paths to the client (scp -f)
+func (p *scpPeer) source(paths []string) error {
+	err := p.ack()
+	if err != nil {
+		return err
+	}
+	for _, file := range paths {
+		err = p.sourceFile(file)
+		if p.skipped(err) {
+			continue
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return err
+		}
+		err = p.report(err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send the guest file or directory file
+func (p *scpPeer) sourceFile(file string) error {
+	out, err := p.run(scpStatCommand(file), file)
+	if err != nil {
+		return err
+	}
+	st, err := parseScpStat(out)
+	if err != nil {
+		return err
+	}
+	switch {
+	case st.Mode.IsDir() && p.s.Recursive:
+		return p.sourceDir(file)
+	case st.Mode.IsRegular():
+		return p.sendFile(path.Base(file), st, func(w io.Writer) error {
+			return p.comm.Download(file, w)
+		})
+	}
+	return fmt.Errorf("%s: not a regular file", file)
+}
+
+// Check if err only concerns one file that is already reported, so the
+// transfer goes on. Errors reported by the client are counted.
+func (p *scpPeer) skipped(err error) bool {
+	switch e := err.(type) {
+	case nil, *scpFileError:
+		return true
+	case *scpPeerError:
+		if !e.Fatal {
+			p.errs++
+		}
+		return !e.Fatal
+	}
+	return false
+}
+
+// An error of one file while its contents are sent, already reported to
+// the client
+type scpFileError struct {
+	error
+}
+
+// Send the file name with attributes st, written by copy
+func (p *scpPeer) sendFile(
+	name string,
+	st *scpStat,
+	copy func(w io.Writer) error,
+) error {
+	if p.s.Preserve {
+		err := p.sendTimes(st)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "C%04o %d %s\n", st.Mode&07777, st.Size, name)
+	if err != nil {
+		return err
+	}
+	err = p.ack()
+	if err != nil {
+		return err
+	}
+
+	// Exactly st.Size bytes are sent, padded if the file shrank, like scp
+	w := &limitWriter{W: p.w, N: st.Size}
+	cerr := copy(w)
+	if w.Err != nil {
+		return w.Err
+	}
+	if w.N > 0 {
+		_, err = p.w.Write(make([]byte, w.N))
+		if err != nil {
+			return err
+		}
+		if cerr == nil {
+			cerr = fmt.Errorf("%s: file changed size", name)
+		}
+	}
+	if cerr != nil {
+		err = p.report(scpGuestError(name, cerr))
+	} else {
+		err = p.ok()
+	}
+	if err != nil {
+		return err
+	}
+	err = p.ack()
+	if cerr != nil && err == nil {
+		return &scpFileError{cerr}
+	}
+	return err
+}
+
+// Send the access and modification times of the next file
+func (p *scpPeer) sendTimes(st *scpStat) error {
+	_, err := fmt.Fprintf(p.w, "T%d 0 %d 0\n",
+		st.Mtime.Unix(), st.Atime.Unix())
+	if err != nil {
+		return err
+	}
+	return p.ack()
+}
+
+// A writer of at most N more bytes that drops the rest
+type limitWriter struct {
+	W io.Writer
+	N int64
+	// Error of W, which breaks the protocol stream
+	Err error
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if int64(len(b)) > lw.N {
+		b = b[:lw.N]
+	}
+	if len(b) > 0 {
+		m, err := lw.W.Write(b)
+		lw.N -= int64(m)
+		if err != nil {
+			lw.Err = err
+			return m, err
+		}
+	}
+	return n, nil
+}
+
+// Send the guest directory dir, copied with DownloadDir
+func (p *scpPeer) sourceDir(dir string) error {
+	tmp, err := ioutil.TempDir("", "fakessh-scp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	err = p.comm.DownloadDir(dir, tmp, nil)
+	if err != nil {
+		return scpGuestError(dir, err)
+	}
+	// Like the ssh Communicator, the directory is usually downloaded into
+	// tmp, but some Communicators download its contents
+	local := filepath.Join(tmp, path.Base(dir))
+	if _, err := os.Stat(local); err != nil {
+		local = tmp
+	}
+
+	times := map[string]*scpStat{}
+	if p.s.Preserve {
+		out, err := p.run(fmt.Sprintf(
+			"cd -- %s && find . -exec stat -c '%s %%n' {} +",
+			ShellQuote(dir), SCPSTATFORMAT,
+		), dir)
+		if err != nil {
+			return err
+		}
+		lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		for _, line := range lines {
+			fields := strings.SplitN(line, " ", 5)
+			if len(fields) != 5 {
+				return fmt.Errorf("bad stat output %q", line)
+			}
+			st, err := parseScpStat(strings.Join(fields[:4], " "))
+			if err != nil {
+				return err
+			}
+			times[path.Clean(fields[4])] = st
+		}
+	}
+	return p.sendLocalDir(local, path.Base(dir), ".", times)
+}
+
+// Send the local copy local of a guest directory as name, where rel is its
+// path in the sent directory and times the attributes of the guest files
+func (p *scpPeer) sendLocalDir(
+	local string,
+	name string,
+	rel string,
+	times map[string]*scpStat,
+) error {
+	fi, err := os.Stat(local)
+	if err != nil {
+		return err
+	}
+	if st, ok := times[rel]; ok {
+		err = p.sendTimes(st)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(p.w, "D%04o 0 %s\n", fi.Mode().Perm(), name)
+	if err != nil {
+		return err
+	}
+	err = p.ack()
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(local)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entryLocal := filepath.Join(local, entry.Name())
+		entryRel := path.Join(rel, entry.Name())
+		if entry.IsDir() {
+			err = p.sendLocalDir(entryLocal, entry.Name(), entryRel, times)
+		} else {
+			st := &scpStat{
+				Mode:  entry.Mode().Perm(),
+				Size:  entry.Size(),
+				Atime: entry.ModTime(),
+				Mtime: entry.ModTime(),
+			}
+			if guest, ok := times[entryRel]; ok {
+				st.Atime = guest.Atime
+				st.Mtime = guest.Mtime
+			}
+			err = p.sendFile(entry.Name(), st, func(w io.Writer) error {
+				f, err := os.Open(entryLocal)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = io.Copy(w, f)
+				return err
+			})
+		}
+		if !p.skipped(err) {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprint(p.w, "E\n")
+	if err != nil {
+		return err
+	}
+	return p.ack()
+}
+
+// A directory being received, staged locally until it is complete
+type scpStagedDir struct {
+	// Local copy of the directory
+	Local string
+	// Mode of the directory, set once its contents are written
+	Mode os.FileMode
+	// Times of the directory, if sent
+	Times *scpStat
+}
+
+// Receive files from the client into the guest file target (scp -t).
+//
+// Files are uploaded as they arrive. Directories are staged in a local
+// directory and uploaded when they end.
+func (p *scpPeer) sink(target string) error {
+	out, err := p.run(scpStatCommand(target), target)
+	targetIsDir := false
+	if err == nil {
+		st, perr := parseScpStat(out)
+		targetIsDir = perr == nil && st.Mode.IsDir()
+	}
+	if p.s.TargetDir && !targetIsDir {
+		if err == nil {
+			err = fmt.Errorf("%s: Not a directory", target)
+		}
+		return p.report(err)
+	}
+	err = p.ok()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir("", "fakessh-scp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// The guest path of the directory being received and its staged
+	// subdirectories
+	var root string
+	stack := []scpStagedDir{}
+	// Guest files whose times are set once uploaded
+	preserved := []string{}
+	var times *scpStat
+	for {
+		line, err := p.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("protocol error: empty message")
+		}
+
+		switch line[0] {
+		case '\x01', '\x02':
+			fmt.Fprintf(p.stderr, "%s\n", line[1:])
+			if line[0] == '\x02' {
+				return &scpPeerError{Msg: line[1:], Fatal: true}
+			}
+			p.errs++
+			continue
+		case 'T':
+			var mtime, atime int64
+			var mus, aus int
+			_, err := fmt.Sscanf(line[1:], "%d %d %d %d",
+				&mtime, &mus, &atime, &aus)
+			if err != nil {
+				return errors.New("protocol error: mtime.sec not delimited")
+			}
+			times = &scpStat{
+				Atime: time.Unix(atime, 0),
+				Mtime: time.Unix(mtime, 0),
+			}
+			err = p.ok()
+			if err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(stack) == 0 {
+				return errors.New("protocol error: unexpected <newline>")
+			}
+			dir := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			err = os.Chmod(dir.Local, dir.Mode)
+			if err == nil && dir.Times != nil {
+				err = os.Chtimes(dir.Local, dir.Times.Atime, dir.Times.Mtime)
+			}
+			if err == nil && len(stack) == 0 {
+				// The staged directory is named like root, so UploadDir
+				// creates or fills root
+				err = p.comm.UploadDir(path.Dir(root), dir.Local, nil)
+				if err == nil && p.s.Preserve {
+					err = p.setTimes(root, dir.Local, preserved)
+				}
+				preserved = []string{}
+			}
+			if err != nil {
+				err = p.report(scpGuestError(root, err))
+			} else {
+				err = p.ok()
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("protocol error: %q", line)
+		}
+
+		var mode uint32
+		var size int64
+		var name string
+		fields := strings.SplitN(line[1:], " ", 3)
+		if len(fields) == 3 {
+			m, merr := strconv.ParseUint(fields[0], 8, 32)
+			size, err = strconv.ParseInt(fields[1], 10, 64)
+			mode, name = uint32(m), fields[2]
+			if merr != nil {
+				err = merr
+			}
+		}
+		if len(fields) != 3 || err != nil || size < 0 {
+			return errors.New("protocol error: bad mode or size")
+		}
+		if name == "" || name == "." || name == ".." ||
+			strings.Contains(name, "/") {
+			return fmt.Errorf("error: unexpected filename: %s", name)
+		}
+		fileTimes := times
+		times = nil
+
+		// The guest path of a file or directory at the top, or the local
+		// path of one in a staged directory
+		var dst string
+		if len(stack) == 0 {
+			dst = target
+			if targetIsDir {
+				dst = path.Join(target, name)
+			}
+		} else {
+			dst = filepath.Join(stack[len(stack)-1].Local, name)
+		}
+
+		if line[0] == 'D' {
+			if !p.s.Recursive {
+				return errors.New("received directory without -r")
+			}
+			local := dst
+			if len(stack) == 0 {
+				root = dst
+				local = filepath.Join(tmp, path.Base(dst))
+				os.RemoveAll(local)
+			}
+			err = os.MkdirAll(local, 0700)
+			if err != nil {
+				return err
+			}
+			stack = append(stack, scpStagedDir{
+				Local: local,
+				Mode:  os.FileMode(mode).Perm(),
+				Times: fileTimes,
+			})
+			if fileTimes != nil {
+				preserved = append(preserved, local)
+			}
+			err = p.ok()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = p.ok()
+		if err != nil {
+			return err
+		}
+		data := io.LimitReader(p.r, size)
+		if len(stack) == 0 {
+			fi := &scpFileInfo{
+				name: path.Base(dst),
+				size: size,
+				mode: os.FileMode(mode).Perm(),
+			}
+			var ofi os.FileInfo = fi
+			err = p.comm.Upload(dst, data, &ofi)
+			if err == nil && fileTimes != nil {
+				_, err = p.run(
+					touchCommand('a', fileTimes.Atime, dst)+" && "+
+						touchCommand('m', fileTimes.Mtime, dst),
+					dst,
+				)
+			}
+		} else {
+			err = writeLocalFile(dst, data, os.FileMode(mode).Perm())
+			if err == nil && fileTimes != nil {
+				err = os.Chtimes(dst, fileTimes.Atime, fileTimes.Mtime)
+				preserved = append(preserved, dst)
+			}
+		}
+		// The data is read even if the file could not be written
+		_, cerr := io.Copy(ioutil.Discard, data)
+		if cerr != nil {
+			return cerr
+		}
+		aerr := p.ack()
+		if aerr != nil {
+			return aerr
+		}
+		if err != nil {
+			err = p.report(scpGuestError(dst, err))
+		} else {
+			err = p.ok()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Set the times of the guest copies of the staged files locals, under the
+// staged directory local uploaded to root
+func (p *scpPeer) setTimes(root string, local string, locals []string) error {
+	commands := []string{}
+	// Set the times of directories after those of their contents
+	for i := len(locals) - 1; i >= 0; i-- {
+		fi, err := os.Stat(locals[i])
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(local, locals[i])
+		if err != nil {
+			return err
+		}
+		commands = append(commands, touchCommand('m', fi.ModTime(),
+			path.Join(root, filepath.ToSlash(rel))))
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	_, err := p.run(strings.Join(commands, " && "), root)
+	return err
+}
+
+// Write r to the local file p with permissions mode
+func writeLocalFile(p string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	return os.Chmod(p, mode)
+}
+
+// A file received by scp -t
+type scpFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi *scpFileInfo) Name() string       { return fi.name }
+func (fi *scpFileInfo) Size() int64        { return fi.size }
+func (fi *scpFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *scpFileInfo) ModTime() time.Time { return time.Now() }
+func (fi *scpFileInfo) IsDir() bool        { return false }
+func (fi *scpFileInfo) Sys() interface{}   { return nil }
@@ -12,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/hashicorp/packer/communicator/none"
 	"github.com/hashicorp/packer/packer"
@@ -36,12 +37,67 @@ type server struct {
 	Ln net.Listener
 	// rpc uds sock directory
 	Dir string
+	ssh *RpcSsh
+}
+
+// Options of a fakessh server
+type ServerConfig struct {
+	// Patterns of environment variable names accepted from the fake ssh.
+	// If nil, use DefaultAcceptEnv.
+	AcceptEnv []string
+	// Template wrapping commands to run them as the user of the ssh
+	// destination, rendered with CommandTemplate.
+	// If empty, the user of the destination is ignored.
+	SwitchUserCommand string
+	// Patterns of destination users commands may run for, whether or not
+	// SwitchUserCommand is set. CommUser is always permitted.
+	// If empty, any user is permitted.
+	AllowedUsers []string
+	// Template wrapping every command before it is started, rendered with
+	// CommandTemplate. SwitchUserCommand wraps the result.
+	// If empty, commands are not wrapped.
+	ExecuteCommand string
+	// The user the Communicator runs commands as.
+	// Commands for this user are not wrapped with SwitchUserCommand.
+	CommUser string
+	// Patterns of destination hosts handled by the server. The fake ssh
+	// passes other hosts to the real ssh. If empty, every host is handled.
+	// The hosts of Routes are always handled.
+	MatchHosts []string
+	// Template of the command relaying stdin and stdout to a TCP port for
+	// ssh -W, -L and -D, rendered with RelayTemplate.
+	// If empty, use DEFAULTRELAYCOMMAND.
+	RelayCommand string
+	// Template of the command accepting one TCP connection and relaying it
+	// to stdin and stdout for ssh -R, rendered with RelayTemplate.
+	// If empty, use DEFAULTLISTENCOMMAND.
+	ListenCommand string
+	// Template of the command accepting one connection on a unix socket and
+	// relaying it to stdin and stdout for ssh -A, rendered with
+	// AgentTemplate. SwitchUserCommand wraps the result.
+	// If empty, use DEFAULTAGENTLISTENCOMMAND.
+	AgentListenCommand string
+	// Template running a command under a pseudo-terminal for ssh -t,
+	// rendered with CommandTemplate. ExecuteCommand wraps the result.
+	// If empty, use DEFAULTPTYCOMMAND.
+	PtyCommand string
+	// Compress the streams of commands between the server and the guest,
+	// unless the fake ssh sets Compression no
+	Compression bool
+	// Communicators picked by the host of the ssh destination, in order.
+	// Hosts matching no route use the Communicator of the server.
+	Routes []Route
 }
 
 // Allocates and initializes a new fakessh server with uds socket in dir.
 // If comm is nil, ignore passed commands.
 // If dir is the empty string, create a temporary directory.
-func NewServer(comm packer.Communicator, dir string) (*server, error) {
+// If config is nil, use the default options.
+func NewServer(
+	comm packer.Communicator,
+	dir string,
+	config *ServerConfig,
+) (*server, error) {
 	var err error = nil
 	if comm == nil {
 		comm, err = none.New("")
@@ -49,9 +105,17 @@ func NewServer(comm packer.Communicator, dir string) (*server, error) {
 			return nil, err
 		}
 	}
+	if config == nil {
+		config = &ServerConfig{}
+	}
 	rpcssh := &RpcSsh{
-		Comm: comm,
-		M:    make(map[RpcCmd]RpcState),
+		Comm:      comm,
+		M:         make(map[string]RpcState),
+		Masters:   make(map[string]time.Time),
+		Codecs:    make(map[packer.Communicator]string),
+		Transfers: make(map[string]*int64),
+		Done:      make(chan struct{}),
+		Config:    *config,
 	}
 
 	// equivalent to rpc.Register(rpcssh)
@@ -89,6 +153,7 @@ func NewServer(comm packer.Communicator, dir string) (*server, error) {
 		Server: httpSrv,
 		Ln:     ln,
 		Dir:    dir,
+		ssh:    rpcssh,
 	}
 
 	return srv, nil
@@ -101,8 +166,11 @@ func (srv *server) Serve() error {
 	return srv.Server.Serve(srv.Ln)
 }
 
-// Gracefully stop fake ssh server and delete working directory
+// Gracefully stop fake ssh server and delete working directory.
+//
+// Running commands, like the listeners of remote forwards, are cancelled.
 func (srv *server) Shutdown(ctx context.Context) error {
+	close(srv.ssh.Done)
 	serr := srv.Server.Shutdown(ctx)
 	lerr := srv.Ln.Close()
 	derr := os.RemoveAll(srv.Dir)
@@ -119,17 +187,63 @@ func (srv *server) Shutdown(ctx context.Context) error {
 	return nil
 }
 
+// Check if the fake ssh server with working directory dir handles commands
+// for the destination host.
+func HandlesHost(ctx context.Context, dir string, host string) (bool, error) {
+	udsDir := filepath.Join(dir, UDSPath)
+	cli, err := rpc.DialHTTP("unix", udsDir)
+	if err != nil {
+		return false, err
+	}
+	defer cli.Close()
+
+	handled := false
+	err = cli.Call(ctx, "RpcSsh.Handles", host, &handled)
+	return handled, err
+}
+
 // A command to send to the communicator
 type Cmd struct {
+	// Command to run. If empty, run a login shell reading Stdin.
 	Command string
-	Stdin   deadlineReaderCloser
-	Stdout  deadlineWriterCloser
-	Stderr  deadlineWriterCloser
+	// Do not read Stdin (ssh -n)
+	NoStdin bool
+	// Do not run Command, wait until cancelled (ssh -N)
+	NoCommand bool
+	// Environment variables to send, like the output of `os.Environ()`
+	Env []string
+	// User of the ssh destination
+	User string
+	// Host of the ssh destination
+	Host string
+	// Working directory of the fake ssh command
+	WorkDir string
+	// If not nil, relay stdin and stdout to this TCP port of the guest
+	// instead of running Command (ssh -W)
+	StdioForward *HostPort
+	// If not nil, relay stdin and stdout to the first connection accepted
+	// on this address of the guest instead of running Command (ssh -R)
+	Listen *HostPort
+	// If not empty, relay stdin and stdout to the first connection accepted
+	// on this unix socket of the guest instead of running Command (ssh -A)
+	ListenAgent string
+	// If not empty, SSH_AUTH_SOCK is set to this path for Command (ssh -A)
+	AgentSocket string
+	// If not nil, run Command under a pseudo-terminal (ssh -t)
+	Pty *PtyRequest
+	// "yes" or "no" to compress the streams of Command or not (ssh -C), or
+	// "" for the default of the server
+	Compression string
+	Stdin       deadlineReaderCloser
+	Stdout      deadlineWriterCloser
+	Stderr      deadlineWriterCloser
 }
 
 // Run cmd on fake ssh server with working directory dir.
 //
-// Closes cmd.Stdin, cmd.Stdout, and cmd.Stderr.
+// Closes cmd.Stdin, cmd.Stdout, and cmd.Stderr if they are not nil.
+// If cmd.NoStdin or cmd.NoCommand is set, cmd.Stdin is never read and may be
+// nil. If cmd.NoCommand is set, cmd.Stdout and cmd.Stderr may also be nil.
 func RunCmd(
 	ctx context.Context,
 	dir string,
@@ -140,18 +254,36 @@ func RunCmd(
 	err = nil
 	udsDir := filepath.Join(dir, UDSPath)
 
+	if cmd.Stdin != nil && (cmd.NoStdin || cmd.NoCommand) {
+		cmd.Stdin.Close()
+	}
+
 	// dial Server
 	cli, err := rpc.DialHTTP("unix", udsDir)
 	if err != nil {
 		return
 	}
 
+	if cmd.NoCommand {
+		if cmd.Stdout != nil {
+			defer cmd.Stdout.Close()
+		}
+		if cmd.Stderr != nil {
+			defer cmd.Stderr.Close()
+		}
+		err = cli.Call(ctx, "RpcSsh.Run", &RpcCmd{NoCommand: true}, &exitCode)
+		return EXIT_FAILURE, err
+	}
+
 	// create pipes
-	inpipe, err := makePipe("stdin")
-	if err != nil {
-		return
+	var inpipe pipe
+	if !cmd.NoStdin {
+		inpipe, err = makePipe("stdin")
+		if err != nil {
+			return
+		}
+		defer inpipe.Close()
 	}
-	defer inpipe.Close()
 	outpipe, err := makePipe("stdout")
 	if err != nil {
 		return
@@ -176,10 +308,21 @@ func RunCmd(
 	defer errpipef.Close()
 
 	c := &RpcCmd{
-		Cmd:        cmd.Command,
-		StdinPipe:  inpipe.Dir,
-		StdoutPipe: outpipe.Dir,
-		StderrPipe: errpipe.Dir,
+		Cmd:          cmd.Command,
+		NoStdin:      cmd.NoStdin,
+		Env:          cmd.Env,
+		User:         cmd.User,
+		Host:         cmd.Host,
+		WorkDir:      cmd.WorkDir,
+		StdioForward: cmd.StdioForward,
+		Listen:       cmd.Listen,
+		ListenAgent:  cmd.ListenAgent,
+		AgentSocket:  cmd.AgentSocket,
+		Pty:          cmd.Pty,
+		Compression:  cmd.Compression,
+		StdinPipe:    inpipe.Dir,
+		StdoutPipe:   outpipe.Dir,
+		StderrPipe:   errpipe.Dir,
 	}
 
 	// open server pipes
@@ -188,13 +331,6 @@ func RunCmd(
 		return EXIT_FAILURE, err
 	}
 
-	// open client write end
-	inpipef, err := openWritePipe(ctx, inpipe.Dir)
-	if err != nil {
-		return EXIT_FAILURE, err
-	}
-	// inpipef is a writer, so it is closed in ctxCopy
-
 	// Error channels to signal Copy completed
 	inCopyErr := make(chan error)
 	outCopyErr := make(chan error)
@@ -218,13 +354,27 @@ func RunCmd(
 		c <- err
 		close(c)
 	}
-	go ctxCopy(ctx, inCopyErr, inpipef, cmd.Stdin)
-	defer cmd.Stdin.Close()
+	// Like OpenSSH, stdin is not read after the command exits
+	inCtx, inCancel := context.WithCancel(ctx)
+	defer inCancel()
+	if cmd.NoStdin {
+		close(inCopyErr)
+	} else {
+		// open client write end
+		// inpipef is a writer, so it is closed in ctxCopy
+		inpipef, err := openWritePipe(ctx, inpipe.Dir)
+		if err != nil {
+			return EXIT_FAILURE, err
+		}
+		go ctxCopy(inCtx, inCopyErr, inpipef, cmd.Stdin)
+		defer cmd.Stdin.Close()
+	}
 	go ctxCopy(ctx, outCopyErr, cmd.Stdout, outpipef)
 	go ctxCopy(ctx, errCopyErr, cmd.Stderr, errpipef)
 
 	// run Cmd
 	err = cli.Call(ctx, "RpcSsh.Run", c, &exitCode)
+	inCancel()
 
 	// wait for copiers to finish
 	inerr := <-inCopyErr
@@ -233,7 +383,7 @@ func RunCmd(
 	if err != nil {
 		return EXIT_FAILURE, err
 	}
-	if inerr != nil && !os.IsTimeout(inerr) {
+	if inerr != nil && !os.IsTimeout(inerr) && inerr != context.Canceled {
 		err = inerr
 		return
 	}
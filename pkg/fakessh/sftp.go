@@ -0,0 +1,571 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+const (
+	// Name of the subsystem served by the fake ssh with ssh -s
+	SFTPSUBSYSTEM = "sftp"
+
+	// Format of stat -c describing a guest file: the raw mode in hex, the
+	// size, the modification time and the name
+	SFTPSTATFORMAT = "%f %s %Y %n"
+)
+
+// Serve the subsystem named by the command of inv on stdin and stdout
+// (ssh -s), and return an exit code.
+//
+// Only SFTPSUBSYSTEM is known. Its files are transferred with the Upload and
+// Download of the Communicator, and their metadata is read and changed with
+// guest commands, all as the Communicator user. Destination users that
+// commands are switched to are refused.
+func serveSubsystem(
+	ctx context.Context,
+	dir string,
+	inv *Invocation,
+	quiet bool,
+) int {
+	if len(inv.Command) == 0 {
+		diagf(quiet, "You must specify a subsystem to invoke.")
+		return EXIT_FAILURE
+	}
+	if ArgvToSh(inv.Command) != SFTPSUBSYSTEM {
+		diagf(quiet, "subsystem request failed on channel 0")
+		return EXIT_FAILURE
+	}
+
+	h, err := newSftpHandler(ctx, dir, inv.HostName, inv.User)
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	defer h.Close()
+
+	srv := sftp.NewRequestServer(stdioConn{}, sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	})
+	err = srv.Serve()
+	if err != nil && err != io.EOF {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	return 0
+}
+
+// stdin and stdout of the fake ssh as a connection
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdioConn) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdioConn) Close() error {
+	return os.Stdin.Close()
+}
+
+// Handlers of the SFTP requests of a fake ssh
+type sftpHandler struct {
+	ctx context.Context
+	// Working directory of the fake ssh server
+	dir string
+	cmd Cmd
+	// Home directory of the Communicator user, which relative paths start
+	// from
+	home string
+	// Local directory of the copies of open files
+	tmpDir string
+	// Files open for writing, by guest path
+	open map[string]*sftpFile
+	L    sync.Mutex
+}
+
+// Make the SFTP handlers for the guest of host and the destination user,
+// through the fake ssh server with working directory dir
+func newSftpHandler(
+	ctx context.Context,
+	dir string,
+	host string,
+	user string,
+) (*sftpHandler, error) {
+	err := PermitTransfer(ctx, dir, &RpcTransfer{Host: host, User: user})
+	if err != nil {
+		return nil, err
+	}
+	// An unknown working directory is passed as the empty string
+	workDir, _ := os.Getwd()
+	h := &sftpHandler{
+		ctx:  ctx,
+		dir:  dir,
+		cmd:  Cmd{User: user, Host: host, WorkDir: workDir},
+		open: make(map[string]*sftpFile),
+	}
+	home, err := h.run(`printf '%s' "$HOME"`)
+	if err != nil {
+		return nil, err
+	}
+	h.home = path.Clean("/" + home)
+	h.tmpDir, err = ioutil.TempDir("", "fakessh-sftp")
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Remove the local copies of files
+func (h *sftpHandler) Close() error {
+	return os.RemoveAll(h.tmpDir)
+}
+
+// Run command on the guest and return its stdout.
+//
+// Errors are translated to SFTP status codes when their message is known.
+func (h *sftpHandler) run(command string) (string, error) {
+	cmd := h.cmd
+	cmd.Command = command
+	out, err := guestOutput(h.ctx, h.dir, cmd)
+	err = gnuStatError(err)
+	if gerr, ok := err.(*guestError); ok {
+		switch {
+		case strings.Contains(gerr.Stderr, "No such file or directory"):
+			return out, sftp.ErrSSHFxNoSuchFile
+		case strings.Contains(gerr.Stderr, "Permission denied"):
+			return out, sftp.ErrSSHFxPermissionDenied
+		}
+	}
+	return out, err
+}
+
+// Get a file open for writing at p
+func (h *sftpHandler) openFile(p string) (*sftpFile, bool) {
+	h.L.Lock()
+	defer h.L.Unlock()
+	f, ok := h.open[p]
+	return f, ok
+}
+
+// Resolve p against the home directory of the Communicator user
+func (h *sftpHandler) RealPath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(h.home, p)
+	}
+	return path.Clean(p)
+}
+
+// Copy a guest file to open it for reading
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return h.openCopy(r.Filepath, sftp.FileOpenFlags{Read: true})
+}
+
+// Copy a guest file to open it for writing. It is uploaded when closed.
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openCopy(r.Filepath, r.Pflags())
+}
+
+// Copy a guest file to open it for reading and writing. It is uploaded
+// when closed.
+func (h *sftpHandler) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openCopy(r.Filepath, r.Pflags())
+}
+
+// Make a local copy of the guest file p opened with flags.
+//
+// New files get permissions 0644, and existing files keep theirs. The
+// guest file is only downloaded if its content is kept.
+func (h *sftpHandler) openCopy(
+	p string,
+	flags sftp.FileOpenFlags,
+) (*sftpFile, error) {
+	write := flags.Write || flags.Append || flags.Creat || flags.Trunc
+	fi, err := h.stat(p, true)
+	exists := err == nil
+	if err != nil && err != sftp.ErrSSHFxNoSuchFile {
+		return nil, err
+	}
+	switch {
+	case !exists && !(write && flags.Creat):
+		return nil, sftp.ErrSSHFxNoSuchFile
+	case exists && write && flags.Creat && flags.Excl:
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	case exists && fi.IsDir():
+		return nil, fmt.Errorf("%s: Is a directory", p)
+	}
+
+	tmp, err := ioutil.TempFile(h.tmpDir, path.Base(p))
+	if err != nil {
+		return nil, err
+	}
+	f := &sftpFile{File: tmp, h: h, remote: p, upload: write}
+	var mode os.FileMode = 0644
+	if exists {
+		mode = fi.Mode().Perm()
+	}
+	err = tmp.Chmod(mode)
+	if err == nil && exists && !flags.Trunc {
+		err = DownloadFile(h.ctx, h.dir, &RpcTransfer{
+			Host:   h.cmd.Host,
+			User:   h.cmd.User,
+			Remote: p,
+			Local:  tmp.Name(),
+		})
+	}
+	if err != nil {
+		f.remove()
+		return nil, err
+	}
+	if write {
+		h.L.Lock()
+		h.open[p] = f
+		h.L.Unlock()
+	}
+	return f, nil
+}
+
+// Change a guest file with a guest command
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	p := ShellQuote(r.Filepath)
+	target := ShellQuote(r.Target)
+	var err error
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r)
+	case "Rename":
+		// Like sftp-server, do not replace existing files
+		_, err = h.run(fmt.Sprintf(
+			`if [ -e %[2]s ] || [ -L %[2]s ]; then `+
+				`echo %[2]s: File exists >&2; exit 1; fi; mv -- %[1]s %[2]s`,
+			p, target,
+		))
+	case "Rmdir":
+		_, err = h.run("rmdir -- " + p)
+	case "Mkdir":
+		_, err = h.run("mkdir -- " + p)
+	case "Remove":
+		_, err = h.run("rm -- " + p)
+	case "Symlink":
+		_, err = h.run("ln -s -- " + p + " " + target)
+	case "Link":
+		_, err = h.run("ln -- " + p + " " + target)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	return err
+}
+
+// Rename a guest file, replacing the target (posix-rename@openssh.com)
+func (h *sftpHandler) PosixRename(r *sftp.Request) error {
+	_, err := h.run(
+		"mv -f -- " + ShellQuote(r.Filepath) + " " + ShellQuote(r.Target))
+	return err
+}
+
+// Change the attributes of a guest file.
+//
+// Attributes of a file open for writing change its local copy, or are set
+// once it is uploaded.
+func (h *sftpHandler) setstat(r *sftp.Request) error {
+	flags := r.AttrFlags()
+	attrs := r.Attributes()
+	if f, ok := h.openFile(r.Filepath); ok {
+		if flags.Size {
+			if err := f.Truncate(int64(attrs.Size)); err != nil {
+				return err
+			}
+		}
+		if flags.Permissions {
+			if err := f.Chmod(attrs.FileMode().Perm()); err != nil {
+				return err
+			}
+		}
+		flags.Size = false
+		f.L.Lock()
+		f.setstat = append(f.setstat, sftpAttrs{flags, attrs})
+		f.L.Unlock()
+		return nil
+	}
+	command := setstatCommand(r.Filepath, flags, attrs)
+	if command == "" {
+		return nil
+	}
+	_, err := h.run(command)
+	return err
+}
+
+// Attributes set on a file
+type sftpAttrs struct {
+	Flags sftp.FileAttrFlags
+	Attrs *sftp.FileStat
+}
+
+// Get a guest command setting the attributes of flags to attrs on the file
+// p, or "" if there are none
+func setstatCommand(
+	p string,
+	flags sftp.FileAttrFlags,
+	attrs *sftp.FileStat,
+) string {
+	q := ShellQuote(p)
+	commands := []string{}
+	if flags.Size {
+		commands = append(commands,
+			fmt.Sprintf("truncate -s %d -- %s", attrs.Size, q))
+	}
+	if flags.UidGid {
+		commands = append(commands,
+			fmt.Sprintf("chown %d:%d -- %s", attrs.UID, attrs.GID, q))
+	}
+	if flags.Permissions {
+		commands = append(commands,
+			fmt.Sprintf("chmod %o -- %s", attrs.Mode&07777, q))
+	}
+	if flags.Acmodtime {
+		commands = append(commands,
+			touchCommand('a', time.Unix(int64(attrs.Atime), 0), p),
+			touchCommand('m', time.Unix(int64(attrs.Mtime), 0), p),
+		)
+	}
+	return strings.Join(commands, " && ")
+}
+
+// List a guest directory, or stat or read the link of a guest file
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		out, err := h.run(fmt.Sprintf(
+			`if ! [ -d %[1]s ]; then stat -L -- %[1]s >/dev/null || exit 1; `+
+				`echo %[1]s: Not a directory >&2; exit 1; fi; `+
+				`cd -- %[1]s && for f in * .[!.]* ..?*; do `+
+				`if [ -e "$f" ] || [ -L "$f" ]; then `+
+				`stat -c '%[2]s' -- "$f" || exit 1; fi; done`,
+			ShellQuote(r.Filepath), SFTPSTATFORMAT,
+		))
+		if err != nil {
+			return nil, err
+		}
+		return parseStatLines(out)
+	case "Stat":
+		fi, err := h.stat(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{fi}, nil
+	case "Readlink":
+		out, err := h.run("readlink -- " + ShellQuote(r.Filepath))
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{&guestFileInfo{
+			name: strings.TrimSuffix(out, "\n"),
+		}}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+// Stat a guest file without following symbolic links
+func (h *sftpHandler) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fi, err := h.stat(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{fi}, nil
+}
+
+// Stat the guest file p, following symbolic links if follow is set.
+//
+// A file open for writing is described by its local copy.
+func (h *sftpHandler) stat(p string, follow bool) (os.FileInfo, error) {
+	if f, ok := h.openFile(p); ok {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return &guestFileInfo{
+			name:  path.Base(p),
+			size:  fi.Size(),
+			mode:  fi.Mode(),
+			mtime: fi.ModTime(),
+		}, nil
+	}
+
+	flag := ""
+	if follow {
+		flag = "-L "
+	}
+	out, err := h.run(fmt.Sprintf(
+		"stat %s-c '%s' -- %s", flag, SFTPSTATFORMAT, ShellQuote(p)))
+	if err != nil {
+		return nil, err
+	}
+	list, err := parseStatLines(out)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) != 1 {
+		return nil, fmt.Errorf("bad stat output %q", out)
+	}
+	fi := list[0].(*guestFileInfo)
+	fi.name = path.Base(p)
+	return fi, nil
+}
+
+// Parse lines of stat output in SFTPSTATFORMAT
+func parseStatLines(out string) (listerAt, error) {
+	list := listerAt{}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("bad stat output %q", line)
+		}
+		mode, err := strconv.ParseUint(fields[0], 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		mtime, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &guestFileInfo{
+			name:  fields[3],
+			size:  size,
+			mode:  guestFileMode(uint32(mode)),
+			mtime: time.Unix(mtime, 0),
+		})
+	}
+	return list, nil
+}
+
+// Convert a raw guest st_mode to an os.FileMode
+func guestFileMode(raw uint32) os.FileMode {
+	mode := os.FileMode(raw & 0777)
+	switch raw & 0170000 {
+	case 0040000:
+		mode |= os.ModeDir
+	case 0120000:
+		mode |= os.ModeSymlink
+	case 0010000:
+		mode |= os.ModeNamedPipe
+	case 0140000:
+		mode |= os.ModeSocket
+	case 0020000:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case 0060000:
+		mode |= os.ModeDevice
+	}
+	if raw&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if raw&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if raw&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// A guest file described by stat
+type guestFileInfo struct {
+	name  string
+	size  int64
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (fi *guestFileInfo) Name() string       { return fi.name }
+func (fi *guestFileInfo) Size() int64        { return fi.size }
+func (fi *guestFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *guestFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi *guestFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *guestFileInfo) Sys() interface{}   { return nil }
+
+// Files listed for an SFTP request
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// The local copy of an open guest file
+type sftpFile struct {
+	*os.File
+	h      *sftpHandler
+	remote string
+	// Upload the copy when it is closed
+	upload bool
+	// Attributes to set once the copy is uploaded
+	setstat []sftpAttrs
+	L       sync.Mutex
+}
+
+// Upload the copy if it was opened for writing, and remove it
+func (f *sftpFile) Close() error {
+	if !f.upload {
+		return f.remove()
+	}
+
+	f.h.L.Lock()
+	delete(f.h.open, f.remote)
+	f.h.L.Unlock()
+
+	err := UploadFile(f.h.ctx, f.h.dir, &RpcTransfer{
+		Host:   f.h.cmd.Host,
+		User:   f.h.cmd.User,
+		Remote: f.remote,
+		Local:  f.Name(),
+	})
+	f.L.Lock()
+	for _, a := range f.setstat {
+		command := setstatCommand(f.remote, a.Flags, a.Attrs)
+		if err != nil || command == "" {
+			continue
+		}
+		_, err = f.h.run(command)
+	}
+	f.L.Unlock()
+	rerr := f.remove()
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+func (f *sftpFile) remove() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
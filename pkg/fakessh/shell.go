@@ -0,0 +1,130 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"sort"
+	"strings"
+)
+
+// Quote s so a POSIX shell reads it as a single word
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Split a simple POSIX shell command into words.
+//
+// Words may be quoted with single or double quotes or escaped with a
+// backslash. The second result is false if command uses expansions,
+// redirections, globs or other shell features that need a shell.
+func ShellSplit(command string) ([]string, bool) {
+	words := []string{}
+	b := strings.Builder{}
+	inWord := false
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, b.String())
+				b.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 >= len(command) || command[i+1] == '\n' {
+				return nil, false
+			}
+			i++
+			b.WriteByte(command[i])
+			inWord = true
+		case c == '\'':
+			k := strings.IndexByte(command[i+1:], '\'')
+			if k < 0 {
+				return nil, false
+			}
+			b.WriteString(command[i+1 : i+1+k])
+			i += k + 1
+			inWord = true
+		case c == '"':
+			i++
+			for ; i < len(command) && command[i] != '"'; i++ {
+				switch command[i] {
+				case '$', '`':
+					return nil, false
+				case '\\':
+					if i+1 < len(command) &&
+						strings.IndexByte("$`\"\\", command[i+1]) >= 0 {
+						i++
+					}
+				}
+				b.WriteByte(command[i])
+			}
+			if i >= len(command) {
+				return nil, false
+			}
+			inWord = true
+		case strings.IndexByte("|&;<>()$`*?[\n", c) >= 0:
+			return nil, false
+		case !inWord && (c == '#' || c == '~'):
+			return nil, false
+		case c == '=' && len(words) == 0:
+			// An assignment before the command
+			return nil, false
+		default:
+			b.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, b.String())
+	}
+	return words, true
+}
+
+// Check if name is a valid POSIX shell variable name
+func isShellName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_':
+		case 'a' <= c && c <= 'z':
+		case 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Convert env into sorted POSIX shell assignments like NAME='value'.
+//
+// env is a slice of variable assignments like the output of `os.Environ()`.
+// Assignments with names that are not valid shell variable names are dropped.
+func ShellAssignments(env []string) []string {
+	assigns := make([]string, 0, len(env))
+	for _, set := range env {
+		ss := strings.SplitN(set, "=", 2)
+		if len(ss) < 2 || !isShellName(ss[0]) {
+			continue
+		}
+		assigns = append(assigns, ss[0]+"="+ShellQuote(ss[1]))
+	}
+	sort.Strings(assigns)
+	return assigns
+}
+
+// Prefix a POSIX shell command with exports of the variables in env.
+//
+// Variables are exported as converted by ShellAssignments.
+func EnvCommand(env []string, command string) string {
+	exports := ShellAssignments(env)
+	if len(exports) == 0 {
+		return command
+	}
+	return "export " + strings.Join(exports, " ") + "; " + command
+}
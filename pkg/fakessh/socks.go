@@ -0,0 +1,197 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	// Versions of the SOCKS protocol
+	SOCKS4 = 4
+	SOCKS5 = 5
+	// The only SOCKS command accepted
+	SOCKSCONNECT = 1
+	// Longest user id or host name accepted in a SOCKS4 request
+	SOCKS4MAXSTRING = 255
+)
+
+// SOCKS5 address types
+const (
+	socks5IPv4   = 1
+	socks5Domain = 3
+	socks5IPv6   = 4
+)
+
+// SOCKS5 authentication methods
+const (
+	socks5NoAuth       = 0
+	socks5NoAcceptable = 0xff
+)
+
+// SOCKS5 reply codes
+const (
+	socks5Succeeded          = 0
+	socks5CommandUnsupported = 7
+	socks5AddressUnsupported = 8
+)
+
+// SOCKS4 reply codes
+const (
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+)
+
+// Read a SOCKS4, SOCKS4a or SOCKS5 CONNECT request from conn and return the
+// target it requests.
+//
+// Like OpenSSH, no authentication is offered. Since the guest connects to
+// the target only once the connection is relayed, the request is granted
+// before the target is reached, and a failed connection is seen as a
+// closed one.
+func socksConnect(conn io.ReadWriter) (HostPort, error) {
+	version := []byte{0}
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return HostPort{}, err
+	}
+	switch version[0] {
+	case SOCKS4:
+		return socks4Connect(conn)
+	case SOCKS5:
+		return socks5Connect(conn)
+	}
+	return HostPort{}, fmt.Errorf("unsupported SOCKS version %d", version[0])
+}
+
+// Answer a SOCKS4 or SOCKS4a request after its version
+func socks4Connect(conn io.ReadWriter) (HostPort, error) {
+	// command, port and IPv4 address
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return HostPort{}, err
+	}
+	// The user id is ignored
+	if _, err := readCString(conn); err != nil {
+		return HostPort{}, err
+	}
+	port := int(binary.BigEndian.Uint16(header[1:3]))
+	ip := net.IP(header[3:7])
+	host := ip.String()
+	// SOCKS4a sends an invalid address 0.0.0.x followed by a host name
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		name, err := readCString(conn)
+		if err != nil {
+			return HostPort{}, err
+		}
+		host = name
+	}
+
+	reply := []byte{0, socks4Granted, 0, 0, 0, 0, 0, 0}
+	if header[0] != SOCKSCONNECT || port == 0 || host == "" {
+		reply[1] = socks4Rejected
+		conn.Write(reply)
+		return HostPort{}, fmt.Errorf("unsupported SOCKS4 request")
+	}
+	if _, err := conn.Write(reply); err != nil {
+		return HostPort{}, err
+	}
+	return HostPort{Host: host, Port: port}, nil
+}
+
+// Answer a SOCKS5 greeting and request after the version of the greeting
+func socks5Connect(conn io.ReadWriter) (HostPort, error) {
+	count := []byte{0}
+	if _, err := io.ReadFull(conn, count); err != nil {
+		return HostPort{}, err
+	}
+	methods := make([]byte, count[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return HostPort{}, err
+	}
+	if bytes.IndexByte(methods, socks5NoAuth) < 0 {
+		conn.Write([]byte{SOCKS5, socks5NoAcceptable})
+		return HostPort{}, errors.New("no acceptable SOCKS5 authentication")
+	}
+	if _, err := conn.Write([]byte{SOCKS5, socks5NoAuth}); err != nil {
+		return HostPort{}, err
+	}
+
+	// version, command, reserved and address type
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return HostPort{}, err
+	}
+	if header[0] != SOCKS5 {
+		return HostPort{}, fmt.Errorf("bad SOCKS5 request version %d", header[0])
+	}
+	host := ""
+	switch header[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socks5IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return HostPort{}, err
+		}
+		host = ip.String()
+	case socks5Domain:
+		length := []byte{0}
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return HostPort{}, err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return HostPort{}, err
+		}
+		host = string(name)
+	default:
+		socks5Reply(conn, socks5AddressUnsupported)
+		return HostPort{}, fmt.Errorf(
+			"unsupported SOCKS5 address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return HostPort{}, err
+	}
+
+	if header[1] != SOCKSCONNECT {
+		socks5Reply(conn, socks5CommandUnsupported)
+		return HostPort{}, fmt.Errorf("unsupported SOCKS5 command %d", header[1])
+	}
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		return HostPort{}, err
+	}
+	return HostPort{Host: host, Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+// Send a SOCKS5 reply with an unspecified bound address
+func socks5Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{SOCKS5, code, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// Read a NUL terminated string of at most SOCKS4MAXSTRING bytes
+func readCString(r io.Reader) (string, error) {
+	s := []byte{}
+	c := []byte{0}
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", err
+		}
+		if c[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) == SOCKS4MAXSTRING {
+			return "", errors.New("SOCKS4 string too long")
+		}
+		s = append(s, c[0])
+	}
+}
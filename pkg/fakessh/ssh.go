@@ -6,8 +6,14 @@ package fakessh
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // The fake ssh command
@@ -34,28 +40,242 @@ func Ssh() int {
 		return
 	}()
 
+	inv, err := ParseArgs(os.Args)
+	quiet := inv.Flag('q')
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+
+	if inv.Host == "" {
+		if inv.Flag('V') {
+			fmt.Fprintln(os.Stderr, SSHVERSION)
+			return 0
+		}
+		diagf(quiet, "no destination given")
+		return EXIT_FAILURE
+	}
+
+	// Without the provisioner, ssh -G and -V are still answered
 	rpcDir, envSet := os.LookupEnv(RPCDirEnvVarName)
-	if !envSet {
+	if !envSet && !inv.Flag('G') && !inv.Flag('V') {
+		diagf(quiet, "%s is not set", RPCDirEnvVarName)
+		return EXIT_FAILURE
+	}
+
+	// Pass-through is decided before -G, -V and Match exec commands, so the
+	// real ssh prints its own configuration and version and runs the
+	// commands only once
+	if envSet {
+		hostName, err := inv.PeekHostName()
+		if err == nil {
+			handled, err := HandlesHost(dctx, rpcDir, hostName)
+			if err != nil {
+				diagf(quiet, "%s", err)
+				return EXIT_FAILURE
+			}
+			if !handled {
+				return passThrough(quiet)
+			}
+		}
+	}
+
+	if inv.Flag('V') {
+		fmt.Fprintln(os.Stderr, SSHVERSION)
+		return 0
+	}
+
+	err = inv.ReadConfig()
+	if err != nil {
+		diagf(quiet, "%s", err)
 		return EXIT_FAILURE
 	}
 
-	sshCmd := ArgvToSh(ParseCmd(os.Args))
+	if inv.Flag('G') {
+		err = inv.DumpConfig(os.Stdout)
+		if err != nil {
+			diagf(quiet, "%s", err)
+			return EXIT_FAILURE
+		}
+		return 0
+	}
 
-	if len(sshCmd) == 0 {
+	if logLevel, ok := inv.Option("LogLevel"); ok {
+		quiet = quiet || strings.EqualFold(logLevel, "QUIET")
+	}
+
+	// Multiplex commands are answered locally, even with a jump host
+	if hops := inv.ProxyJump(); len(hops) > 0 && !inv.Flag('O') {
+		return jumpCommand(dctx, rpcDir, inv, hops, quiet)
+	}
+
+	if op, ok := inv.FlagArg('O'); ok {
+		return controlCommand(dctx, rpcDir, inv, op, quiet)
+	}
+
+	master, err := startMaster(dctx, rpcDir, inv, quiet)
+	if err != nil {
+		diagf(quiet, "%s", err)
 		return EXIT_FAILURE
 	}
+	if master != nil {
+		defer master.Close()
+		// The server keeps the session, so a background master (-f -N)
+		// has nothing left to do and persists until it is stopped.
+		if inv.Flag('f') && inv.Flag('N') &&
+			len(inv.LocalForwards) == 0 && len(inv.RemoteForwards) == 0 &&
+			len(inv.DynamicForwards) == 0 {
+			master.persist = 0
+			return 0
+		}
+	}
+
+	forwarder, err := startLocalForwards(dctx, rpcDir, inv, quiet)
+	if err != nil {
+		diagf(quiet, "%s", err)
+		return EXIT_FAILURE
+	}
+	defer forwarder.Close()
+	remoteForwarder, err := startRemoteForwards(dctx, rpcDir, inv, quiet)
+	if err != nil {
+		if dctx.Err() == nil {
+			diagf(quiet, "%s", err)
+		}
+		return EXIT_FAILURE
+	}
+	defer remoteForwarder.Close()
+
+	if inv.Flag('s') {
+		return serveSubsystem(dctx, rpcDir, inv, quiet)
+	}
+
+	// An unknown working directory is passed as the empty string
+	workDir, _ := os.Getwd()
 
 	cmd := &Cmd{
-		Command: sshCmd,
-		Stdin:   os.Stdin,
-		Stdout:  os.Stdout,
-		Stderr:  os.Stderr,
+		NoStdin:      inv.Flag('n'),
+		NoCommand:    inv.Flag('N') && inv.StdioForward == nil,
+		Env:          inv.Env(os.Environ()),
+		User:         inv.User,
+		Host:         inv.HostName,
+		WorkDir:      workDir,
+		StdioForward: inv.StdioForward,
+		Compression:  inv.Compression(),
+		Stdin:        os.Stdin,
+		Stdout:       os.Stdout,
+		Stderr:       noCloseFile{os.Stderr},
+	}
+	// Keep stdin open if it is not read. Otherwise a forwarded connection
+	// could reuse its descriptor, and writes to it would raise SIGPIPE.
+	if cmd.NoStdin || cmd.NoCommand {
+		cmd.Stdin = nil
+	}
+
+	// Without a command, the server starts a login shell reading stdin.
+	// Like OpenSSH, the command is ignored with -W.
+	if !cmd.NoCommand && cmd.StdioForward == nil {
+		cmd.Command = ArgvToSh(inv.Command)
+
+		// The rsync client needs rsync on the guest, or the local rsync
+		// running on copies of the guest files
+		if r := ParseRsyncServer(cmd.Command); r != nil && cmd.Stdin != nil {
+			found, err := guestHasRsync(dctx, rpcDir, cmd)
+			if err != nil {
+				diagf(quiet, "%s", err)
+				return EXIT_FAILURE
+			}
+			if !found {
+				return emulateRsyncServer(dctx, rpcDir, cmd, r, quiet)
+			}
+		}
+
+		agent, err := startAgentForward(dctx, rpcDir, inv, Cmd{
+			User:    cmd.User,
+			Host:    cmd.Host,
+			WorkDir: cmd.WorkDir,
+		})
+		if err != nil {
+			diagf(quiet, "%s", err)
+			return EXIT_FAILURE
+		}
+		if agent != nil {
+			defer agent.Close()
+			cmd.AgentSocket = agent.Path
+		}
+
+		tty, warn := inv.RequestTTY(terminal.IsTerminal(int(os.Stdin.Fd())))
+		if warn != "" {
+			diagf(quiet, "%s", warn)
+		}
+		if tty {
+			pty, err := startPty(dctx, rpcDir, cmd)
+			if err != nil {
+				diagf(quiet, "%s", err)
+				return EXIT_FAILURE
+			}
+			defer pty.Close()
+		}
+	}
+
+	if cmd.Stdin == os.Stdin {
+		cmd.Stdin, err = pollableStdin()
+		if err != nil {
+			diagf(quiet, "%s", err)
+			return EXIT_FAILURE
+		}
 	}
 
 	exitCode, err := RunCmd(dctx, rpcDir, cmd)
 	if err != nil {
+		if dctx.Err() == nil {
+			diagf(quiet, "%s", err)
+		}
 		return EXIT_FAILURE
 	} else {
 		return exitCode
 	}
 }
+
+// Print a diagnostic message to stderr unless quiet (ssh -q) is set
+func diagf(quiet bool, format string, a ...interface{}) {
+	if quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "ssh: "+format+"\n", a...)
+}
+
+// Return stdin if its reads can be interrupted, or a pipe copied from stdin
+// otherwise. Like OpenSSH, the fake ssh then exits with the command, even if
+// the process writing stdin waits for that before closing it.
+//
+// Unlike making stdin non-blocking, this does not change the terminal or pipe
+// shared with the caller.
+func pollableStdin() (*os.File, error) {
+	if os.Stdin.SetReadDeadline(time.Time{}) == nil {
+		return os.Stdin, nil
+	}
+	// Reads of regular files do not block
+	fi, err := os.Stdin.Stat()
+	if err == nil && fi.Mode().IsRegular() {
+		return os.Stdin, nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		io.Copy(pw, os.Stdin)
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// A file that RunCmd can not close, so diagnostics can be printed after it
+// returns
+type noCloseFile struct {
+	*os.File
+}
+
+func (f noCloseFile) Close() error {
+	return nil
+}
@@ -0,0 +1,373 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Maximum depth of nested Include directives, like OpenSSH
+	MAXINCLUDEDEPTH = 16
+)
+
+// An error in an ssh_config file
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s line %d: %s", e.File, e.Line, e.Msg)
+}
+
+// Read the ssh_config file passed with -F, or the user and system files, and
+// add their options to inv.
+//
+// Like OpenSSH, options apply if they are outside of a Host or Match block or
+// if the block matches, and the first value obtained for an option is the one
+// used. Options on the command line come first. Afterwards, HostName is
+// resolved and RemoteCommand is used if no command was given.
+func (inv *Invocation) ReadConfig() error {
+	if path, ok := inv.FlagArg('F'); ok {
+		if !strings.EqualFold(path, "none") {
+			err := inv.readConfigFile(expandHome(path), false, true, 0)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path := filepath.Join(home, ".ssh", "config")
+			err = inv.readConfigFile(path, false, false, 0)
+			if err != nil {
+				return err
+			}
+		}
+		err = inv.readConfigFile(SYSTEMSSHCONFIG, true, false, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	inv.HostName = inv.currentHostName()
+
+	if command, ok := inv.Option("RemoteCommand"); ok &&
+		!strings.EqualFold(command, "none") && !inv.Flag('N') &&
+		inv.StdioForward == nil {
+		if len(inv.Command) > 0 {
+			return &UsageError{Msg: "Cannot execute command-line and remote command."}
+		}
+		inv.Command = []string{inv.expandTokens(command)}
+	}
+	return nil
+}
+
+// Resolve HostName from the ssh_config files like ReadConfig, without
+// running the commands of Match exec criteria. With ProxyJump, the host name
+// of the first jump host is returned, since it is the host connected to.
+//
+// Lines with an exec criterion do not match. inv is not modified.
+func (inv *Invocation) PeekHostName() (string, error) {
+	peek := *inv
+	peek.Options = append([]Option(nil), inv.Options...)
+	peek.skipExec = true
+	err := peek.ReadConfig()
+	if err != nil {
+		return "", err
+	}
+	if hops := peek.ProxyJump(); len(hops) > 0 {
+		jump, err := peek.JumpInvocation(hops[0])
+		if err != nil {
+			return "", err
+		}
+		return jump.HostName, nil
+	}
+	return peek.HostName, nil
+}
+
+// Read the ssh_config file at path.
+//
+// Relative Include paths are resolved in the directory of the system config
+// if system is set, and in ~/.ssh otherwise. A missing file is not an error
+// unless required is set.
+func (inv *Invocation) readConfigFile(
+	path string,
+	system bool,
+	required bool,
+	depth int,
+) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if !required && os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Can't open user config file %s: %s", path, err)
+	}
+	defer f.Close()
+
+	active := true
+	lineNum := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		configErr := func(format string, a ...interface{}) error {
+			return &ConfigError{
+				File: path,
+				Line: lineNum,
+				Msg:  fmt.Sprintf(format, a...),
+			}
+		}
+
+		key, value, err := parseOption(line)
+		if err != nil {
+			return configErr("%s", err)
+		}
+		args := splitConfigArgs(value)
+
+		switch strings.ToLower(key) {
+		case "host":
+			active = MatchPatternList(
+				strings.ToLower(inv.Host),
+				splitConfigArgs(strings.ToLower(value)),
+			)
+		case "match":
+			active, err = inv.matchConfig(args)
+			if err != nil {
+				return configErr("%s", err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			if depth >= MAXINCLUDEDEPTH {
+				return configErr("Include nesting depth exceeded")
+			}
+			if len(args) == 0 {
+				return configErr("Include requires an argument")
+			}
+			for _, arg := range args {
+				err = inv.readInclude(arg, system, depth)
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			if !active {
+				continue
+			}
+			err = inv.addOption(key, value)
+			if err != nil {
+				return configErr("%s", err)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Read the ssh_config files matching the glob pattern of an Include directive
+func (inv *Invocation) readInclude(pattern string, system bool, depth int) error {
+	pattern = expandHome(pattern)
+	if !filepath.IsAbs(pattern) {
+		if system {
+			pattern = filepath.Join(filepath.Dir(SYSTEMSSHCONFIG), pattern)
+		} else if home, err := os.UserHomeDir(); err == nil {
+			pattern = filepath.Join(home, ".ssh", pattern)
+		}
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = inv.readConfigFile(path, system, false, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check if the criteria of a Match line match inv.
+//
+// Canonicalization is never done, so canonical never matches, and final
+// always matches since the config is only read once.
+func (inv *Invocation) matchConfig(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, fmt.Errorf("Missing Match criteria")
+	}
+	matched := true
+	for i := 0; i < len(args); i++ {
+		criterion := strings.ToLower(args[i])
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var ok bool
+		switch criterion {
+		case "all":
+			afterFinal := i == 1 && len(args) == 2 &&
+				(strings.EqualFold(args[0], "canonical") ||
+					strings.EqualFold(args[0], "final"))
+			if len(args) > 1 && !afterFinal {
+				return false, fmt.Errorf(
+					"Match all must appear alone or after canonical/final")
+			}
+			ok = true
+		case "canonical":
+			ok = false
+		case "final":
+			ok = true
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return false, fmt.Errorf(
+					"Missing Match criteria for %s", criterion)
+			}
+			i++
+			arg := args[i]
+			patterns := strings.Split(arg, ",")
+			hostPatterns := strings.Split(strings.ToLower(arg), ",")
+			switch criterion {
+			case "host":
+				ok = MatchPatternList(
+					strings.ToLower(inv.currentHostName()), hostPatterns)
+			case "originalhost":
+				ok = MatchPatternList(strings.ToLower(inv.Host), hostPatterns)
+			case "user":
+				ok = MatchPatternList(inv.remoteUser(), patterns)
+			case "localuser":
+				ok = MatchPatternList(localUser(), patterns)
+			case "exec":
+				if inv.skipExec {
+					matched = false
+					continue
+				}
+				cmd := exec.Command("/bin/sh", "-c", inv.expandTokens(arg))
+				cmd.Stderr = os.Stderr
+				ok = cmd.Run() == nil
+			}
+		default:
+			return false, fmt.Errorf(
+				"Unsupported Match attribute %s", criterion)
+		}
+		if ok == negate {
+			matched = false
+		}
+	}
+	return matched, nil
+}
+
+// The HostName obtained so far, or the host of the destination
+func (inv *Invocation) currentHostName() string {
+	hostName, ok := inv.Option("HostName")
+	if !ok {
+		return inv.Host
+	}
+	args := splitConfigArgs(hostName)
+	if len(args) == 0 {
+		return inv.Host
+	}
+	return percentExpand(args[0], map[byte]string{'h': inv.Host})
+}
+
+// The user obtained so far, or the local user
+func (inv *Invocation) remoteUser() string {
+	if inv.User != "" {
+		return inv.User
+	}
+	return localUser()
+}
+
+// Expand the percent tokens of ssh_config in s.
+//
+// %h is the host name, %n the original host, %p the port, %r the remote
+// user, %u the local user, %d the local home directory, %l and %L the local
+// host name with and without its domain, and %C a hash of %l%h%p%r.
+func (inv *Invocation) expandTokens(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	port := inv.Port
+	if port == 0 {
+		port = 22
+	}
+	home, _ := os.UserHomeDir()
+	local, _ := os.Hostname()
+	shortLocal := local
+	if k := strings.IndexByte(local, '.'); k >= 0 {
+		shortLocal = local[:k]
+	}
+	hostName := inv.currentHostName()
+	hash := sha1.Sum([]byte(
+		local + hostName + strconv.Itoa(port) + inv.remoteUser()))
+	return percentExpand(s, map[byte]string{
+		'h': hostName,
+		'n': inv.Host,
+		'p': strconv.Itoa(port),
+		'r': inv.remoteUser(),
+		'u': localUser(),
+		'd': home,
+		'l': local,
+		'L': shortLocal,
+		'C': hex.EncodeToString(hash[:]),
+	})
+}
+
+// Replace each %c in s with tokens[c] and %% with '%'.
+// Unknown tokens are kept.
+func percentExpand(s string, tokens map[byte]string) string {
+	b := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if s[i] == '%' {
+			b.WriteByte('%')
+		} else if v, ok := tokens[s[i]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// The name of the local user, or the empty string if it is unknown
+func localUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+// Expand a leading ~ to the home directory of the local user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
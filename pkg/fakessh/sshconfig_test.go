@@ -0,0 +1,426 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+const testSshConfig = `# global options
+SendEnv LANG
+
+Host build vm
+    HostName 192.0.2.10
+    User packer
+    Port 2222
+    SetEnv NIX_PATH=nixpkgs=/nix
+
+Host *.internal !secret.internal
+    User deploy
+
+Host vm
+    User other
+    HostName 192.0.2.99
+
+Host alias
+    HostName %h.example.com
+
+Match originalhost alias host alias.example.com
+    RemoteCommand echo %r@%h:%p
+
+Match !all
+    User never
+
+Match exec "test %n = execd"
+    User exec-user
+
+Match all
+Include INCLUDE
+
+Host *
+    User default
+`
+
+const testSshConfigInclude = `Host inc
+    User included
+    Port 2200
+`
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakessh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		filepath.Join(dir, "conf.d", "inc.conf"),
+		[]byte(testSshConfigInclude),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(
+		config,
+		[]byte(strings.Replace(
+			testSshConfig, "INCLUDE", filepath.Join(dir, "conf.d", "*"), 1)),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badConfig := filepath.Join(dir, "bad")
+	err = ioutil.WriteFile(badConfig, []byte("Match host\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configTests := []struct {
+		name     string
+		args     []string
+		hostName string
+		user     string
+		port     int
+		command  []string
+		env      []string
+		err      bool
+	}{
+		{
+			name:     "alias",
+			args:     []string{"ssh", "-F", config, "build", "true"},
+			hostName: "192.0.2.10",
+			user:     "packer",
+			port:     2222,
+			command:  []string{"true"},
+			env:      []string{"LANG=C", "NIX_PATH=nixpkgs=/nix"},
+		},
+		{
+			name: "command line first",
+			args: []string{"ssh", "-F", config, "-p", "22",
+				"-o", "SetEnv=A=b", "root@build", "true"},
+			hostName: "192.0.2.10",
+			user:     "root",
+			port:     22,
+			command:  []string{"true"},
+			env:      []string{"A=b", "LANG=C"},
+		},
+		{
+			name:     "first match",
+			args:     []string{"ssh", "-F", config, "vm", "true"},
+			hostName: "192.0.2.10",
+			user:     "packer",
+			port:     2222,
+			command:  []string{"true"},
+			env:      []string{"LANG=C", "NIX_PATH=nixpkgs=/nix"},
+		},
+		{
+			name:     "pattern",
+			args:     []string{"ssh", "-F", config, "DB.internal", "true"},
+			hostName: "DB.internal",
+			user:     "deploy",
+			port:     0,
+			command:  []string{"true"},
+			env:      []string{"LANG=C"},
+		},
+		{
+			name:     "negated pattern",
+			args:     []string{"ssh", "-F", config, "secret.internal", "true"},
+			hostName: "secret.internal",
+			user:     "default",
+			port:     0,
+			command:  []string{"true"},
+			env:      []string{"LANG=C"},
+		},
+		{
+			name:     "match and remote command",
+			args:     []string{"ssh", "-F", config, "alias"},
+			hostName: "alias.example.com",
+			user:     "default",
+			port:     0,
+			command:  []string{"echo default@alias.example.com:22"},
+			env:      []string{"LANG=C"},
+		},
+		{
+			name:     "remote command with -N",
+			args:     []string{"ssh", "-F", config, "-N", "alias"},
+			hostName: "alias.example.com",
+			user:     "default",
+			port:     0,
+			command:  []string{},
+			env:      []string{"LANG=C"},
+		},
+		{
+			name:     "match exec",
+			args:     []string{"ssh", "-F", config, "execd", "true"},
+			hostName: "execd",
+			user:     "exec-user",
+			port:     0,
+			command:  []string{"true"},
+			env:      []string{"LANG=C"},
+		},
+		{
+			name:     "include",
+			args:     []string{"ssh", "-F", config, "inc", "true"},
+			hostName: "inc",
+			user:     "included",
+			port:     2200,
+			command:  []string{"true"},
+			env:      []string{"LANG=C"},
+		},
+		{
+			name:     "no config",
+			args:     []string{"ssh", "-F", "none", "build", "true"},
+			hostName: "build",
+			user:     "",
+			port:     0,
+			command:  []string{"true"},
+			env:      []string{},
+		},
+		{
+			name: "command line and remote command",
+			args: []string{"ssh", "-F", config, "alias", "true"},
+			err:  true,
+		},
+		{
+			name: "missing config",
+			args: []string{"ssh", "-F", filepath.Join(dir, "missing"), "build"},
+			err:  true,
+		},
+		{
+			name: "bad config",
+			args: []string{"ssh", "-F", badConfig, "build"},
+			err:  true,
+		},
+	}
+
+	for i, tt := range configTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = inv.ReadConfig()
+			if tt.err {
+				if err == nil {
+					t.Errorf("expected an error for %#v", tt.args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed for %#v: %s", tt.args, err)
+			}
+
+			env := inv.Env([]string{"LANG=C", "HOME=/home/test"})
+			ok := true
+			ok = ok && inv.HostName == tt.hostName
+			ok = ok && inv.User == tt.user
+			ok = ok && inv.Port == tt.port
+			ok = ok && reflect.DeepEqual(inv.Command, tt.command)
+			ok = ok && reflect.DeepEqual(env, tt.env)
+			if !ok {
+				t.Errorf(
+					"failed for %#v ... (got host name %#v, user %#v, "+
+						"port %d, command %#v, env %#v)",
+					tt.args, inv.HostName, inv.User, inv.Port, inv.Command, env,
+				)
+			}
+		})
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	config, err := ioutil.TempFile("", "fakessh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(config.Name())
+	_, err = config.WriteString(`SendEnv LANG
+Host Build
+    HostName 192.0.2.10
+    IdentityFile ~/.ssh/build
+    ControlPath ~/.ssh/%r@%h:%p
+    Port 2222
+
+Host *
+    User packer
+    Port 22
+`)
+	config.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localUser, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Lines of expected appear in this order, lines of absent do not appear
+	dumpTests := []struct {
+		name     string
+		args     []string
+		expected []string
+		absent   []string
+	}{
+		{
+			name: "config",
+			args: []string{"ssh", "-F", config.Name(), "-G", "build"},
+			expected: []string{
+				"user packer",
+				"hostname 192.0.2.10",
+				"port 2222",
+				"addressfamily any",
+				"controlpath ~/.ssh/%r@%h:%p",
+				"identityfile ~/.ssh/build",
+				"sendenv LANG",
+				"forwardagent no",
+			},
+			absent: []string{"identityfile ~/.ssh/id_rsa"},
+		},
+		{
+			name: "flags first",
+			args: []string{"ssh", "-F", config.Name(), "-G", "-A",
+				"-i", "id", "-S", "none", "-o", "SendEnv=LC_* GIT_PROTOCOL",
+				"-l", "root", "-p", "2200", "build.test"},
+			expected: []string{
+				"user root",
+				"hostname build.test",
+				"port 2200",
+				"controlpath none",
+				"identityfile id",
+				"sendenv LC_*",
+				"sendenv GIT_PROTOCOL",
+				"sendenv LANG",
+				"forwardagent yes",
+			},
+			absent: []string{"forwardagent no"},
+		},
+		{
+			name: "no config",
+			args: []string{"ssh", "-F", "none", "-G", "vm"},
+			expected: []string{
+				"user " + localUser.Username,
+				"hostname vm",
+				"port 22",
+				"addressfamily any",
+				"compression no",
+				"serveraliveinterval 0",
+				"ciphers " + DEFAULTCIPHERS,
+				"hostkeyalgorithms " + DEFAULTKEYTYPES,
+				"loglevel INFO",
+				"identityfile ~/.ssh/id_rsa",
+				"identityfile ~/.ssh/id_xmss",
+				"userknownhostsfile ~/.ssh/known_hosts ~/.ssh/known_hosts2",
+				"canonicalizePermittedcnames none",
+				"streamlocalbindmask 0177",
+			},
+			absent: []string{"sendenv ", "controlpath "},
+		},
+	}
+
+	for i, tt := range dumpTests {
+		t.Run(fmt.Sprintf("%d: %s", i, tt.name), func(t *testing.T) {
+			inv, err := ParseArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = inv.ReadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &strings.Builder{}
+			err = inv.DumpConfig(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(got.String(), "\n")
+			j := 0
+			for _, line := range lines {
+				if j < len(tt.expected) && line == tt.expected[j] {
+					j++
+				}
+				for _, a := range tt.absent {
+					if strings.HasPrefix(line, a) {
+						t.Errorf("failed for %#v ... (unexpected %#v)",
+							tt.args, line)
+					}
+				}
+			}
+			if j < len(tt.expected) {
+				t.Errorf(
+					"failed for %#v ... (expected %#v in order, but got %#v)",
+					tt.args,
+					tt.expected[j],
+					got.String(),
+				)
+			}
+		})
+	}
+}
+
+// Resolve HostName without running Match exec commands
+func TestPeekHostName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakessh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mark := filepath.Join(dir, "mark")
+	config := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(
+		config,
+		[]byte(fmt.Sprintf("Match exec \"touch '%s'\"\n"+
+			"    HostName exec.example\n"+
+			"Host peek\n"+
+			"    HostName peek.example\n", mark)),
+		0644,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inv, err := ParseArgs([]string{"ssh", "-F", config, "peek", "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostName, err := inv.PeekHostName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hostName != "peek.example" || inv.HostName != "" ||
+		len(inv.Options) != 0 {
+		t.Errorf("bad peek: %#v, %#v", hostName, inv)
+	}
+	if _, err := os.Stat(mark); !os.IsNotExist(err) {
+		t.Errorf("Match exec command ran while peeking: %v", err)
+	}
+
+	err = inv.ReadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.HostName != "exec.example" {
+		t.Errorf("bad host name: %#v", inv.HostName)
+	}
+	if _, err := os.Stat(mark); err != nil {
+		t.Errorf("Match exec command did not run: %s", err)
+	}
+}
@@ -0,0 +1,357 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/keegancsmith/rpc"
+)
+
+// RPC argument of the RpcSsh file transfer methods
+//
+// The fake ssh and the server share a file system, so files are passed by
+// their local path.
+type RpcTransfer struct {
+	// Host of the ssh destination, picking the Communicator
+	Host string
+	// User of the ssh destination. Files are copied as the Communicator
+	// user, so users that commands are switched to are refused, like users
+	// that are not permitted.
+	User string
+	// Path on the guest
+	Remote string
+	// Path of a local file or directory read by Upload and UploadDir or
+	// written by Download and DownloadDir
+	Local string
+	// Patterns of files skipped by UploadDir and DownloadDir, passed to the
+	// Communicator
+	Exclude []string
+	// If set, the bytes copied by Upload and Download are reported by
+	// TransferProgress with this ID while the call runs
+	ID string
+}
+
+// Get the Communicator of t.Host, if the files of t may be copied for
+// t.User
+func (ssh *RpcSsh) transferComm(t *RpcTransfer) (packer.Communicator, error) {
+	comm, commUser := ssh.route(t.Host)
+	c := &RpcCmd{User: t.User, Host: t.Host}
+	err := ssh.permitUser(c, commUser)
+	if err != nil {
+		return nil, err
+	}
+	if ssh.switchesUser(c, commUser) {
+		return nil, fmt.Errorf(
+			"files can not be copied as user %q, only as the Communicator user",
+			t.User)
+	}
+	return comm, nil
+}
+
+// Check that the files of t may be copied, before running guest commands
+// for them
+func (ssh *RpcSsh) PermitTransfer(
+	ctx context.Context,
+	t *RpcTransfer,
+	_ *int,
+) error {
+	_, err := ssh.transferComm(t)
+	return err
+}
+
+// Upload the local file t.Local to t.Remote with the Communicator of
+// t.Host.
+//
+// The uploaded file gets the permissions of the local file. The copy fails
+// once ctx is done.
+func (ssh *RpcSsh) Upload(ctx context.Context, t *RpcTransfer, _ *int) error {
+	comm, err := ssh.transferComm(t)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(t.Local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	copied, done := ssh.startTransfer(t.ID)
+	defer done()
+	r := &countingReader{ctx: ctx, r: f, n: copied}
+	return comm.Upload(t.Remote, r, &fi)
+}
+
+// Download t.Remote into the local file t.Local with the Communicator of
+// t.Host.
+//
+// t.Local is truncated or created first. The copy fails once ctx is done.
+func (ssh *RpcSsh) Download(ctx context.Context, t *RpcTransfer, _ *int) error {
+	comm, err := ssh.transferComm(t)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(t.Local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	copied, done := ssh.startTransfer(t.ID)
+	defer done()
+	w := &countingWriter{ctx: ctx, w: f, n: copied}
+	err = comm.Download(t.Remote, w)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// Upload the local directory t.Local to t.Remote with the Communicator of
+// t.Host.
+//
+// Like Communicator.UploadDir, the contents of t.Local are uploaded if it
+// ends with a slash, and the directory itself otherwise.
+// Communicator.UploadDir can not be cancelled, so ctx is only checked
+// before the copy.
+func (ssh *RpcSsh) UploadDir(ctx context.Context, t *RpcTransfer, _ *int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	comm, err := ssh.transferComm(t)
+	if err != nil {
+		return err
+	}
+	return comm.UploadDir(t.Remote, t.Local, t.Exclude)
+}
+
+// Download the guest directory t.Remote into the local directory t.Local
+// with the Communicator of t.Host.
+//
+// Like UploadDir, ctx is only checked before the copy.
+func (ssh *RpcSsh) DownloadDir(
+	ctx context.Context,
+	t *RpcTransfer,
+	_ *int,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	comm, err := ssh.transferComm(t)
+	if err != nil {
+		return err
+	}
+	return comm.DownloadDir(t.Remote, t.Local, t.Exclude)
+}
+
+// Report the bytes copied so far by the Upload or Download call with
+// RpcTransfer.ID id, or 0 if it is not running
+func (ssh *RpcSsh) TransferProgress(
+	ctx context.Context,
+	id *string,
+	copied *int64,
+) error {
+	ssh.L.RLock()
+	n, ok := ssh.Transfers[*id]
+	ssh.L.RUnlock()
+	*copied = 0
+	if ok {
+		*copied = atomic.LoadInt64(n)
+	}
+	return nil
+}
+
+// Record the bytes copied by a transfer with RpcTransfer.ID id, if set.
+// Call done when the transfer ends.
+func (ssh *RpcSsh) startTransfer(id string) (copied *int64, done func()) {
+	copied = new(int64)
+	if id == "" {
+		return copied, func() {}
+	}
+	ssh.L.Lock()
+	ssh.Transfers[id] = copied
+	ssh.L.Unlock()
+	return copied, func() {
+		ssh.L.Lock()
+		delete(ssh.Transfers, id)
+		ssh.L.Unlock()
+	}
+}
+
+// A reader counting the bytes read into n, failing once ctx is done
+type countingReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// A writer counting the bytes written into n, failing once ctx is done
+type countingWriter struct {
+	ctx context.Context
+	w   io.Writer
+	n   *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// Check that files may be copied for the user of t through the fake ssh
+// server with working directory dir
+func PermitTransfer(ctx context.Context, dir string, t *RpcTransfer) error {
+	return callTransfer(ctx, dir, "RpcSsh.PermitTransfer", t)
+}
+
+// Upload a local file through the fake ssh server with working directory
+// dir
+func UploadFile(ctx context.Context, dir string, t *RpcTransfer) error {
+	return callTransfer(ctx, dir, "RpcSsh.Upload", t)
+}
+
+// Download a file of the guest through the fake ssh server with working
+// directory dir
+func DownloadFile(ctx context.Context, dir string, t *RpcTransfer) error {
+	return callTransfer(ctx, dir, "RpcSsh.Download", t)
+}
+
+// Upload a local directory through the fake ssh server with working
+// directory dir
+func UploadDir(ctx context.Context, dir string, t *RpcTransfer) error {
+	return callTransfer(ctx, dir, "RpcSsh.UploadDir", t)
+}
+
+// Download a directory of the guest through the fake ssh server with
+// working directory dir
+func DownloadDir(ctx context.Context, dir string, t *RpcTransfer) error {
+	return callTransfer(ctx, dir, "RpcSsh.DownloadDir", t)
+}
+
+// Get the bytes copied so far by the transfer with RpcTransfer.ID id
+// through the fake ssh server with working directory dir
+func TransferProgress(ctx context.Context, dir string, id string) (
+	int64,
+	error,
+) {
+	cli, err := rpc.DialHTTP("unix", filepath.Join(dir, UDSPath))
+	if err != nil {
+		return 0, err
+	}
+	defer cli.Close()
+
+	copied := int64(0)
+	err = cli.Call(ctx, "RpcSsh.TransferProgress", &id, &copied)
+	return copied, err
+}
+
+func callTransfer(
+	ctx context.Context,
+	dir string,
+	method string,
+	t *RpcTransfer,
+) error {
+	udsDir := filepath.Join(dir, UDSPath)
+	cli, err := rpc.DialHTTP("unix", udsDir)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	reply := 0
+	return cli.Call(ctx, method, t, &reply)
+}
+
+// The output of a guest command for guestOutput
+type outputBuffer struct {
+	bytes.Buffer
+}
+
+func (b *outputBuffer) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (b *outputBuffer) Close() error {
+	return nil
+}
+
+// A guest command that exited with an error
+type guestError struct {
+	ExitCode int
+	Stderr   string
+}
+
+func (e *guestError) Error() string {
+	if msg := strings.TrimSpace(e.Stderr); msg != "" {
+		return msg
+	}
+	return fmt.Sprintf("exited with code %d", e.ExitCode)
+}
+
+// Replace the error of a guest command whose stat does not take -c, like
+// the stat of BSD and macOS, with one asking for GNU stat
+func gnuStatError(err error) error {
+	gerr, ok := err.(*guestError)
+	if ok && strings.Contains(gerr.Stderr, "illegal option -- c") {
+		return errors.New("stat on the guest does not support -c, " +
+			"install GNU coreutils")
+	}
+	return err
+}
+
+// Build a command setting the access (a) or modification (m) time of the
+// guest file p to t.
+//
+// POSIX touch -t is used, since GNU touch -d @seconds is not supported by
+// the touch of BSD and macOS.
+func touchCommand(which byte, t time.Time, p string) string {
+	return fmt.Sprintf("TZ=UTC0 touch -%c -t %s -- %s",
+		which, t.UTC().Format("200601021504.05"), ShellQuote(p))
+}
+
+// Run cmd.Command without stdin through the fake ssh server with working
+// directory dir and return its stdout.
+//
+// A command exiting with an error returns a *guestError.
+func guestOutput(ctx context.Context, dir string, cmd Cmd) (string, error) {
+	stdout := &outputBuffer{}
+	stderr := &outputBuffer{}
+	cmd.NoStdin = true
+	cmd.Stdin = nil
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	exitCode, err := RunCmd(ctx, dir, &cmd)
+	if err != nil {
+		return "", err
+	}
+	if exitCode != 0 {
+		return "", &guestError{ExitCode: exitCode, Stderr: stderr.String()}
+	}
+	return stdout.String(), nil
+}
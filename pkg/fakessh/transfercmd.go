@@ -0,0 +1,245 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+package fakessh
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// The getopt string of packer-upload and packer-download.
+	// A character followed by a colon takes an argument.
+	TRANSFEROPTSTRING = "F:o:pqrx:"
+
+	// Usage message of packer-upload
+	UPLOADUSAGE = "usage: packer-upload [-pqr] [-F ssh_config] " +
+		"[-o ssh_option] [-x pattern]\n" +
+		"                     destination source ... target"
+
+	// Usage message of packer-download
+	DOWNLOADUSAGE = "usage: packer-download [-pqr] [-F ssh_config] " +
+		"[-o ssh_option] [-x pattern]\n" +
+		"                       destination source ... target"
+
+	// Exit code of packer-upload and packer-download on failure
+	TRANSFER_EXIT_FAILURE = 1
+)
+
+// A parsed packer-upload or packer-download command line
+type TransferInvocation struct {
+	// Number of times each flag without an argument was passed
+	Flags map[byte]int
+	// Arguments of each flag that takes one, in command line order
+	FlagArgs map[byte][]string
+	// The ssh destination, [user@]host or ssh://[user@]host[:port]
+	Destination string
+	// The sources followed by the target
+	Paths []string
+}
+
+// Check if flag f was passed
+func (tinv *TransferInvocation) Flag(f byte) bool {
+	return tinv.Flags[f] > 0
+}
+
+// Parse the arguments of packer-upload or packer-download (including
+// argv[0]).
+//
+// Options are parsed with getopt semantics until the first operand or "--".
+// The first operand is the ssh destination, and the others are paths.
+func ParseTransferArgs(args []string) (*TransferInvocation, error) {
+	tinv := &TransferInvocation{
+		Flags:    make(map[byte]int),
+		FlagArgs: make(map[byte][]string),
+		Paths:    []string{},
+	}
+
+	flags, n, _, err := getopt(args[1:], optTakesArg(TRANSFEROPTSTRING))
+	for _, f := range flags {
+		if !f.HasArg {
+			tinv.Flags[f.Flag]++
+			continue
+		}
+		tinv.FlagArgs[f.Flag] = append(tinv.FlagArgs[f.Flag], f.Arg)
+	}
+	if err != nil {
+		return tinv, err
+	}
+
+	i := 1 + n
+	if i < len(args) {
+		tinv.Destination = args[i]
+		tinv.Paths = append(tinv.Paths, args[i+1:]...)
+	}
+	return tinv, nil
+}
+
+// Resolve the destination of tinv like the fake ssh, with the ssh options
+// passed to it
+func (tinv *TransferInvocation) sshInvocation() (*Invocation, error) {
+	args := []string{SSHEXENAME}
+	for _, f := range []byte("Fo") {
+		for _, val := range tinv.FlagArgs[f] {
+			args = append(args, "-"+string(f), val)
+		}
+	}
+	args = append(args, "--", tinv.Destination)
+
+	inv, err := ParseArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	err = inv.ReadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// The packer-upload command.
+//
+// Local files are copied to the guest of the destination with the Upload
+// and UploadDir methods of its Communicator.
+func PackerUpload() int {
+	return transferMain("packer-upload", UPLOADUSAGE, true)
+}
+
+// The packer-download command.
+//
+// Guest files of the destination are copied to local files with the
+// Download and DownloadDir methods of its Communicator.
+func PackerDownload() int {
+	return transferMain("packer-download", DOWNLOADUSAGE, false)
+}
+
+// Run packer-upload if upload is set, and packer-download otherwise
+func transferMain(name string, usage string, upload bool) int {
+	ctx := context.Background()
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, os.Kill)
+
+	go func() {
+		select {
+		case <-signalChan:
+			cancel()
+		case <-dctx.Done():
+		}
+	}()
+
+	errorf := func(format string, a ...interface{}) {
+		fmt.Fprintf(os.Stderr, name+": "+format+"\n", a...)
+	}
+
+	tinv, err := ParseTransferArgs(os.Args)
+	if err != nil {
+		errorf("%s", err)
+	}
+	if err != nil || len(tinv.Paths) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return TRANSFER_EXIT_FAILURE
+	}
+
+	rpcDir, envSet := os.LookupEnv(RPCDirEnvVarName)
+	if !envSet {
+		errorf("%s is not set", RPCDirEnvVarName)
+		return TRANSFER_EXIT_FAILURE
+	}
+
+	inv, err := tinv.sshInvocation()
+	if err != nil {
+		errorf("%s", err)
+		return TRANSFER_EXIT_FAILURE
+	}
+	if len(inv.ProxyJump()) > 0 {
+		errorf("%s: jump hosts are not supported", tinv.Destination)
+		return TRANSFER_EXIT_FAILURE
+	}
+	handled, err := HandlesHost(dctx, rpcDir, inv.HostName)
+	if err == nil && !handled {
+		err = fmt.Errorf("%s: not a host of the fakessh server",
+			tinv.Destination)
+	}
+	if err != nil {
+		errorf("%s", err)
+		return TRANSFER_EXIT_FAILURE
+	}
+
+	c := &scpCopier{
+		ctx:       dctx,
+		dir:       rpcDir,
+		recursive: tinv.Flag('r'),
+		preserve:  tinv.Flag('p'),
+		exclude:   tinv.FlagArgs['x'],
+	}
+	if !tinv.Flag('q') {
+		c.meter = &progressMeter{
+			w:   os.Stderr,
+			tty: terminal.IsTerminal(int(os.Stderr.Fd())),
+		}
+	}
+	// Like the fake scp, the user is checked before any guest command, and
+	// guest commands and file transfers get the same absolute paths
+	guest := scpEnd{Host: inv.HostName, User: inv.User}
+	err = PermitTransfer(dctx, rpcDir, &RpcTransfer{
+		Host: guest.Host,
+		User: guest.User,
+	})
+	if err != nil {
+		errorf("%s", err)
+		return TRANSFER_EXIT_FAILURE
+	}
+	target := scpEnd{Path: tinv.Paths[len(tinv.Paths)-1]}
+	if upload {
+		p := target.Path
+		target = guest
+		target.Path, err = c.guestPath(guest.Host, p)
+		if err != nil {
+			errorf("%s", scpGuestError(p, err))
+			return TRANSFER_EXIT_FAILURE
+		}
+	}
+	sources := tinv.Paths[:len(tinv.Paths)-1]
+	if len(sources) > 1 {
+		isDir, err := c.isDir(target)
+		if err == nil && !isDir {
+			err = fmt.Errorf("%s: Not a directory", target.Path)
+		}
+		if err != nil {
+			errorf("%s", err)
+			return TRANSFER_EXIT_FAILURE
+		}
+	}
+
+	exitCode := 0
+	for _, src := range sources {
+		if upload {
+			err = c.upload(src, target)
+		} else {
+			from := guest
+			from.Path, err = c.guestPath(guest.Host, src)
+			if err != nil {
+				err = scpGuestError(src, err)
+			} else {
+				err = c.download(from, target.Path)
+			}
+		}
+		if err != nil {
+			errorf("%s", err)
+			exitCode = TRANSFER_EXIT_FAILURE
+		}
+		if dctx.Err() != nil {
+			return TRANSFER_EXIT_FAILURE
+		}
+	}
+	return exitCode
+}
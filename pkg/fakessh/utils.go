@@ -30,6 +30,15 @@ const (
 
 	// The name of the go package containing the fake ssh command
 	SSHPKGNAME = "github.com/leocp1/packer-provisioner-fakessh/cmd/ssh"
+
+	// The name of the go package containing the fake scp command
+	SCPPKGNAME = "github.com/leocp1/packer-provisioner-fakessh/cmd/scp"
+
+	// The name of the go package containing the packer-upload command
+	UPLOADPKGNAME = "github.com/leocp1/packer-provisioner-fakessh/cmd/packer-upload"
+
+	// The name of the go package containing the packer-download command
+	DOWNLOADPKGNAME = "github.com/leocp1/packer-provisioner-fakessh/cmd/packer-download"
 )
 
 // Return a reasonable guess for the parent directory of the fake ssh binary
@@ -76,6 +85,8 @@ func FakeSshPath() (string, bool) {
 }
 
 // Modify environment slice to use fakessh instead.
+// The fake scp next to the fake ssh, if any, shadows scp as well, and
+// packer-upload and packer-download are found on PATH.
 // If the PATH variable is unset,
 // set it to its value from os.Environ
 func AddFakeSshPath(es []string, sshDir string, rpcDir string) ([]string, error) {
@@ -117,18 +128,26 @@ func AddFakeSshPath(es []string, sshDir string, rpcDir string) ([]string, error)
 	return em.EnvSlice(), nil
 }
 
-// Create a temporary directory and build a ssh binary inside
+// Create a temporary directory and build the ssh, scp, packer-upload and
+// packer-download binaries inside
 func GoBuildFakeSsh(ctx context.Context) (string, error) {
 	sshDir, err := ioutil.TempDir("", "packer-provisioner-fakessh")
 	if err != nil {
 		return sshDir, err
 	}
-	sshExe := filepath.Join(sshDir, SSHEXENAME)
 
-	cmd := exec.CommandContext(ctx, "go", "build", "-o", sshExe, SSHPKGNAME)
-	err = cmd.Run()
-	if err != nil {
-		return sshDir, err
+	for exe, pkg := range map[string]string{
+		SSHEXENAME:      SSHPKGNAME,
+		SCPEXENAME:      SCPPKGNAME,
+		UPLOADEXENAME:   UPLOADPKGNAME,
+		DOWNLOADEXENAME: DOWNLOADPKGNAME,
+	} {
+		cmd := exec.CommandContext(ctx,
+			"go", "build", "-o", filepath.Join(sshDir, exe), pkg)
+		err = cmd.Run()
+		if err != nil {
+			return sshDir, err
+		}
 	}
 
 	return sshDir, nil
@@ -14,13 +14,29 @@ import (
 const (
 	// The basename of the ssh executable
 	SSHEXENAME = "ssh"
+	// The basename of the scp executable
+	SCPEXENAME = "scp"
+	// The basename of the packer-upload executable
+	UPLOADEXENAME = "packer-upload"
+	// The basename of the packer-download executable
+	DOWNLOADEXENAME = "packer-download"
 )
 
 // Check if the passed directory has a ssh executable
 func dirHasFakeSsh(dir string) bool {
-	fi, err := os.Stat(filepath.Join(dir, SSHEXENAME))
+	return dirHasExe(dir, SSHEXENAME)
+}
+
+// Check if the passed directory has an executable named name
+func dirHasExe(dir string, name string) bool {
+	fi, err := os.Stat(filepath.Join(dir, name))
 	if err != nil {
 		return false
 	}
 	return fi.Mode()&0111 != 0000
 }
+
+const (
+	// The system wide ssh_config file
+	SYSTEMSSHCONFIG = "/etc/ssh/ssh_config"
+)
@@ -14,10 +14,26 @@ import (
 const (
 	// The basename of the ssh executable
 	SSHEXENAME = "ssh.exe"
+	// The basename of the scp executable
+	SCPEXENAME = "scp.exe"
+	// The basename of the packer-upload executable
+	UPLOADEXENAME = "packer-upload.exe"
+	// The basename of the packer-download executable
+	DOWNLOADEXENAME = "packer-download.exe"
 )
 
 // Check if the passed directory has a ssh executable
 func dirHasFakeSsh(dir string) bool {
-	_, err := os.Stat(filepath.Join(dir, SSHEXENAME))
+	return dirHasExe(dir, SSHEXENAME)
+}
+
+// Check if the passed directory has an executable named name
+func dirHasExe(dir string, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
 	return err == nil
 }
+
+const (
+	// The system wide ssh_config file
+	SYSTEMSSHCONFIG = `C:\ProgramData\ssh\ssh_config`
+)
@@ -12,8 +12,11 @@ package localcommunicator
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -43,18 +46,135 @@ func RunExitCode(cmd *exec.Cmd) int {
 	}
 }
 
+// Connect stdin to lcmd through a pipe.
+//
+// Unlike setting lcmd.Stdin to a reader, waiting for lcmd does not wait
+// until stdin is copied, so a command can exit while stdin is still open,
+// like a command of an ssh server. Close the returned file after lcmd exits.
+// It is nil if stdin is nil, which is safe to close.
+func pipeStdin(lcmd *exec.Cmd, stdin io.Reader) (*os.File, error) {
+	if stdin == nil {
+		return nil, nil
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	lcmd.Stdin = pr
+	go func() {
+		io.Copy(pw, stdin)
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// Write input to the file path, created with the permissions of fi, or 0644
+// if fi is nil
 func (c *comm) Upload(path string, input io.Reader, fi *os.FileInfo) error {
-	return errors.New("Upload is not implemented")
+	var mode os.FileMode = 0644
+	if fi != nil {
+		mode = (*fi).Mode().Perm()
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, input)
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
 }
 
+// Copy the directory src into dst, or its contents if src ends with a
+// slash, like the ssh Communicator. Files whose name matches a pattern of
+// excl are skipped.
 func (c *comm) UploadDir(dst string, src string, excl []string) error {
-	return errors.New("UploadDir is not implemented")
+	if !strings.HasSuffix(src, "/") {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+	return copyDir(dst, src, excl)
 }
 
+// Copy the file path to output
 func (c *comm) Download(path string, output io.Writer) error {
-	return errors.New("Download is not implemented")
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(output, f)
+	return err
+}
+
+// Copy the directory src into dst, like the ssh Communicator. Files whose
+// name matches a pattern of excl are skipped.
+func (c *comm) DownloadDir(src string, dst string, excl []string) error {
+	return copyDir(filepath.Join(dst, filepath.Base(src)), src, excl)
 }
 
-func (c *comm) DownloadDir(dst string, src string, excl []string) error {
-	return errors.New("DownloadDir is not implemented")
+// Copy the contents of the directory src to dst, which is created with the
+// permissions of src if it does not exist
+func copyDir(dst string, src string, excl []string) error {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{
+			Op:   "copy",
+			Path: src,
+			Err:  errors.New("not a directory"),
+		}
+	}
+	err = os.MkdirAll(dst, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if excluded(entry.Name(), excl) {
+			continue
+		}
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dst, entry.Name())
+		if entry.IsDir() {
+			err = copyDir(to, from, excl)
+		} else {
+			err = copyFile(to, from)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the file src to dst with its permissions
+func copyFile(dst string, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var c comm
+	return c.Upload(dst, f, &fi)
+}
+
+// Check if name matches one of the patterns of excl
+func excluded(name string, excl []string) bool {
+	for _, pattern := range excl {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
 }
@@ -8,6 +8,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -61,3 +64,126 @@ func TestLocalComm(t *testing.T) {
 		})
 	}
 }
+
+func TestLocalCommTransfer(t *testing.T) {
+	lc, _ := localcommunicator.New()
+
+	dir, err := ioutil.TempDir("", "localcomm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	err = ioutil.WriteFile(src, []byte("test"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	err = lc.Upload(dst, bytes.NewBufferString("uploaded"), &fi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dfi.Mode().Perm() != fi.Mode().Perm() {
+		t.Errorf("bad mode: %v", dfi.Mode())
+	}
+
+	out := &bytes.Buffer{}
+	err = lc.Download(dst, out)
+	if err != nil || out.String() != "uploaded" {
+		t.Errorf("bad download: %#v %v", out.String(), err)
+	}
+	err = lc.Download(filepath.Join(dir, "missing"), out)
+	if !os.IsNotExist(err) {
+		t.Errorf("bad missing download: %v", err)
+	}
+}
+
+func TestLocalCommTransferDir(t *testing.T) {
+	lc, _ := localcommunicator.New()
+
+	dir, err := ioutil.TempDir("", "localcomm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	files := map[string]string{
+		"a":       "a",
+		"sub/b":   "b",
+		"skip.o":  "skipped",
+		"sub/c.o": "skipped",
+	}
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		transfer func(dst string) error
+		root     string
+	}{
+		{
+			name: "upload",
+			transfer: func(dst string) error {
+				return lc.UploadDir(dst, src, []string{"*.o"})
+			},
+			root: "src",
+		},
+		{
+			name: "upload contents",
+			transfer: func(dst string) error {
+				return lc.UploadDir(dst, src+"/", []string{"*.o"})
+			},
+			root: "",
+		},
+		{
+			name: "download",
+			transfer: func(dst string) error {
+				return lc.DownloadDir(src, dst, []string{"*.o"})
+			},
+			root: "src",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(dir, "dst")
+			defer os.RemoveAll(dst)
+			err := tt.transfer(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range files {
+				p := filepath.Join(dst, tt.root, name)
+				got, err := ioutil.ReadFile(p)
+				if content == "skipped" {
+					if !os.IsNotExist(err) {
+						t.Errorf("%s not skipped: %v", name, err)
+					}
+					continue
+				}
+				if err != nil || string(got) != content {
+					t.Errorf("bad %s: %#v %v", name, string(got), err)
+				}
+				fi, err := os.Stat(p)
+				if err != nil || fi.Mode().Perm() != 0600 {
+					t.Errorf("bad mode of %s: %v %v", name, fi, err)
+				}
+			}
+		})
+	}
+}
@@ -16,11 +16,15 @@ import (
 // Run command by passing it directly as an argument to /bin/sh
 func (c *comm) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
 	lcmd := exec.CommandContext(ctx, "/bin/sh", "-c", cmd.Command)
-	lcmd.Stdin = cmd.Stdin
+	stdin, err := pipeStdin(lcmd, cmd.Stdin)
+	if err != nil {
+		return err
+	}
 	lcmd.Stdout = cmd.Stdout
 	lcmd.Stderr = cmd.Stderr
 	go func() {
 		exitCode := RunExitCode(lcmd)
+		stdin.Close()
 		cmd.SetExited(exitCode)
 	}()
 	return nil
@@ -17,12 +17,16 @@ import (
 // Run command by passing it directly as an argument to powershell
 func (c *comm) Start(ctx context.Context, cmd *packer.RemoteCmd) (err error) {
 	lcmd := exec.Command("cmd.exe", "/c", cmd.Command)
-	lcmd.Stdin = cmd.Stdin
+	stdin, err := pipeStdin(lcmd, cmd.Stdin)
+	if err != nil {
+		return err
+	}
 	lcmd.Stdout = cmd.Stdout
 	lcmd.Stderr = cmd.Stderr
 	exitChan := make(chan struct{})
 	go func() {
 		exitCode := RunExitCode(lcmd)
+		stdin.Close()
 		if ctx.Err() != nil {
 			exitCode = EXIT_FAILURE
 		}
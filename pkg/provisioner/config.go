@@ -0,0 +1,245 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:generate mapstructure-to-hcl2 -type Config
+
+package provisioner
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	sl "github.com/hashicorp/packer/common/shell-local"
+	configHelper "github.com/hashicorp/packer/helper/config"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+type Config struct {
+	sl.Config `mapstructure:",squash"`
+
+	// Patterns of environment variable names accepted from SendEnv and
+	// SetEnv options of the fake ssh command.
+	// Defaults to LANG, LC_* and GIT_PROTOCOL.
+	AcceptEnv []string `mapstructure:"accept_env"`
+
+	// Template wrapping commands to run them as the user of the ssh
+	// destination, like `sudo -u {{.User}} -H -- sh -c {{.Command}}`.
+	// {{.Command}}, {{.User}}, {{.Host}} and {{.WorkDir}} are quoted for a
+	// POSIX shell. Users that are not valid login names are refused.
+	// If empty, commands run as the Communicator user.
+	SwitchUserCommand string `mapstructure:"switch_user_command"`
+
+	// Template wrapping every command forwarded by the fake ssh command,
+	// like `cd /srv && umask 022 && sh -c {{.Command}}`.
+	// {{.User}} and {{.Host}} are from the ssh destination, {{.Env}} holds
+	// the accepted environment variables as shell assignments and
+	// {{.WorkDir}} is the working directory of the fake ssh command. All of
+	// them and {{.Command}} are quoted for a POSIX shell.
+	// switch_user_command wraps the result.
+	// If empty, commands are not wrapped.
+	RemoteExecuteCommand string `mapstructure:"remote_execute_command"`
+
+	// Template of the command relaying stdin and stdout to a TCP port of
+	// the guest for ssh -W, -L and -D, like
+	// `socat - TCP:{{.Host}}:{{.Port}}`.
+	// {{.Host}} is quoted for a POSIX shell.
+	// If empty, nc, socat or bash is used.
+	RelayCommand string `mapstructure:"relay_command"`
+
+	// Template of the command accepting connections on a TCP address of the
+	// guest and multiplexing them over stdin and stdout for ssh -R, in the
+	// frames described in the README, like `tcp-mux {{.Host}} {{.Port}}`.
+	// {{.Host}} is quoted for a POSIX shell.
+	// If empty, python3 is used.
+	ListenCommand string `mapstructure:"listen_command"`
+
+	// Template of the command accepting connections on a unix socket of the
+	// guest and multiplexing them over stdin and stdout for ssh -A, in the
+	// frames of listen_command. {{.Path}} is the socket and {{.Dir}} its
+	// directory, both quoted for a POSIX shell.
+	// switch_user_command wraps the result.
+	// If empty, python3 is used.
+	AgentListenCommand string `mapstructure:"agent_listen_command"`
+
+	// Template of the command running {{.Command}} under a pseudo-terminal
+	// for ssh -t, like `script -qfec {{.Command}} /dev/null`.
+	// remote_execute_command wraps the result.
+	// If empty, script is used.
+	PtyCommand string `mapstructure:"pty_command"`
+
+	// Compress the streams of forwarded commands between the provisioner and
+	// the guest with gzip or zstd, unless the fake ssh command sets
+	// Compression no. Commands run uncompressed if the guest has neither
+	// the gzip or zstd commands nor python3.
+	Compression bool `mapstructure:"compression"`
+
+	// Patterns of destination users commands may run for, with or without
+	// switch_user_command. The Communicator user is always permitted.
+	// If empty, any user is permitted.
+	AllowedUsers []string `mapstructure:"allowed_users"`
+
+	// Patterns of ssh destination hosts handled by the fake ssh command,
+	// like {{ build `Host` }}. Other destinations are passed to the
+	// real ssh. The patterns of Hosts are always handled.
+	// If empty, every destination is handled.
+	MatchHosts []string `mapstructure:"match_hosts"`
+
+	// Hosts commands are sent to, picked by the first matching pattern of
+	// the host of the ssh destination. Destinations matching no host are
+	// sent to the communicator of the build.
+	Hosts []HostConfig `mapstructure:"hosts"`
+
+	// If the commands fail while Packer runs with -on-error=ask, keep the
+	// fake ssh server running and print a command opening a shell on the
+	// guest, until enter is pressed.
+	DebugShell bool `mapstructure:"debug_shell"`
+
+	ctx interpolate.Context
+}
+
+// Decode raws into config.
+//
+// Keys of the shell-local config are decoded by sl.Decode, so it keeps its
+// interpolation context. The remaining keys are decoded into the fakessh
+// fields of config.
+func Decode(config *Config, raws ...interface{}) error {
+	// The placeholder data of build variables is passed on to both decoders
+	ctxData, raws := configHelper.DetectContextData(raws...)
+
+	keys := fakesshKeys()
+	slRaws := make([]interface{}, 0, len(raws))
+	fakesshRaws := make([]interface{}, 0, len(raws))
+	for _, raw := range raws {
+		m, err := rawToMap(raw)
+		if err != nil {
+			return err
+		}
+		slRaw := make(map[string]interface{})
+		fakesshRaw := make(map[string]interface{})
+		for k, v := range m {
+			if keys[k] {
+				fakesshRaw[k] = v
+				continue
+			}
+			slRaw[k] = v
+			// needed for user variable interpolation
+			if strings.HasPrefix(k, "packer_") {
+				fakesshRaw[k] = v
+			}
+		}
+		slRaws = append(slRaws, slRaw)
+		fakesshRaws = append(fakesshRaws, fakesshRaw)
+	}
+	if ctxData != nil {
+		slRaws = append(slRaws, ctxData)
+		fakesshRaws = append(fakesshRaws, ctxData)
+	}
+
+	err := sl.Decode(&config.Config, slRaws...)
+	if err != nil {
+		return err
+	}
+
+	return configHelper.Decode(config, &configHelper.DecodeOpts{
+		Interpolate:        true,
+		InterpolateContext: &config.ctx,
+		InterpolateFilter: &interpolate.RenderFilter{
+			Exclude: []string{
+				"remote_execute_command",
+				"switch_user_command",
+				"relay_command",
+				"listen_command",
+				"agent_listen_command",
+				"pty_command",
+			},
+		},
+	}, fakesshRaws...)
+}
+
+// Check the fakessh fields of config
+func Validate(config *Config) error {
+	var errs *packer.MultiError
+
+	templates := []struct {
+		name string
+		tpl  string
+	}{
+		{"remote_execute_command", config.RemoteExecuteCommand},
+		{"switch_user_command", config.SwitchUserCommand},
+		{"relay_command", config.RelayCommand},
+		{"listen_command", config.ListenCommand},
+		{"agent_listen_command", config.AgentListenCommand},
+		{"pty_command", config.PtyCommand},
+	}
+	for _, t := range templates {
+		if t.tpl == "" {
+			continue
+		}
+		err := interpolate.Validate(t.tpl, &config.ctx)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error parsing %s: %s", t.name, err))
+		}
+	}
+
+	for i := range config.Hosts {
+		for _, err := range config.Hosts[i].Prepare(&config.ctx) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("hosts[%d]: %s", i, err))
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Get the mapstructure keys of the fields of Config not in sl.Config
+func fakesshKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			continue
+		}
+		if k := f.Tag.Get("mapstructure"); k != "" {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// Convert a raw config into a map.
+//
+// HCL2 configs are passed as cty.Value and are converted through JSON, like
+// configHelper.Decode does.
+func rawToMap(raw interface{}) (map[string]interface{}, error) {
+	switch r := raw.(type) {
+	case map[string]interface{}:
+		return r, nil
+	case cty.Value:
+		b, err := ctyjson.SimpleJSONValue{Value: r}.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]interface{}
+		err = json.Unmarshal(b, &m)
+		return m, err
+	default:
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]interface{}
+		err = json.Unmarshal(b, &m)
+		return m, err
+	}
+}
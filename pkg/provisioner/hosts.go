@@ -0,0 +1,355 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+//go:generate mapstructure-to-hcl2 -type HostConfig
+
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	packerssh "github.com/hashicorp/packer/communicator/ssh"
+	"github.com/hashicorp/packer/helper/communicator"
+	"github.com/hashicorp/packer/helper/multistep"
+	helperssh "github.com/hashicorp/packer/helper/ssh"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/proxy"
+
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/fakessh"
+)
+
+const (
+	// Send commands to the communicator of the build
+	HOSTBUILD = "build"
+	// Send commands to a host connected with the ssh_* options
+	HOSTSSH = "ssh"
+	// Time between attempts to connect to a host
+	SSHRETRYINTERVAL = 5 * time.Second
+)
+
+// A host the fake ssh command sends commands to
+type HostConfig struct {
+	// Patterns of ssh destination hosts sent to this host
+	Match []string `mapstructure:"match"`
+
+	// The `communicator` option is `build` to use the communicator of the
+	// build, or `ssh` to connect with the ssh_* options, like a builder
+	// does. Defaults to `ssh` if `ssh_host` is set and `build` otherwise.
+	communicator.Config `mapstructure:",squash"`
+}
+
+// Check host and set its defaults
+func (host *HostConfig) Prepare(ctx *interpolate.Context) []error {
+	var errs []error
+	if len(host.Match) == 0 {
+		errs = append(errs, errors.New("match must be specified"))
+	}
+
+	if host.Type == "" {
+		if host.SSHHost != "" {
+			host.Type = HOSTSSH
+		} else {
+			host.Type = HOSTBUILD
+		}
+	}
+	switch host.Type {
+	case HOSTBUILD:
+	case HOSTSSH:
+		if host.SSHHost == "" {
+			errs = append(errs, errors.New("An ssh_host must be specified"))
+		}
+		errs = append(errs, host.Config.Prepare(ctx)...)
+	default:
+		errs = append(errs, fmt.Errorf(
+			"communicator ('%s') is invalid, valid communicators: %s, %s",
+			host.Type, HOSTBUILD, HOSTSSH))
+	}
+	return errs
+}
+
+// Render the build variables in patterns, like {{ build `Host` }}, with the
+// data generated by the builder.
+func RenderPatterns(
+	patterns []string,
+	generatedData map[string]interface{},
+) ([]string, error) {
+	ictx := &interpolate.Context{Data: generatedData}
+	rendered := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		r, err := interpolate.Render(pattern, ictx)
+		if err != nil {
+			return nil, err
+		}
+		rendered = append(rendered, r)
+	}
+	return rendered, nil
+}
+
+// Connect to hosts and convert them to routes of a fakessh server.
+//
+// generatedData is the data generated by the builder, which has the user of
+// the communicator of the build. Call the returned function to disconnect
+// the hosts.
+func ConnectHosts(
+	ctx context.Context,
+	ui packer.Ui,
+	hosts []HostConfig,
+	generatedData map[string]interface{},
+) ([]fakessh.Route, func(), error) {
+	commUser, _ := generatedData["User"].(string)
+	routes := make([]fakessh.Route, 0, len(hosts))
+	conns := []*sshConns{}
+	disconnect := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	for i := range hosts {
+		host := &hosts[i]
+		match, err := RenderPatterns(host.Match, generatedData)
+		if err != nil {
+			disconnect()
+			return nil, nil, fmt.Errorf("hosts[%d]: %s", i, err)
+		}
+		route := fakessh.Route{
+			Hosts:    match,
+			Comm:     nil,
+			CommUser: commUser,
+		}
+		if host.Type == HOSTSSH {
+			ui.Say(fmt.Sprintf("Connecting to host %s...", host.SSHHost))
+			comm, c, err := connectSSH(ctx, ui, &host.Config)
+			if err != nil {
+				disconnect()
+				return nil, nil, fmt.Errorf("hosts[%d]: %s", i, err)
+			}
+			conns = append(conns, c)
+			route.Comm = comm
+			route.CommUser = host.SSHUsername
+		}
+		routes = append(routes, route)
+	}
+	return routes, disconnect, nil
+}
+
+// Connections opened by an ssh Communicator.
+//
+// Packer's ssh Communicator can not be closed, so it is disconnected by
+// closing its connections.
+type sshConns struct {
+	l      sync.Mutex
+	conns  []net.Conn
+	closed bool
+}
+
+// Wrap dial to keep the connections it opens
+func (sc *sshConns) track(
+	dial func() (net.Conn, error),
+) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		c, err := dial()
+		if err != nil {
+			return nil, err
+		}
+		sc.l.Lock()
+		defer sc.l.Unlock()
+		if sc.closed {
+			c.Close()
+			return nil, errors.New("ssh communicator is disconnected")
+		}
+		sc.conns = append(sc.conns, c)
+		return c, nil
+	}
+}
+
+// Close the connections, and refuse to open new ones
+func (sc *sshConns) Close() error {
+	sc.l.Lock()
+	defer sc.l.Unlock()
+	sc.closed = true
+	for _, c := range sc.conns {
+		c.Close()
+	}
+	sc.conns = nil
+	return nil
+}
+
+// Connect a Communicator with the ssh options of config, like a builder
+// does. Close the returned connections to disconnect it.
+func connectSSH(
+	ctx context.Context,
+	ui packer.Ui,
+	config *communicator.Config,
+) (packer.Communicator, *sshConns, error) {
+	address := fmt.Sprintf("%s:%d", config.SSHHost, config.SSHPort)
+	dial, err := sshDial(config, address)
+	if err != nil {
+		return nil, nil, err
+	}
+	sshConfig, err := config.SSHConfigFunc()(new(multistep.BasicStateBag))
+	if err != nil {
+		return nil, nil, err
+	}
+	var tunnels []packerssh.TunnelSpec
+	for _, v := range config.SSHLocalTunnels {
+		t, err := helperssh.ParseTunnelArgument(v, packerssh.LocalTunnel)
+		if err != nil {
+			return nil, nil, err
+		}
+		tunnels = append(tunnels, t)
+	}
+	for _, v := range config.SSHRemoteTunnels {
+		t, err := helperssh.ParseTunnelArgument(v, packerssh.RemoteTunnel)
+		if err != nil {
+			return nil, nil, err
+		}
+		tunnels = append(tunnels, t)
+	}
+
+	conns := &sshConns{}
+	commConfig := &packerssh.Config{
+		Connection:             conns.track(dial),
+		SSHConfig:              sshConfig,
+		Pty:                    config.SSHPty,
+		DisableAgentForwarding: config.SSHDisableAgentForwarding,
+		UseSftp:                config.SSHFileTransferMethod == "sftp",
+		KeepAliveInterval:      config.SSHKeepAliveInterval,
+		Timeout:                config.SSHReadWriteTimeout,
+		Tunnels:                tunnels,
+	}
+
+	ui.Say("Waiting for SSH to become available...")
+	timeout := time.After(config.SSHTimeout)
+	handshakeAttempts := 0
+	for {
+		comm, err := packerssh.New(address, commConfig)
+		if err == nil {
+			ui.Say("Connected to SSH!")
+			return comm, conns, nil
+		}
+		// Like builders, give up after SSHHandshakeAttempts failed
+		// authentications, and retry other errors until the timeout
+		if strings.Contains(err.Error(), "authenticate") {
+			handshakeAttempts++
+			if handshakeAttempts >= config.SSHHandshakeAttempts {
+				conns.Close()
+				return nil, nil, err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			conns.Close()
+			return nil, nil, errors.New("SSH connection cancelled")
+		case <-timeout:
+			conns.Close()
+			return nil, nil, errors.New("Timeout waiting for SSH.")
+		case <-time.After(SSHRETRYINTERVAL):
+		}
+	}
+}
+
+// Return the function connecting to address with the proxy or bastion
+// options of config
+func sshDial(
+	config *communicator.Config,
+	address string,
+) (func() (net.Conn, error), error) {
+	if config.SSHBastionHost != "" {
+		bConf, err := sshBastionConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("Error configuring bastion: %s", err)
+		}
+		bAddr := fmt.Sprintf(
+			"%s:%d", config.SSHBastionHost, config.SSHBastionPort)
+		return packerssh.BastionConnectFunc(
+			"tcp", bAddr, bConf, "tcp", address), nil
+	}
+	if config.SSHProxyHost != "" {
+		pAddr := fmt.Sprintf(
+			"%s:%d", config.SSHProxyHost, config.SSHProxyPort)
+		var pAuth *proxy.Auth = nil
+		if config.SSHProxyUsername != "" {
+			pAuth = &proxy.Auth{
+				User:     config.SSHProxyUsername,
+				Password: config.SSHProxyPassword,
+			}
+		}
+		return packerssh.ProxyConnectFunc(pAddr, pAuth, "tcp", address), nil
+	}
+	return packerssh.ConnectFunc("tcp", address), nil
+}
+
+// Build the client config of the bastion host of config, like builders do
+func sshBastionConfig(config *communicator.Config) (*gossh.ClientConfig, error) {
+	auth := []gossh.AuthMethod{}
+	if config.SSHBastionInteractive {
+		var c io.ReadWriteCloser = os.Stdin
+		if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+			tty, err := os.Open("/dev/tty")
+			if err != nil {
+				return nil, err
+			}
+			defer tty.Close()
+			c = tty
+		}
+		auth = append(auth,
+			gossh.KeyboardInteractive(packerssh.KeyboardInteractive(c)))
+	}
+	if config.SSHBastionPassword != "" {
+		auth = append(auth,
+			gossh.Password(config.SSHBastionPassword),
+			gossh.KeyboardInteractive(
+				packerssh.PasswordKeyboardInteractive(
+					config.SSHBastionPassword)))
+	}
+	if config.SSHBastionPrivateKeyFile != "" {
+		path, err := packer.ExpandUser(config.SSHBastionPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer gossh.Signer
+		if config.SSHBastionCertificateFile != "" {
+			certPath, err := packer.ExpandUser(config.SSHBastionCertificateFile)
+			if err != nil {
+				return nil, err
+			}
+			signer, err = helperssh.FileSignerWithCert(path, certPath)
+		} else {
+			signer, err = helperssh.FileSigner(path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, gossh.PublicKeys(signer))
+	}
+	if config.SSHBastionAgentAuth {
+		authSock := os.Getenv("SSH_AUTH_SOCK")
+		if authSock == "" {
+			return nil, errors.New("SSH_AUTH_SOCK is not set")
+		}
+		sshAgent, err := net.Dial("unix", authSock)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth,
+			gossh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+	}
+	return &gossh.ClientConfig{
+		User:            config.SSHBastionUsername,
+		Auth:            auth,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}, nil
+}
@@ -2,14 +2,14 @@
 // License, v. 2.0. If a copy of the MPL was not distributed with this
 // file, You can obtain one at https://mozilla.org/MPL/2.0/.
 
-//go:generate mapstructure-to-hcl2 -type Provisioner
-
 package provisioner
 
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/hashicorp/hcl/v2/hcldec"
 	sl "github.com/hashicorp/packer/common/shell-local"
@@ -19,21 +19,26 @@ import (
 )
 
 type Provisioner struct {
-	config    sl.Config
+	config    Config
 	sshExeDir string
 }
 
 func (p *Provisioner) ConfigSpec() hcldec.ObjectSpec {
-	return p.FlatMapstructure().HCL2Spec()
+	return p.config.FlatMapstructure().HCL2Spec()
 }
 
 func (p *Provisioner) Prepare(raws ...interface{}) error {
-	err := sl.Decode(&p.config, raws...)
+	err := Decode(&p.config, raws...)
+	if err != nil {
+		return err
+	}
+
+	err = sl.Validate(&p.config.Config)
 	if err != nil {
 		return err
 	}
 
-	err = sl.Validate(&p.config)
+	err = Validate(&p.config)
 	if err != nil {
 		return err
 	}
@@ -55,7 +60,31 @@ func (p *Provisioner) Provision(
 ) error {
 	var err error = nil
 
-	srv, err := fakessh.NewServer(comm, "")
+	commUser, _ := generatedData["User"].(string)
+	matchHosts, err := RenderPatterns(p.config.MatchHosts, generatedData)
+	if err != nil {
+		return err
+	}
+	routes, disconnect, err :=
+		ConnectHosts(ctx, ui, p.config.Hosts, generatedData)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+	srv, err := fakessh.NewServer(comm, "", &fakessh.ServerConfig{
+		AcceptEnv:          p.config.AcceptEnv,
+		ExecuteCommand:     p.config.RemoteExecuteCommand,
+		SwitchUserCommand:  p.config.SwitchUserCommand,
+		AllowedUsers:       p.config.AllowedUsers,
+		CommUser:           commUser,
+		RelayCommand:       p.config.RelayCommand,
+		ListenCommand:      p.config.ListenCommand,
+		AgentListenCommand: p.config.AgentListenCommand,
+		PtyCommand:         p.config.PtyCommand,
+		Compression:        p.config.Compression,
+		MatchHosts:         matchHosts,
+		Routes:             routes,
+	})
 	if err != nil {
 		return err
 	}
@@ -79,7 +108,14 @@ func (p *Provisioner) Provision(
 		p.config.Vars after running Validate is safe.
 	*/
 
-	_, retErr := sl.Run(ctx, ui, &p.config, generatedData)
+	_, retErr := sl.Run(ctx, ui, &p.config.Config, generatedData)
+	if retErr != nil && p.config.DebugShell &&
+		p.config.PackerOnError == "ask" {
+		err = debugShell(ctx, ui, srv.Dir)
+		if err != nil {
+			ui.Error(err.Error())
+		}
+	}
 
 	srv.Shutdown(ctx)
 	err = <-srvChan
@@ -89,3 +125,34 @@ func (p *Provisioner) Provision(
 
 	return retErr
 }
+
+// Print how to open a shell on the guest through the fake ssh server with
+// directory dir, and wait until enter is pressed.
+func debugShell(ctx context.Context, ui packer.Ui, dir string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ui.Say(fmt.Sprintf(
+		"The fake ssh server is kept running. Open a shell on the guest "+
+			"with:\n  %s %s %s",
+		fakessh.ShellQuote(exe),
+		fakessh.SHELLSUBCOMMAND,
+		fakessh.ShellQuote(dir),
+	))
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := ui.Ask("Press enter to continue.")
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if err != nil {
+			return fmt.Errorf("Error asking for input: %s", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -5,11 +5,19 @@
 package provisioner_test
 
 import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/hcl/v2/hcldec"
 	"github.com/hashicorp/packer/packer"
+	"github.com/zclconf/go-cty/cty"
 
 	. "github.com/leocp1/packer-provisioner-fakessh/pkg/provisioner"
+	"github.com/leocp1/packer-provisioner-fakessh/pkg/sshtest"
 )
 
 // Copy of local-shell tests
@@ -56,6 +64,310 @@ func TestConfigPrepare(t *testing.T) {
 	}
 }
 
+func TestDecode(t *testing.T) {
+	raw := testConfig(t)
+	raw["accept_env"] = []string{"LANG", "NIX_*"}
+	raw["environment_vars"] = []string{"FOO=bar"}
+	raw["remote_execute_command"] = "cd /srv && sh -c {{.Command}}"
+	raw["debug_shell"] = true
+	raw["compression"] = true
+	raw["packer_on_error"] = "ask"
+	raw["hosts"] = []map[string]interface{}{
+		{"match": []string{"build*"}},
+		{
+			"match":        []string{"bastion", "*.internal"},
+			"ssh_host":     "192.0.2.1",
+			"ssh_username": "admin",
+			"ssh_timeout":  "30s",
+		},
+	}
+
+	var c Config
+	err := Decode(&c, raw)
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(c.AcceptEnv, []string{"LANG", "NIX_*"}) {
+		t.Errorf("bad accept_env: %#v", c.AcceptEnv)
+	}
+	if c.RemoteExecuteCommand != "cd /srv && sh -c {{.Command}}" {
+		t.Errorf("bad remote_execute_command: %#v", c.RemoteExecuteCommand)
+	}
+	if !c.DebugShell || c.PackerOnError != "ask" {
+		t.Errorf("bad debug_shell: %#v %#v", c.DebugShell, c.PackerOnError)
+	}
+	if !c.Compression {
+		t.Errorf("bad compression: %#v", c.Compression)
+	}
+	if c.Command != "echo foo" {
+		t.Errorf("bad command: %#v", c.Command)
+	}
+	if !reflect.DeepEqual(c.Vars, []string{"FOO=bar"}) {
+		t.Errorf("bad environment_vars: %#v", c.Vars)
+	}
+	if len(c.Hosts) != 2 ||
+		!reflect.DeepEqual(c.Hosts[1].Match, []string{"bastion", "*.internal"}) ||
+		c.Hosts[1].SSHUsername != "admin" ||
+		c.Hosts[1].SSHTimeout != 30*time.Second {
+		t.Errorf("bad hosts: %#v", c.Hosts)
+	}
+
+	raw["unknown_key"] = "bad"
+	err = Decode(&Config{}, raw)
+	testConfigErr(t, err, "unknown_key")
+}
+
+// HCL2 configs are passed as a cty object of every attribute in ConfigSpec
+func TestDecodeHCL2(t *testing.T) {
+	var p Provisioner
+	attrs := make(map[string]cty.Value)
+	for k, spec := range p.ConfigSpec() {
+		attrs[k] = cty.NullVal(hcldec.ImpliedType(spec))
+	}
+	attrs["command"] = cty.StringVal("echo foo")
+	attrs["accept_env"] = cty.ListVal([]cty.Value{cty.StringVal("NIX_*")})
+
+	hostSpec := p.ConfigSpec()["hosts"].(*hcldec.BlockListSpec).Nested
+	hostAttrs := make(map[string]cty.Value)
+	for k, spec := range hostSpec.(hcldec.ObjectSpec) {
+		hostAttrs[k] = cty.NullVal(hcldec.ImpliedType(spec))
+	}
+	hostAttrs["match"] = cty.ListVal([]cty.Value{cty.StringVal("bastion")})
+	hostAttrs["ssh_host"] = cty.StringVal("192.0.2.1")
+	hostAttrs["ssh_timeout"] = cty.StringVal("30s")
+	attrs["hosts"] = cty.ListVal([]cty.Value{cty.ObjectVal(hostAttrs)})
+
+	var c Config
+	err := Decode(&c, cty.ObjectVal(attrs))
+	if err != nil {
+		t.Fatalf("bad: %s", err)
+	}
+	if !reflect.DeepEqual(c.AcceptEnv, []string{"NIX_*"}) {
+		t.Errorf("bad accept_env: %#v", c.AcceptEnv)
+	}
+	if c.Command != "echo foo" {
+		t.Errorf("bad command: %#v", c.Command)
+	}
+	if len(c.Hosts) != 1 ||
+		!reflect.DeepEqual(c.Hosts[0].Match, []string{"bastion"}) ||
+		c.Hosts[0].SSHHost != "192.0.2.1" ||
+		c.Hosts[0].SSHTimeout != 30*time.Second {
+		t.Errorf("bad hosts: %#v", c.Hosts)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		Key   string
+		Value interface{}
+		Err   bool
+	}{
+		{
+			"remote_execute_command",
+			"cd {{.WorkDir}} && env {{.Env}} sh -c {{.Command}}",
+			false,
+		},
+		{
+			"remote_execute_command",
+			"umask 022 && sh -c {{.Command",
+			true,
+		},
+		{
+			"hosts",
+			[]map[string]interface{}{
+				{"match": []string{"build"}},
+				{
+					"match":        []string{"bastion"},
+					"ssh_host":     "192.0.2.1",
+					"ssh_username": "admin",
+				},
+			},
+			false,
+		},
+		{
+			"hosts",
+			[]map[string]interface{}{{"ssh_host": "192.0.2.1"}},
+			true,
+		},
+		{
+			"hosts",
+			[]map[string]interface{}{
+				{"match": []string{"bastion"}, "ssh_host": "192.0.2.1"},
+			},
+			true,
+		},
+		{
+			"hosts",
+			[]map[string]interface{}{
+				{"match": []string{"bastion"}, "communicator": "ssh"},
+			},
+			true,
+		},
+		{
+			"hosts",
+			[]map[string]interface{}{
+				{"match": []string{"win"}, "communicator": "winrm"},
+			},
+			true,
+		},
+		{
+			"relay_command",
+			"socat - TCP:{{.Host}}:{{.Port}}",
+			false,
+		},
+		{
+			"relay_command",
+			"nc {{.Host}} {{.Port",
+			true,
+		},
+		{
+			"listen_command",
+			"socat TCP-LISTEN:{{.Port}},bind={{.Host}},reuseaddr -",
+			false,
+		},
+		{
+			"listen_command",
+			"nc -l {{.Host}} {{.Port",
+			true,
+		},
+		{
+			"agent_listen_command",
+			"mkdir -p {{.Dir}} && agent-mux {{.Path}}",
+			false,
+		},
+		{
+			"agent_listen_command",
+			"agent-mux {{.Path",
+			true,
+		},
+		{
+			"pty_command",
+			"script -qfec {{.Command}} /dev/null",
+			false,
+		},
+		{
+			"pty_command",
+			"script -qfec {{.Command /dev/null",
+			true,
+		},
+		{
+			"switch_user_command",
+			"sudo -u {{.User}} -H -- sh -c {{.Command}}",
+			false,
+		},
+		{
+			"switch_user_command",
+			"sudo -u {{.User -- sh -c {{.Command}}",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		raw := testConfig(t)
+		raw[tc.Key] = tc.Value
+
+		var c Config
+		err := Decode(&c, raw)
+		if err == nil {
+			err = Validate(&c)
+		}
+		if tc.Err {
+			testConfigErr(t, err, tc.Key)
+		} else {
+			testConfigOk(t, err)
+		}
+	}
+}
+
+// Build variables are rendered with the data generated by the builder
+func TestMatchHosts(t *testing.T) {
+	raw := testConfig(t)
+	raw["match_hosts"] = []string{"{{ build `Host` }}", "*.internal"}
+
+	var c Config
+	err := Decode(&c, raw, packer.BasicPlaceholderData())
+	testConfigOk(t, err)
+	if c.Command != "echo foo" {
+		t.Errorf("bad command: %#v", c.Command)
+	}
+
+	matchHosts, err := RenderPatterns(
+		c.MatchHosts,
+		map[string]interface{}{"Host": "192.0.2.1"},
+	)
+	testConfigOk(t, err)
+	if !reflect.DeepEqual(matchHosts, []string{"192.0.2.1", "*.internal"}) {
+		t.Errorf("bad match_hosts: %#v", matchHosts)
+	}
+}
+
+func TestConnectHosts(t *testing.T) {
+	sshSrv, err := sshtest.NewServer(
+		"tester", "secret", []string{"FAKESSH_HOSTNAME=second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sshSrv.Close()
+
+	raw := testConfig(t)
+	raw["hosts"] = []map[string]interface{}{
+		{"match": []string{"build"}},
+		{
+			"match":        []string{"second"},
+			"ssh_host":     sshSrv.Host(),
+			"ssh_port":     sshSrv.Port(),
+			"ssh_username": sshSrv.User,
+			"ssh_password": sshSrv.Password,
+		},
+	}
+	var c Config
+	err = Decode(&c, raw)
+	if err == nil {
+		err = Validate(&c)
+	}
+	testConfigOk(t, err)
+
+	routes, disconnect, err := ConnectHosts(
+		context.Background(),
+		packer.TestUi(t),
+		c.Hosts,
+		map[string]interface{}{"User": "packer"},
+	)
+	testConfigOk(t, err)
+	defer disconnect()
+	if len(routes) != 2 {
+		t.Fatalf("bad routes: %#v", routes)
+	}
+	if routes[0].Comm != nil || routes[0].CommUser != "packer" {
+		t.Errorf("bad build route: %#v", routes[0])
+	}
+	if routes[1].Comm == nil || routes[1].CommUser != "tester" {
+		t.Fatalf("bad ssh route: %#v", routes[1])
+	}
+
+	// expands the variable with either sh or cmd.exe
+	stdout := &bytes.Buffer{}
+	cmd := &packer.RemoteCmd{
+		Command: "echo %FAKESSH_HOSTNAME%$FAKESSH_HOSTNAME",
+		Stdout:  stdout,
+	}
+	err = routes[1].Comm.Start(context.Background(), cmd)
+	testConfigOk(t, err)
+	exitCode := cmd.Wait()
+	if exitCode != 0 ||
+		!strings.Contains(strings.TrimSpace(stdout.String()), "second") {
+		t.Errorf("bad command output: %d %#v", exitCode, stdout.String())
+	}
+
+	disconnect()
+	err = routes[1].Comm.Start(context.Background(), &packer.RemoteCmd{
+		Command: "true",
+	})
+	if err == nil {
+		t.Error("command started after disconnecting")
+	}
+}
+
 func testConfig(t *testing.T) map[string]interface{} {
 	return map[string]interface{}{
 		"command": "echo foo",
@@ -1,8 +1,12 @@
 #!/usr/bin/env bash
 
 echo "Checking that we are not using system ssh..."
-ssh -V
-[ $? -ne 255 ] && exit 1
+version="$(2>&1 ssh -V)"
+echo "$version"
+case "$version" in
+  *packer-provisioner-fakessh*) ;;
+  *) exit 1 ;;
+esac
 
 echo "Exit code test"
 ssh packer@fakessh exit 42
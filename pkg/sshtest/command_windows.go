@@ -0,0 +1,16 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// +build windows
+
+package sshtest
+
+import (
+	"os/exec"
+)
+
+// Run command by passing it directly as an argument to cmd.exe
+func shellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd.exe", "/c", command)
+}
@@ -0,0 +1,222 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+
+// An in-process ssh server that runs commands locally.
+//
+// Created for testing purposes. Only password authentication and exec
+// requests are supported.
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	packerssh "github.com/hashicorp/packer/communicator/ssh"
+	"github.com/hashicorp/packer/packer"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	EXIT_FAILURE = 255
+)
+
+// A running ssh server
+type Server struct {
+	// Address the server listens on
+	Addr string
+	// User and password accepted by the server
+	User     string
+	Password string
+	// Environment variables added to every command
+	Env []string
+
+	ln     net.Listener
+	config *ssh.ServerConfig
+}
+
+// Start an ssh server on a random local port accepting user with password
+func NewServer(user string, password string, env []string) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(
+			c ssh.ConnMetadata,
+			pass []byte,
+		) (*ssh.Permissions, error) {
+			if c.User() == user && string(pass) == password {
+				return nil, nil
+			}
+			return nil, errors.New("password rejected")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		Addr:     ln.Addr().String(),
+		User:     user,
+		Password: password,
+		Env:      env,
+		ln:       ln,
+		config:   config,
+	}
+	go srv.serve()
+	return srv, nil
+}
+
+// Host the server listens on
+func (srv *Server) Host() string {
+	host, _, _ := net.SplitHostPort(srv.Addr)
+	return host
+}
+
+// Port the server listens on
+func (srv *Server) Port() int {
+	_, port, _ := net.SplitHostPort(srv.Addr)
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Connect a packer ssh Communicator to the server
+func (srv *Server) Communicator() (packer.Communicator, error) {
+	comm, err := packerssh.New(srv.Addr, &packerssh.Config{
+		SSHConfig: &ssh.ClientConfig{
+			User:            srv.User,
+			Auth:            []ssh.AuthMethod{ssh.Password(srv.Password)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		},
+		Connection:             packerssh.ConnectFunc("tcp", srv.Addr),
+		DisableAgentForwarding: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comm, nil
+}
+
+// Stop accepting connections
+func (srv *Server) Close() error {
+	return srv.ln.Close()
+}
+
+func (srv *Server) serve() {
+	for {
+		nc, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		go srv.handleConn(nc)
+	}
+}
+
+func (srv *Server) handleConn(nc net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, srv.config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.handleSession(ch, reqs)
+	}
+}
+
+// Handle env requests until an exec request, then run the command
+func (srv *Server) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	env := append(os.Environ(), srv.Env...)
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var kv struct {
+				Name  string
+				Value string
+			}
+			err := ssh.Unmarshal(req.Payload, &kv)
+			if err == nil {
+				env = append(env, kv.Name+"="+kv.Value)
+			}
+			req.Reply(err == nil, nil)
+		case "exec":
+			var exe struct {
+				Command string
+			}
+			err := ssh.Unmarshal(req.Payload, &exe)
+			req.Reply(err == nil, nil)
+			if err != nil {
+				continue
+			}
+			go ssh.DiscardRequests(reqs)
+
+			status := run(shellCommand(exe.Command), env, ch)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct {
+				Status uint32
+			}{uint32(status)}))
+			return
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// Run cmd with the stdio of ch and return its exit code
+//
+// Like sshd, do not wait for stdin to be closed once the command exits.
+func run(cmd *exec.Cmd, env []string, ch ssh.Channel) int {
+	cmd.Env = env
+	cmd.Stdout = ch
+	cmd.Stderr = ch.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return EXIT_FAILURE
+	}
+	err = cmd.Start()
+	if err != nil {
+		return EXIT_FAILURE
+	}
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+
+	err = cmd.Wait()
+	if err != nil {
+		exitError, ok := err.(*exec.ExitError)
+		if ok {
+			return exitError.ExitCode()
+		}
+		return EXIT_FAILURE
+	}
+	return 0
+}